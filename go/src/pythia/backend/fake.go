@@ -0,0 +1,300 @@
+// Copyright 2013 The Pythia Authors.
+// This file is part of Pythia.
+//
+// Pythia is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, version 3 of the License.
+//
+// Pythia is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Pythia.  If not, see <http://www.gnu.org/licenses/>.
+
+package backend
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"pythia"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	Sandboxes["fake"] = SandboxInfo{
+		Name:        "fake",
+		Description: "In-process fake executing a script given as input (for testing)",
+		New: func(config *SandboxConfig) Sandbox {
+			return newFakeSandbox()
+		},
+	}
+}
+
+// A fakeSandbox does not execute the task, but interprets its input as a
+// script describing the behaviour of the job. It allows to test the pool and
+// the queue without building the virtual machine, and to benchmark the
+// platform without running real jobs.
+//
+// The script contains one command per line:
+//
+//	sleep DURATION   wait for DURATION (e.g. 100ms)
+//	spin DURATION    wait for DURATION, counted as CPU time
+//	echo TEXT        write TEXT and a newline on the output
+//	warn TEXT        write TEXT and a newline on the standard error
+//	file NAME TEXT   write TEXT and a newline in the result file NAME
+//	cat NAME         write the content of the input file NAME on the output
+//	step REPORT      report a step of the control file as the init process
+//	                 (see parseSteps), and terminate if the step stops
+//	flood            write on the output until the job is killed
+//	hang             wait until the job is killed
+//	exit STATUS      terminate successfully if STATUS is 0, crash otherwise
+//	fail MESSAGE     make the sandbox fail with MESSAGE
+//
+// The job terminates successfully at the end of the script. Empty lines are
+// ignored. If the task declares a results directory, the result files are
+// exported as by a real sandbox, whatever the outcome of the script.
+type fakeSandbox struct {
+	task *pythia.Task
+
+	// Environment and memory limit given to Start, if called
+	started     bool
+	environment string
+	memory      int
+
+	// Steps reported by the script
+	steps []byte
+
+	// Result files written by the script, in order
+	files []fakeFile
+
+	// Closed when the sandbox is aborted
+	aborted chan bool
+
+	// CPU time consumed, and start of the current spin command, if any
+	cpu      time.Duration
+	spinning time.Time
+
+	// Mutex protecting cpu and spinning
+	mutex sync.Mutex
+
+	// Ensures aborted is closed once
+	once sync.Once
+
+	result SandboxResult
+}
+
+// NewFakeSandbox returns a new fake sandbox.
+func newFakeSandbox() *fakeSandbox {
+	return &fakeSandbox{aborted: make(chan bool)}
+}
+
+// A fakeFile is a result file written by a fake sandbox.
+type fakeFile struct {
+	name, content string
+}
+
+// Start only records the environment and memory limit of the tasks accepted
+// by the sandbox, as there is nothing to boot.
+func (sb *fakeSandbox) Start(environment string, memory int) error {
+	sb.started = true
+	sb.environment = environment
+	sb.memory = memory
+	return nil
+}
+
+// Prepare stores the task, whose only used parameters are the results
+// directory and its limit. If the sandbox has been started, the task shall
+// match its environment and memory limit.
+func (sb *fakeSandbox) Prepare(task *pythia.Task) error {
+	if sb.started && (task.Environment != sb.environment || task.Limits.Memory != sb.memory) {
+		return errors.New("Sandbox started for another environment")
+	}
+	sb.task = task
+	return nil
+}
+
+// Run interprets the script given as input, and exports the result files.
+func (sb *fakeSandbox) Run(input string, files map[string][]byte, output, stderr io.Writer) error {
+	if stderr == nil {
+		stderr = output
+	}
+	err := sb.run(input, files, output, stderr)
+	sb.result.CpuTime = sb.CpuTime()
+	sb.result.Steps, sb.result.Stopped = parseSteps(sb.steps)
+	if err != nil {
+		return err
+	}
+	if sb.task.Results != "" {
+		sb.result.Results = sb.archive()
+	}
+	return nil
+}
+
+// Run interprets the script.
+func (sb *fakeSandbox) run(input string, files map[string][]byte, output, stderr io.Writer) error {
+	for _, line := range strings.Split(input, "\n") {
+		fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+		cmd, arg := fields[0], ""
+		if len(fields) > 1 {
+			arg = fields[1]
+		}
+		select {
+		case <-sb.aborted:
+			return nil
+		default:
+		}
+		switch cmd {
+		case "":
+		case "sleep":
+			d, err := time.ParseDuration(arg)
+			if err != nil {
+				return err
+			}
+			select {
+			case <-time.After(d):
+			case <-sb.aborted:
+				return nil
+			}
+		case "spin":
+			d, err := time.ParseDuration(arg)
+			if err != nil {
+				return err
+			}
+			if !sb.spin(d) {
+				return nil
+			}
+		case "echo":
+			if _, err := io.WriteString(output, arg+"\n"); err != nil {
+				return err
+			}
+		case "warn":
+			if _, err := io.WriteString(stderr, arg+"\n"); err != nil {
+				return err
+			}
+		case "file":
+			fields := strings.SplitN(arg, " ", 2)
+			file := fakeFile{name: fields[0]}
+			if len(fields) > 1 {
+				file.content = fields[1]
+			}
+			file.content += "\n"
+			sb.files = append(sb.files, file)
+		case "cat":
+			content, ok := files[arg]
+			if !ok {
+				return fmt.Errorf("No input file '%s'", arg)
+			}
+			if _, err := output.Write(content); err != nil {
+				return err
+			}
+		case "step":
+			sb.steps = append(sb.steps, arg+"\n"...)
+			if _, stop := parseSteps([]byte(arg)); stop {
+				sb.result.Success = true
+				return nil
+			}
+		case "flood":
+			for {
+				select {
+				case <-sb.aborted:
+					return nil
+				default:
+				}
+				if _, err := io.WriteString(output, "flood\n"); err != nil {
+					return err
+				}
+			}
+		case "hang":
+			<-sb.aborted
+			return nil
+		case "exit":
+			status, err := strconv.Atoi(arg)
+			if err != nil {
+				return err
+			}
+			sb.result.Success = status == 0
+			return nil
+		case "fail":
+			return errors.New(arg)
+		default:
+			return fmt.Errorf("Unknown fake sandbox command '%s'", cmd)
+		}
+	}
+	sb.result.Success = true
+	return nil
+}
+
+// Spin waits for d, counted as CPU time, and returns false if the sandbox has
+// been aborted meanwhile.
+func (sb *fakeSandbox) spin(d time.Duration) bool {
+	sb.mutex.Lock()
+	sb.spinning = time.Now()
+	sb.mutex.Unlock()
+	defer func() {
+		sb.mutex.Lock()
+		sb.cpu += time.Since(sb.spinning)
+		sb.spinning = time.Time{}
+		sb.mutex.Unlock()
+	}()
+	select {
+	case <-time.After(d):
+		return true
+	case <-sb.aborted:
+		return false
+	}
+}
+
+// Archive returns the content of the device on which the result files have
+// been archived.
+func (sb *fakeSandbox) archive() []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&deviceWriter{W: &buf, Size: resultsSize(sb.task)})
+	for _, file := range sb.files {
+		hdr := &tar.Header{
+			Name:     file.name,
+			Mode:     0644,
+			Size:     int64(len(file.content)),
+			Typeflag: tar.TypeReg,
+		}
+		if tw.WriteHeader(hdr) != nil {
+			break
+		}
+		if _, err := io.WriteString(tw, file.content); err != nil {
+			break
+		}
+	}
+	tw.Close()
+	return buf.Bytes()
+}
+
+// Abort interrupts the script.
+func (sb *fakeSandbox) Abort() {
+	sb.once.Do(func() {
+		close(sb.aborted)
+	})
+}
+
+// CpuTime returns the time spent in spin commands.
+func (sb *fakeSandbox) CpuTime() time.Duration {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	if sb.spinning.IsZero() {
+		return sb.cpu
+	}
+	return sb.cpu + time.Since(sb.spinning)
+}
+
+// Result returns the outcome of the script.
+func (sb *fakeSandbox) Result() SandboxResult {
+	return sb.result
+}
+
+// vim:set sw=4 ts=4 noet:
@@ -0,0 +1,585 @@
+// Copyright 2013 The Pythia Authors.
+// This file is part of Pythia.
+//
+// Pythia is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, version 3 of the License.
+//
+// Pythia is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Pythia.  If not, see <http://www.gnu.org/licenses/>.
+
+package backend
+
+import (
+	"pythia"
+	"strings"
+	"testing"
+	"testutils"
+	"time"
+)
+
+// These tests use the fake sandbox, and do not need the virtual machine.
+
+// NewFakeTask returns a task with the given time and output limits.
+func newFakeTask(time, output int) pythia.Task {
+	task := pythia.Task{Environment: "fake", TaskFS: "fake.sfs"}
+	task.Limits.Time = time
+	task.Limits.Memory = 32
+	task.Limits.Output = output
+	return task
+}
+
+// NewFakeJob creates a job executing script in a fake sandbox.
+func newFakeJob(task pythia.Task, script string) *Job {
+	job := NewJob()
+	job.Sandbox = "fake"
+	job.Task = task
+	job.Input = script
+	return job
+}
+
+func TestFakeJob(t *testing.T) {
+	for _, c := range []struct {
+		script string
+		status pythia.Status
+		limit  pythia.Limit
+		output string
+	}{
+		{"echo Hello world!", pythia.Success, "", "Hello world!\n"},
+		{"sleep 10ms\necho a\n\necho b\n", pythia.Success, "", "a\nb\n"},
+		{"echo a\r\nexit 0\necho b", pythia.Success, "", "a\n"},
+		{"echo a\nexit 1", pythia.Crash, "", "a\n"},
+		{"echo a\nfail broken", pythia.Error, "", "broken"},
+		{"flood", pythia.Overflow, pythia.OutputLimit,
+			strings.Repeat("flood\n", 10)[:32]},
+		{"echo a\nhang", pythia.Timeout, pythia.TimeLimit, "a\n"},
+	} {
+		job := newFakeJob(newFakeTask(1, 32), c.script)
+		wd := testutils.Watchdog(t, 2)
+		status, output := job.Execute()
+		wd.Stop()
+		testutils.Expect(t, c.script+" status", c.status, status)
+		testutils.Expect(t, c.script+" limit", c.limit, job.Limit())
+		testutils.Expect(t, c.script+" output", c.output, output)
+	}
+}
+
+func TestFakeJobCpuTime(t *testing.T) {
+	for _, c := range []struct {
+		script  string
+		cputime int
+		status  pythia.Status
+		limit   pythia.Limit
+	}{
+		{"spin 100ms\nsleep 100ms\necho a", 1, pythia.Success, ""},
+		{"sleep 1500ms\necho a", 1, pythia.Success, ""},
+		{"echo a\nspin 5s", 1, pythia.Timeout, pythia.CpuTimeLimit},
+		{"echo a\nspin 5s", 0, pythia.Timeout, pythia.TimeLimit},
+	} {
+		task := newFakeTask(2, 32)
+		task.Limits.CpuTime = c.cputime
+		job := newFakeJob(task, c.script)
+		wd := testutils.Watchdog(t, 3)
+		start := time.Now()
+		status, output := job.Execute()
+		wd.Stop()
+		testutils.Expect(t, c.script+" status", c.status, status)
+		testutils.Expect(t, c.script+" limit", c.limit, job.Limit())
+		testutils.Expect(t, c.script+" output", "a\n", output)
+		if c.limit == pythia.CpuTimeLimit && time.Since(start) > 1500*time.Millisecond {
+			t.Error("CPU time limit enforced late:", time.Since(start))
+		}
+	}
+}
+
+func TestFakeJobCleanup(t *testing.T) {
+	testutils.CheckGoroutines(t, func() {
+		job := newFakeJob(newFakeTask(1, 32), "echo a\nsleep 10ms")
+		job.Execute()
+	})
+}
+
+func TestFakeJobAbort(t *testing.T) {
+	job := newFakeJob(newFakeTask(5, 32), "echo a\nhang")
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		job.Abort()
+	}()
+	wd := testutils.Watchdog(t, 1)
+	status, output := job.Execute()
+	wd.Stop()
+	testutils.Expect(t, "status", pythia.Abort, status)
+	testutils.Expect(t, "output", "a\n", output)
+	// A job aborted before its execution shall not run.
+	job = newFakeJob(newFakeTask(5, 32), "echo a\nhang")
+	job.Abort()
+	status, output = job.Execute()
+	testutils.Expect(t, "status", pythia.Abort, status)
+	testutils.Expect(t, "output", "", output)
+}
+
+func TestFakeJobUsage(t *testing.T) {
+	job := newFakeJob(newFakeTask(1, 32), "sleep 50ms\necho abc")
+	job.Execute()
+	usage := job.Usage()
+	if usage.WallTime < 0.05 || usage.WallTime > 1 {
+		t.Error("Invalid wall time", usage.WallTime)
+	}
+	testutils.Expect(t, "output", 4, usage.Output)
+	job = newFakeJob(newFakeTask(1, 32), "flood")
+	job.Execute()
+	if usage := job.Usage(); usage.Output <= 32 {
+		t.Error("Output size does not include overflow:", usage.Output)
+	}
+}
+
+func TestFakeJobStderr(t *testing.T) {
+	for _, c := range []struct {
+		script string
+		limit  int
+		status pythia.Status
+		output string
+		stderr string
+		size   int
+	}{
+		{"echo a\nwarn b\necho c", 16, pythia.Success, "a\nc\n", "b\n", 2},
+		{"echo a\nwarn b\necho c", 0, pythia.Success, "a\nb\nc\n", "", 0},
+		{"warn a\r\nwarn b", 16, pythia.Success, "", "a\nb\n", 4},
+		{"warn 0123456789\nwarn 0123456789", 16, pythia.Overflow, "",
+			"0123456789\n01234", 22},
+	} {
+		task := newFakeTask(1, 32)
+		task.Limits.Stderr = c.limit
+		job := newFakeJob(task, c.script)
+		status, output := job.Execute()
+		testutils.Expect(t, c.script+" status", c.status, status)
+		if status == pythia.Overflow {
+			testutils.Expect(t, c.script+" limit", pythia.StderrLimit, job.Limit())
+		}
+		testutils.Expect(t, c.script+" output", c.output, output)
+		testutils.Expect(t, c.script+" stderr", c.stderr, job.Stderr())
+		testutils.Expect(t, c.script+" stderr size", c.size, job.Usage().Stderr)
+	}
+}
+
+func TestFakeJobResults(t *testing.T) {
+	for _, c := range []struct {
+		script string
+		limit  int
+		status pythia.Status
+		files  map[string][]byte
+		result string
+	}{
+		{"echo a\nfile a.txt Hello\nfile result.json {\"a\": [1, 2]}", 0,
+			pythia.Success, map[string][]byte{"a.txt": []byte("Hello\n")},
+			`{"a":[1,2]}`},
+		{"file result.json {\"a\"", 0, pythia.Success,
+			map[string][]byte{"result.json": []byte("{\"a\"\n")}, ""},
+		{"file a\nexit 1", 0, pythia.Crash,
+			map[string][]byte{"a": []byte("\n")}, ""},
+		{"echo a", 0, pythia.Success, map[string][]byte{}, ""},
+		{"file a " + strings.Repeat("a", 600), 512, pythia.Overflow,
+			map[string][]byte{}, ""},
+		{"file a 1\nfile b " + strings.Repeat("b", 600), 1024, pythia.Overflow,
+			map[string][]byte{"a": []byte("1\n")}, ""},
+		{"file a 1\nfile b/c 2", 0, pythia.Error, nil, ""},
+	} {
+		task := newFakeTask(1, 32)
+		task.Results = "/tmp/results"
+		task.Limits.Results = c.limit
+		job := newFakeJob(task, c.script)
+		status, _ := job.Execute()
+		files, result := job.Results()
+		testutils.Expect(t, c.script+" status", c.status, status)
+		if status == pythia.Overflow {
+			testutils.Expect(t, c.script+" limit", pythia.ResultsLimit, job.Limit())
+		}
+		testutils.Expect(t, c.script+" files", c.files, files)
+		testutils.Expect(t, c.script+" result", c.result, string(result))
+	}
+	// Without a results directory, no file is returned.
+	job := newFakeJob(newFakeTask(1, 32), "file a b")
+	job.Execute()
+	if files, result := job.Results(); files != nil || result != nil {
+		t.Error("Unexpected results", files, result)
+	}
+}
+
+func TestFakeJobReleaseSandbox(t *testing.T) {
+	// A sandbox started ahead of time is released if the job fails before
+	// running it.
+	for _, c := range []struct {
+		environment string
+		files       map[string][]byte
+		status      pythia.Status
+	}{
+		{"fake", map[string][]byte{"../a": nil}, pythia.Fatal},
+		{"other", nil, pythia.Error},
+	} {
+		sandbox := newFakeSandbox()
+		sandbox.Start(c.environment, 32)
+		job := newFakeJob(newFakeTask(1, 32), "echo a")
+		job.Files = c.files
+		job.sandbox = sandbox
+		status, _ := job.Execute()
+		testutils.Expect(t, "status", c.status, status)
+		select {
+		case <-sandbox.aborted:
+		default:
+			t.Error("Sandbox not released on status", status)
+		}
+	}
+}
+
+func TestFakeJobSteps(t *testing.T) {
+	for _, c := range []struct {
+		script string
+		status pythia.Status
+		limit  pythia.Limit
+		output string
+		steps  []pythia.StepResult
+	}{
+		{"echo a", pythia.Success, "", "a\n", nil},
+		{"echo a\nstep 2 crash - continue check\necho b", pythia.Success, "",
+			"a\nb\n", []pythia.StepResult{
+				{Line: 2, Name: "check", Status: pythia.Crash},
+			}},
+		{"step 1 timeout time continue run\nstep 3 crash - stop\necho b",
+			pythia.Success, "", "", []pythia.StepResult{
+				{Line: 1, Name: "run", Status: pythia.Timeout, Limit: pythia.TimeLimit},
+				{Line: 3, Status: pythia.Crash},
+			}},
+		{"echo a\nstep 2 timeout time stop run\necho b", pythia.Timeout,
+			pythia.TimeLimit, "a\n", []pythia.StepResult{
+				{Line: 2, Name: "run", Status: pythia.Timeout, Limit: pythia.TimeLimit},
+			}},
+		{"step 1 overflow output stop", pythia.Overflow, pythia.OutputLimit, "",
+			[]pythia.StepResult{
+				{Line: 1, Status: pythia.Overflow, Limit: pythia.OutputLimit},
+			}},
+	} {
+		job := newFakeJob(newFakeTask(1, 32), c.script)
+		status, output := job.Execute()
+		testutils.Expect(t, c.script+" status", c.status, status)
+		testutils.Expect(t, c.script+" limit", c.limit, job.Limit())
+		testutils.Expect(t, c.script+" output", c.output, output)
+		testutils.Expect(t, c.script+" steps", c.steps, job.Steps())
+	}
+}
+
+func TestFakeJobFiles(t *testing.T) {
+	job := newFakeJob(newFakeTask(1, 32), "cat a.txt\ncat src/b")
+	job.Files = map[string][]byte{"a.txt": []byte("a\n"), "src/b": []byte("b\n")}
+	status, output := job.Execute()
+	testutils.Expect(t, "status", pythia.Success, status)
+	testutils.Expect(t, "output", "a\nb\n", output)
+	// Jobs with invalid file names are not executed.
+	job = newFakeJob(newFakeTask(1, 32), "echo a")
+	job.Files = map[string][]byte{"../a.txt": nil}
+	status, _ = job.Execute()
+	testutils.Expect(t, "status", pythia.Fatal, status)
+}
+
+func TestFakeJobStream(t *testing.T) {
+	job := newFakeJob(newFakeTask(1, 16), "echo a\r\nsleep 10ms\necho b\nflood")
+	var chunks []string
+	job.Stream = func(chunk string) { chunks = append(chunks, chunk) }
+	status, output := job.Execute()
+	testutils.Expect(t, "status", pythia.Overflow, status)
+	if len(chunks) < 2 {
+		t.Errorf("Expected several chunks, got %q", chunks)
+	}
+	testutils.Expect(t, "streamed output", output, strings.Join(chunks, ""))
+}
+
+func TestFakeJobStreamLineEndings(t *testing.T) {
+	var chunks []string
+	s := &outputStream{f: func(chunk string) { chunks = append(chunks, chunk) }}
+	for _, p := range []string{"a\r", "\nb\r", "c\r"} {
+		s.write([]byte(p))
+	}
+	s.flush()
+	testutils.Expect(t, "chunks", []string{"a", "\nb", "\rc", "\r"}, chunks)
+}
+
+func TestFakePool(t *testing.T) {
+	pool := NewPool()
+	pool.Capacity = 2
+	pool.Sandbox = "fake"
+	f := SetupPoolFixtureWith(t, pool)
+	task := newFakeTask(1, 32)
+	f.Conn.Send(pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      "hang",
+		Task:    &task,
+		Input:   "echo Start\nhang",
+	})
+	f.Conn.Send(pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      "hello",
+		Task:    &task,
+		Input:   "echo Hello",
+	})
+	f.Conn.Expect(1, pythia.Message{
+		Message: pythia.DoneMsg,
+		Id:      "hello",
+		Status:  pythia.Success,
+		Output:  "Hello\n",
+	})
+	f.Conn.Send(pythia.Message{Message: pythia.AbortMsg, Id: "hang"})
+	f.Conn.Expect(1, pythia.Message{
+		Message: pythia.DoneMsg,
+		Id:      "hang",
+		Status:  pythia.Abort,
+		Output:  "Start\n",
+	})
+	f.TearDown()
+}
+
+func TestFakePoolStream(t *testing.T) {
+	pool := NewPool()
+	pool.Sandbox = "fake"
+	f := SetupPoolFixtureWith(t, pool)
+	task := newFakeTask(1, 32)
+	f.Conn.Send(pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      "job",
+		Task:    &task,
+		Input:   "echo a\necho b\nsleep 300ms\necho c",
+		Stream:  true,
+	})
+	// The chunks written together are sent in a single message, and the
+	// last ones are sent before the result.
+	for _, expected := range []pythia.Message{
+		{Message: pythia.OutputMsg, Id: "job", Output: "a\nb\n"},
+		{Message: pythia.OutputMsg, Id: "job", Output: "c\n"},
+		{Message: pythia.DoneMsg, Id: "job", Status: pythia.Success,
+			Output: "a\nb\nc\n"},
+	} {
+		f.Conn.Expect(1, expected)
+	}
+	f.TearDown()
+}
+
+func TestFakePoolWarm(t *testing.T) {
+	pool := NewPool()
+	pool.Sandbox = "fake"
+	pool.Warm = 1
+	pool.Memory = 64
+	f := SetupPoolFixtureWith(t, pool)
+	small, large := newFakeTask(1, 32), newFakeTask(1, 32)
+	large.Limits.Memory = 48
+	for _, c := range []struct {
+		id   string
+		task *pythia.Task
+		warm bool
+	}{
+		// The first job of a kind starts a sandbox for the next one.
+		{"a", &small, false},
+		{"b", &small, true},
+		{"c", &small, true},
+		// The sandbox started for small jobs is released for a large job,
+		// and no sandbox fits along with it until it is done.
+		{"d", &large, false},
+		{"e", &large, true},
+		{"f", &small, false},
+	} {
+		waitWarm(pool)
+		f.Conn.Send(pythia.Message{
+			Message: pythia.LaunchMsg,
+			Id:      c.id,
+			Task:    c.task,
+			Input:   "echo " + c.id,
+		})
+		msg := f.Conn.Receive(1)
+		testutils.Expect(t, "id", c.id, msg.Id)
+		testutils.Expect(t, "status", pythia.Success, msg.Status)
+		if msg.Usage == nil || msg.Usage.Warm != c.warm {
+			t.Errorf("Job %s: expected warm %v, got usage %v", c.id, c.warm, msg.Usage)
+		}
+	}
+	f.TearDown()
+	// The sandboxes are released once the pool has stopped.
+	testutils.Expect(t, "warm memory", 0, waitWarmMemory(pool))
+}
+
+func TestFakePoolWarmInvalidFiles(t *testing.T) {
+	pool := NewPool()
+	pool.Sandbox = "fake"
+	pool.Warm = 1
+	f := SetupPoolFixtureWith(t, pool)
+	task := newFakeTask(1, 32)
+	for _, c := range []struct {
+		id     string
+		files  map[string][]byte
+		status pythia.Status
+		warm   bool
+	}{
+		{"a", nil, pythia.Success, false},
+		// A job with invalid input files is rejected without taking the
+		// sandbox started ahead of time, which is given to the next job.
+		{"b", map[string][]byte{"../b": nil}, pythia.Fatal, false},
+		{"c", nil, pythia.Success, true},
+	} {
+		waitWarm(pool)
+		f.Conn.Send(pythia.Message{
+			Message: pythia.LaunchMsg,
+			Id:      c.id,
+			Task:    &task,
+			Input:   "echo " + c.id,
+			Files:   c.files,
+		})
+		msg := f.Conn.Receive(1)
+		testutils.Expect(t, "id", c.id, msg.Id)
+		testutils.Expect(t, "status", c.status, msg.Status)
+		if warm := msg.Usage != nil && msg.Usage.Warm; warm != c.warm {
+			t.Errorf("Job %s: expected warm %v, got usage %v", c.id, c.warm, msg.Usage)
+		}
+	}
+	f.TearDown()
+	testutils.Expect(t, "warm memory", 0, waitWarmMemory(pool))
+}
+
+// WaitWarm waits for the sandboxes of pool being started ahead of time to be
+// ready.
+func waitWarm(pool *Pool) {
+	for i := 0; i < 100; i++ {
+		booting := 0
+		pool.mutex.Lock()
+		for _, n := range pool.booting {
+			booting += n
+		}
+		pool.mutex.Unlock()
+		if booting == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// WaitWarmMemory waits for the sandboxes of pool started ahead of time to be
+// released, and returns the memory still allocated to them.
+func waitWarmMemory(pool *Pool) int {
+	memory := -1
+	for i := 0; i < 100 && memory != 0; i++ {
+		time.Sleep(time.Millisecond)
+		pool.mutex.Lock()
+		memory = pool.warmMemory
+		pool.mutex.Unlock()
+	}
+	return memory
+}
+
+func TestFakeQueuePool(t *testing.T) {
+	f := SetupQueueFixture(t, 500, 1)
+	frontend := f.Clients[0]
+	frontend.IgnoreUsage = true
+	pool := NewPool()
+	pool.Sandbox = "fake"
+	go pool.Run()
+	defer pool.Shutdown()
+	task := newFakeTask(1, 32)
+	for _, c := range []struct {
+		script string
+		status pythia.Status
+		limit  pythia.Limit
+		output string
+	}{
+		{"sleep 10ms\necho Hello", pythia.Success, "", "Hello\n"},
+		{"flood", pythia.Overflow, pythia.OutputLimit,
+			strings.Repeat("flood\n", 10)[:32]},
+		{"echo a\nhang", pythia.Timeout, pythia.TimeLimit, "a\n"},
+	} {
+		frontend.Send(pythia.Message{
+			Message: pythia.LaunchMsg,
+			Id:      "job",
+			Task:    &task,
+			Input:   c.script,
+		})
+		frontend.Expect(2, pythia.Message{
+			Message: pythia.DoneMsg,
+			Id:      "job",
+			Status:  c.status,
+			Limit:   c.limit,
+			Output:  c.output,
+		})
+	}
+	f.TearDown()
+}
+
+// A streamed job whose pool is lost in the middle of the execution is
+// dispatched again, and the output seen by the front-end starts over.
+func TestFakeQueuePoolLost(t *testing.T) {
+	f := SetupQueueFixture(t, 500, 2)
+	frontend, lost := f.Clients[0], f.Clients[1]
+	frontend.IgnoreUsage = true
+	lost.Send(pythia.Message{
+		Message:  pythia.RegisterPoolMsg,
+		Capacity: 1,
+	})
+	task := newFakeTask(1, 32)
+	frontend.Send(pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      "job",
+		Task:    &task,
+		Input:   "echo a\nsleep 50ms\necho b",
+		Stream:  true,
+	})
+	lost.Expect(1, pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      "0:job",
+		Task:    &task,
+		Input:   "echo a\nsleep 50ms\necho b",
+		Stream:  true,
+	})
+	lost.Send(pythia.Message{
+		Message: pythia.OutputMsg,
+		Id:      "0:job",
+		Output:  "a\nstale",
+	})
+	frontend.Expect(1, pythia.Message{
+		Message: pythia.StartedMsg,
+		Id:      "job",
+	}, pythia.Message{
+		Message: pythia.OutputMsg,
+		Id:      "job",
+		Output:  "a\nstale",
+	})
+	pool := NewPool()
+	pool.Sandbox = "fake"
+	go pool.Run()
+	defer pool.Shutdown()
+	lost.Close()
+	f.Clients[1] = nil
+	// Follow the output as a front-end does, starting over on each started
+	// message.
+	output := ""
+	for {
+		msg := frontend.Receive(2)
+		switch msg.Message {
+		case pythia.StartedMsg:
+			output = ""
+		case pythia.OutputMsg:
+			output += msg.Output
+		case pythia.DoneMsg:
+			if msg.Status != pythia.Success || msg.Output != "a\nb\n" {
+				t.Error("Unexpected result", msg)
+			}
+			if !strings.HasPrefix("a\nb\n", output) {
+				t.Errorf("Streamed output %q, expected a prefix of %q",
+					output, "a\nb\n")
+			}
+			f.TearDown()
+			return
+		default:
+			t.Fatal("Unexpected message", msg)
+		}
+	}
+}
+
+// vim:set sw=4 ts=4 noet:
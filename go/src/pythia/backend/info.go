@@ -0,0 +1,168 @@
+// Copyright 2013 The Pythia Authors.
+// This file is part of Pythia.
+//
+// Pythia is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, version 3 of the License.
+//
+// Pythia is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Pythia.  If not, see <http://www.gnu.org/licenses/>.
+
+package backend
+
+import (
+	"pythia"
+	"sort"
+)
+
+// This file contains the functions building the answers to the introspection
+// messages (status, list-jobs and job-info). They shall be called from the
+// queue main goroutine.
+
+// Connected returns whether client is an active connection (as opposed to the
+// holder of a disconnected session).
+func (queue *Queue) connected(client *queueClient) bool {
+	return client != nil && queue.clients[client.Id] == client
+}
+
+// ClientInfo returns the description of client.
+func (queue *Queue) clientInfo(client *queueClient) pythia.ClientInfo {
+	info := pythia.ClientInfo{
+		Id:           -1,
+		Session:      client.Session,
+		Connected:    queue.connected(client),
+		Capacity:     client.Capacity,
+		Memory:       client.Memory,
+		Environments: setElements(client.Environments),
+		Tasks:        setElements(client.Tasks),
+		MemoryUsed:   client.MemoryUsed,
+		Executed:     client.Executed,
+		WarmHits:     client.WarmHits,
+		Waiting:      client.Waiting,
+		InFlight:     client.InFlight,
+		Draining:     client.Draining,
+	}
+	if info.Connected {
+		info.Id = client.Id
+	}
+	for id := range client.Running {
+		info.Running = append(info.Running, id)
+	}
+	sort.Strings(info.Running)
+	return info
+}
+
+// JobInfo returns the description of job.
+func (queue *Queue) jobInfo(job *queueJob) pythia.JobInfo {
+	info := pythia.JobInfo{
+		Id:       job.Id,
+		State:    "done",
+		Task:     job.Msg.Task,
+		Priority: job.Msg.Priority,
+		Session:  job.Session,
+		Client:   -1,
+		Pool:     -1,
+	}
+	if job.WaitingElement != nil {
+		info.State = "waiting"
+	} else if job.Pool != nil {
+		info.State = "running"
+		if queue.connected(job.Pool) {
+			info.Pool = job.Pool.Id
+		}
+	}
+	if queue.connected(job.Origin) {
+		info.Client = job.Origin.Id
+	}
+	if !job.Queued.IsZero() {
+		t := job.Queued
+		info.Queued = &t
+	}
+	if !job.Started.IsZero() {
+		t := job.Started
+		info.Started = &t
+	}
+	return info
+}
+
+// Status returns the description of the queue and of its clients, including
+// the sessions of disconnected clients.
+func (queue *Queue) status() *pythia.QueueInfo {
+	info := &pythia.QueueInfo{
+		Capacity: queue.Capacity,
+		Waiting:  queue.waiting.Len(),
+		Clients:  []pythia.ClientInfo{},
+	}
+	for _, job := range queue.jobs {
+		if job.Pool != nil {
+			info.Running++
+		} else if job.Result != nil {
+			info.Done++
+		}
+	}
+	for _, client := range queue.clients {
+		info.Clients = append(info.Clients, queue.clientInfo(client))
+	}
+	for _, client := range queue.sessions {
+		if !queue.connected(client) {
+			info.Clients = append(info.Clients, queue.clientInfo(client))
+		}
+	}
+	sort.Sort(clientInfos(info.Clients))
+	return info
+}
+
+// ListJobs returns the description of all jobs, sorted by queuing time.
+func (queue *Queue) listJobs() []pythia.JobInfo {
+	jobs := make([]*queueJob, 0, len(queue.jobs))
+	for _, job := range queue.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Sort(queueJobsByQueued(jobs))
+	infos := make([]pythia.JobInfo, len(jobs))
+	for i, job := range jobs {
+		infos[i] = queue.jobInfo(job)
+	}
+	return infos
+}
+
+// SetElements returns the sorted elements of set.
+func setElements(set map[string]bool) []string {
+	var elements []string
+	for e := range set {
+		elements = append(elements, e)
+	}
+	sort.Strings(elements)
+	return elements
+}
+
+// ClientInfos sorts client descriptions by identifier, then session.
+type clientInfos []pythia.ClientInfo
+
+func (s clientInfos) Len() int      { return len(s) }
+func (s clientInfos) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s clientInfos) Less(i, j int) bool {
+	if s[i].Id != s[j].Id {
+		return s[i].Id < s[j].Id
+	}
+	return s[i].Session < s[j].Session
+}
+
+// QueueJobsByQueued sorts jobs by queuing time, then identifier.
+type queueJobsByQueued []*queueJob
+
+func (s queueJobsByQueued) Len() int      { return len(s) }
+func (s queueJobsByQueued) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s queueJobsByQueued) Less(i, j int) bool {
+	if !s[i].Queued.Equal(s[j].Queued) {
+		return s[i].Queued.Before(s[j].Queued)
+	}
+	return s[i].Id < s[j].Id
+}
+
+// vim:set sw=4 ts=4 noet:
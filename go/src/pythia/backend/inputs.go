@@ -0,0 +1,54 @@
+// Copyright 2013 The Pythia Authors.
+// This file is part of Pythia.
+//
+// Pythia is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, version 3 of the License.
+//
+// Pythia is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Pythia.  If not, see <http://www.gnu.org/licenses/>.
+
+package backend
+
+import (
+	"archive/tar"
+	"io"
+	"time"
+)
+
+// The input files of a job are given to the sandbox as a tar archive of
+// regular files, in the ustar format, which is extracted in a read-only
+// directory readable by the master user only.
+
+// Directory of the sandbox containing the input files
+const inputDir = "/tmp/input"
+
+// WriteInputs writes the archive of the input files to w. The file names
+// shall have been checked with pythia.CheckFiles.
+func writeInputs(w io.Writer, files map[string][]byte) error {
+	now := time.Now()
+	tw := tar.NewWriter(w)
+	for _, name := range sortedNames(files) {
+		hdr := &tar.Header{
+			Name:     name,
+			Mode:     0600,
+			Size:     int64(len(files[name])),
+			ModTime:  now,
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(files[name]); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// vim:set sw=4 ts=4 noet:
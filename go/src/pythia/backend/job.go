@@ -16,19 +16,16 @@
 package backend
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"os"
-	"os/exec"
-	"path"
 	"pythia"
 	"strings"
 	"sync"
-	"syscall"
 	"time"
 )
 
@@ -43,173 +40,360 @@ type Job struct {
 	Task  pythia.Task
 	Input string
 
-	// Path to the UML executable
-	UmlPath string
+	// Input files, mapped by their path in the input directory of the
+	// sandbox (see pythia.CheckFiles)
+	Files map[string][]byte
 
-	// Path to the directory containing the environments
-	EnvDir string
+	// If not nil, Stream is called with the successive chunks of the output
+	// while the job is running, up to the output limit. The chunks add up to
+	// the output returned by Execute.
+	Stream func(chunk string)
 
-	// Path to the directory containing the tasks
-	TasksDir string
+	// Parameters of the sandbox
+	SandboxConfig
 
-	// Process id of the job sandbox
-	pid int
+	// Sandbox executing the job. If nil, a sandbox is created from
+	// SandboxConfig when the job is executed.
+	sandbox Sandbox
 
-	// Job output
-	output string
+	// Whether the sandbox has been started ahead of time
+	warm bool
 
-	// Send a signal to the interrupt channel to trigger job killing.
-	interrupt chan bool
+	// The first limits exceeded, which made the job time out or overflow,
+	// if any
+	timeout, overflow pythia.Limit
 
-	// Has the job timed out, overflowed, or been aborted?
-	timeout, overflow, abort bool
+	// Has the job been aborted?
+	abort bool
 
-	// Error occurring in a goroutine
-	err error
+	// Mutex protecting sandbox and the fields above
+	mutex sync.Mutex
 
-	// Barrier to wait for all goroutines associated to a job execution to end.
-	wg sync.WaitGroup
+	// Limit exceeded by the last execution, if its status is timeout or
+	// overflow
+	limit pythia.Limit
+
+	// Standard error of the last execution, if kept apart from the output
+	stderr string
+
+	// Steps of the control file which did not succeed in the last execution
+	steps []pythia.StepResult
+
+	// Files of the results directory and JSON result document of the last
+	// execution
+	files  map[string][]byte
+	result json.RawMessage
+
+	// Resources used by the last execution
+	usage pythia.Usage
 }
 
+// Interval between checks of the CPU time consumed by the sandbox
+const cpuTimeInterval = 100 * time.Millisecond
+
 // NewJob returns a new job, filled with default parameters. To execute the
 // job, Task and Input have to be filled, and Execute() called.
 func NewJob() *Job {
 	job := new(Job)
-	job.UmlPath = "vm/uml"
-	job.EnvDir = "vm"
-	job.TasksDir = "tasks"
-	// The interrupt channel is buffered to avoid missing a kill request
-	// arriving before the watch goroutine is ready.
-	job.interrupt = make(chan bool, 1)
+	job.setDefaults()
 	return job
 }
 
 // Execute the job in a sandbox, wait for it to complete (or time out), and
 // return the result.
 func (job *Job) Execute() (status pythia.Status, output string) {
-	// Write input to a temporary file. This is needed because UML has trouble
-	// reading on the standard input. Hence, we feed the input as a block
-	// device.
-	inputfile, err := ioutil.TempFile("", "pythia-input-")
-	if err != nil {
-		return pythia.Error, fmt.Sprint(err)
+	job.mutex.Lock()
+	if job.sandbox == nil {
+		if err := job.check(); err != nil {
+			job.mutex.Unlock()
+			return pythia.Error, fmt.Sprint(err)
+		}
+		job.sandbox = job.newSandbox()
 	}
-	defer os.Remove(inputfile.Name())
-	defer inputfile.Close()
-	if _, err := io.WriteString(inputfile, job.Input); err != nil {
-		return pythia.Error, fmt.Sprint(err)
+	sandbox := job.sandbox
+	if job.abort {
+		// The job has been aborted before the sandbox was created.
+		sandbox.Abort()
 	}
-	inputfile.Close()
-	// Create and configure command.
-	cmd := exec.Command(job.UmlPath,
-		fmt.Sprintf("ubd0r=%s.sfs", path.Join(job.EnvDir, job.Task.Environment)),
-		fmt.Sprintf("ubd1r=%s", path.Join(job.TasksDir, job.Task.TaskFS)),
-		fmt.Sprintf("ubd2r=%s", inputfile.Name()),
-		"con0=null,fd:1",
-		"init=/init",
-		"ro",
-		"quiet",
-		fmt.Sprintf("mem=%dm", job.Task.Limits.Memory),
-		fmt.Sprintf("disksize=%d%%", job.Task.Limits.Disk))
-	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
-	cmd.Stdin = nil
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return pythia.Error, fmt.Sprint(err)
+	job.mutex.Unlock()
+	// The sandbox may have been started ahead of time, and shall be released
+	// if it is not run.
+	if err := pythia.CheckFiles(job.Files); err != nil {
+		sandbox.Abort()
+		return pythia.Fatal, fmt.Sprint(err)
 	}
-	cmd.Stderr = cmd.Stdout
-	// Run the VM
-	if err := cmd.Start(); err != nil {
+	if err := sandbox.Prepare(&job.Task); err != nil {
+		sandbox.Abort()
 		return pythia.Error, fmt.Sprint(err)
 	}
-	job.pid = cmd.Process.Pid
-	job.wg.Add(2)
-	go job.watch()
-	go job.gatherOutput(stdout)
-	if err := cmd.Wait(); err != nil {
-		switch err := err.(type) {
-		case *exec.ExitError:
-			// Ignore this error, cmd.ProcessState will be read below.
-		default:
-			job.err = err
+	out := &limitedBuffer{
+		Limit:    job.Task.Limits.Output,
+		Overflow: func() { job.exceed(&job.overflow, pythia.OutputLimit) },
+	}
+	var stream *outputStream
+	if job.Stream != nil {
+		stream = &outputStream{f: job.Stream}
+		out.Append = stream.write
+	}
+	// The standard error is only kept apart from the output if it has its own
+	// limit.
+	var stderr io.Writer
+	var errbuf *limitedBuffer
+	if job.Task.Limits.Stderr > 0 {
+		errbuf = &limitedBuffer{
+			Limit:    job.Task.Limits.Stderr,
+			Overflow: func() { job.exceed(&job.overflow, pythia.StderrLimit) },
+		}
+		stderr = errbuf
+	}
+	// Watch for the time limits while the sandbox is running. The CPU time
+	// consumed by the sandbox is checked periodically.
+	start := time.Now()
+	cpuLimit := time.Duration(job.Task.Limits.CpuTime) * time.Second
+	done := make(chan bool)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		timeout := time.After(time.Duration(job.Task.Limits.Time) * time.Second)
+		var tick <-chan time.Time
+		if cpuLimit > 0 {
+			ticker := time.NewTicker(cpuTimeInterval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			select {
+			case <-timeout:
+				job.exceed(&job.timeout, pythia.TimeLimit)
+				return
+			case <-tick:
+				if sandbox.CpuTime() > cpuLimit {
+					job.exceed(&job.timeout, pythia.CpuTimeLimit)
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	err := sandbox.Run(job.Input, job.Files, out, stderr)
+	close(done)
+	wg.Wait()
+	if stream != nil {
+		stream.flush()
+	}
+	output = strings.Replace(out.String(), "\r\n", "\n", -1)
+	result := sandbox.Result()
+	job.usage = pythia.Usage{
+		WallTime: time.Since(start).Seconds(),
+		CpuTime:  result.CpuTime.Seconds(),
+		MaxRss:   result.MaxRss,
+		Output:   out.Written(),
+		Warm:     job.warm,
+	}
+	job.steps = result.Steps
+	job.stderr = ""
+	if errbuf != nil {
+		job.stderr = strings.Replace(errbuf.String(), "\r\n", "\n", -1)
+		job.usage.Stderr = errbuf.Written()
+	}
+	job.files, job.result = nil, nil
+	overflow := false
+	if err == nil && job.Task.Results != "" {
+		job.files, overflow, err = readResults(result.Results, resultsSize(&job.Task))
+		if err != nil {
+			err = fmt.Errorf("Invalid results archive: %s", err)
+		}
+		// The result document is only returned apart from the other files
+		// when it is valid.
+		var buf bytes.Buffer
+		if data, ok := job.files[resultsDocument]; ok && json.Compact(&buf, data) == nil {
+			job.result = buf.Bytes()
+			delete(job.files, resultsDocument)
+		}
+	}
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	if overflow && job.overflow == "" {
+		job.overflow = pythia.ResultsLimit
+	}
+	// The CPU time limit may have been exceeded between two checks.
+	if cpuLimit > 0 && result.CpuTime > cpuLimit && job.timeout == "" {
+		job.timeout = pythia.CpuTimeLimit
+	}
+	// A step which exceeded its own limits and stopped the execution makes
+	// the job time out or overflow.
+	if n := len(result.Steps); n > 0 && result.Stopped {
+		switch step := result.Steps[n-1]; {
+		case step.Status == pythia.Timeout && job.timeout == "":
+			job.timeout = step.Limit
+		case step.Status == pythia.Overflow && job.overflow == "":
+			job.overflow = step.Limit
 		}
 	}
-	job.kill()
-	job.wg.Wait()
 	// Return result
+	job.limit = ""
 	switch {
-	case job.err != nil:
-		return pythia.Error, fmt.Sprint(job.err)
+	case err != nil:
+		return pythia.Error, fmt.Sprint(err)
 	case job.abort:
-		return pythia.Abort, job.output
-	case job.overflow:
-		return pythia.Overflow, job.output
-	case job.timeout:
-		return pythia.Timeout, job.output
-	case !cmd.ProcessState.Success():
-		return pythia.Crash, job.output
+		return pythia.Abort, output
+	case job.overflow != "":
+		job.limit = job.overflow
+		return pythia.Overflow, output
+	case job.timeout != "":
+		job.limit = job.timeout
+		return pythia.Timeout, output
+	case !result.Success:
+		return pythia.Crash, output
 	default:
-		return pythia.Success, job.output
+		return pythia.Success, output
 	}
 }
 
+// Limit returns the limit exceeded by the last execution of the job, if its
+// status is timeout or overflow. It shall be called after Execute returned.
+func (job *Job) Limit() pythia.Limit {
+	return job.limit
+}
+
+// Steps returns the steps of the control file of the task which did not
+// succeed in the last execution of the job. If the status of the execution is
+// timeout or overflow because of a step, the step is the last one. It shall be
+// called after Execute returned.
+func (job *Job) Steps() []pythia.StepResult {
+	return job.steps
+}
+
+// Usage returns the resources used by the last execution of the job. It shall
+// be called after Execute returned.
+func (job *Job) Usage() pythia.Usage {
+	return job.usage
+}
+
+// Stderr returns the standard error of the last execution of the job, if the
+// task has a limit on it. Otherwise, the standard error is part of the output.
+// It shall be called after Execute returned.
+func (job *Job) Stderr() string {
+	return job.stderr
+}
+
+// Results returns the files of the results directory of the task after the
+// last execution of the job, and the JSON document found in its result.json
+// file, if any. It shall be called after Execute returned.
+func (job *Job) Results() (files map[string][]byte, result json.RawMessage) {
+	return job.files, job.result
+}
+
 // Abort aborts the execution of the job.
 func (job *Job) Abort() {
+	job.mutex.Lock()
 	job.abort = true
-	job.kill()
+	sandbox := job.sandbox
+	job.mutex.Unlock()
+	if sandbox != nil {
+		sandbox.Abort()
+	}
 }
 
-// GatherOutput is a goroutine that buffers the output of the job.
-// If the size of the output exceeds the limit set in the task, the job will be
-// killed.
-func (job *Job) gatherOutput(stdout io.Reader) {
-	defer job.wg.Done()
-	// Make buffer one byte larger than the limit to catch overflows.
-	buffer := make([]byte, job.Task.Limits.Output+1)
-	read := 0
-	for {
-		n, err := stdout.Read(buffer[read:])
-		read += n
-		if err != nil && err != io.EOF {
-			job.err = err
-			job.kill()
-			break
-		} else if read > job.Task.Limits.Output {
-			job.overflow = true
-			job.kill()
-			break
-		} else if err == io.EOF {
-			break
-		}
+// Exceed records that limit has been exceeded in reason, which is either
+// the timeout or the overflow field, unless another limit has been recorded
+// there first, and kills the sandbox.
+func (job *Job) exceed(reason *pythia.Limit, limit pythia.Limit) {
+	job.mutex.Lock()
+	if *reason == "" {
+		*reason = limit
 	}
-	if read > job.Task.Limits.Output {
-		read = job.Task.Limits.Output
+	sandbox := job.sandbox
+	job.mutex.Unlock()
+	if sandbox != nil {
+		sandbox.Abort()
 	}
-	job.output = strings.Replace(string(buffer[:read]), "\r\n", "\n", -1)
 }
 
-// Kill requests the sandbox to be killed. It is a convenience method to send
-// a signal on the job.interrupt channel, but do not block if the job has
-// already finished.
-func (job *Job) kill() {
-	select {
-	case job.interrupt <- true:
-	default:
+// A limitedBuffer is a writer keeping up to Limit bytes. Overflow is called
+// once when more bytes are written. If not nil, Append is called with the bytes
+// kept, in order.
+type limitedBuffer struct {
+	Limit    int
+	Overflow func()
+	Append   func(p []byte)
+
+	buffer   []byte
+	written  int
+	overflow bool
+	mutex    sync.Mutex
+}
+
+// Write appends p to the buffer, up to the limit. It never fails, such that
+// the sandbox does not block on a full buffer before being killed.
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	n := len(p)
+	b.written += n
+	if room := b.Limit - len(b.buffer); n > room {
+		p = p[:room]
 	}
+	b.buffer = append(b.buffer, p...)
+	if b.Append != nil && len(p) > 0 {
+		b.Append(p)
+	}
+	overflow := n > len(p) && !b.overflow
+	b.overflow = b.overflow || overflow
+	b.mutex.Unlock()
+	if overflow {
+		b.Overflow()
+	}
+	return n, nil
+}
+
+// Written returns the number of bytes written, including the ones exceeding
+// the limit.
+func (b *limitedBuffer) Written() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.written
 }
 
-// Watch is a goroutine responsible for killing the job when it times out or
-// when a signal is received on the job.interrupt channel.
-func (job *Job) watch() {
-	defer job.wg.Done()
-	select {
-	case <-time.After(time.Duration(job.Task.Limits.Time) * time.Second):
-		job.timeout = true
-	case <-job.interrupt:
-	}
-	// Send the KILL signal to the whole UML process group. Do this even when
-	// the job is already done to ensure no zombie processes are left.
-	syscall.Kill(-job.pid, syscall.SIGKILL)
+// String returns the content of the buffer.
+func (b *limitedBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return string(b.buffer)
+}
+
+// An outputStream normalizes the line endings of the chunks of the output
+// before passing them to f, as done for the whole output.
+type outputStream struct {
+	f func(chunk string)
+
+	// Whether the last chunk ended with a carriage return, kept until the
+	// next chunk tells whether it starts a line ending
+	cr bool
+}
+
+// Write normalizes and passes a chunk of the output.
+func (s *outputStream) write(p []byte) {
+	chunk := string(p)
+	if s.cr {
+		chunk = "\r" + chunk
+	}
+	s.cr = strings.HasSuffix(chunk, "\r")
+	if s.cr {
+		chunk = chunk[:len(chunk)-1]
+	}
+	if chunk = strings.Replace(chunk, "\r\n", "\n", -1); chunk != "" {
+		s.f(chunk)
+	}
+}
+
+// Flush passes the carriage return kept at the end of the output, if any.
+func (s *outputStream) flush() {
+	if s.cr {
+		s.f("\r")
+		s.cr = false
+	}
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -227,12 +411,15 @@ func init() {
 func (job *Job) Setup(fs *flag.FlagSet, args []string) error {
 	taskfile := fs.String("task", "", "path to the task description (mandatory)")
 	inputfile := fs.String("input", "", "path to the input file (mandatory)")
-	fs.StringVar(&job.UmlPath, "uml", job.UmlPath, "path to the UML executable")
-	fs.StringVar(&job.EnvDir, "envdir", job.EnvDir, "environments directory")
-	fs.StringVar(&job.TasksDir, "tasksdir", job.TasksDir, "tasks directory")
+	filesdir := fs.String("files", "", "directory containing the input files")
+	job.setupFlags(fs)
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
+	if err := job.check(); err != nil {
+		return err
+	}
+	job.sandbox = job.newSandbox()
 	if len(*taskfile) == 0 || len(*inputfile) == 0 {
 		return errors.New("Missing task or input file")
 	}
@@ -248,14 +435,38 @@ func (job *Job) Setup(fs *flag.FlagSet, args []string) error {
 		return err
 	}
 	job.Input = string(inputcontent)
+	if len(*filesdir) > 0 {
+		if job.Files, err = pythia.ReadFiles(*filesdir); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 // Execute the job when launched from the CLI. The result is shown on stdout.
 func (job *Job) Run() {
 	status, output := job.Execute()
+	usage := job.Usage()
 	fmt.Println("Status:", status)
+	if limit := job.Limit(); limit != "" {
+		fmt.Println("Limit:", limit)
+	}
+	for _, step := range job.Steps() {
+		fmt.Println("Step:", step)
+	}
 	fmt.Println("Output:", output)
+	if stderr := job.Stderr(); stderr != "" {
+		fmt.Println("Stderr:", stderr)
+	}
+	files, result := job.Results()
+	if result != nil {
+		fmt.Println("Result:", string(result))
+	}
+	for _, name := range sortedNames(files) {
+		fmt.Printf("File: %s (%d bytes)\n", name, len(files[name]))
+	}
+	fmt.Printf("Usage: %.3fs wall, %.3fs CPU, %d KB max RSS, %d bytes output\n",
+		usage.WallTime, usage.CpuTime, usage.MaxRss, usage.Output)
 }
 
 // Abort the job if it is still running.
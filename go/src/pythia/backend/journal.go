@@ -0,0 +1,310 @@
+// Copyright 2013 The Pythia Authors.
+// This file is part of Pythia.
+//
+// Pythia is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, version 3 of the License.
+//
+// Pythia is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Pythia.  If not, see <http://www.gnu.org/licenses/>.
+
+package backend
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"pythia"
+	"sort"
+	"time"
+)
+
+// Operation recorded in the journal.
+type journalOp string
+
+const (
+	// A job has been queued. The record contains the launch message, the
+	// session of the submitter and the time at which the job was queued.
+	journalLaunch journalOp = "launch"
+
+	// A job has been dispatched to a pool.
+	journalDispatch journalOp = "dispatch"
+
+	// A job is done, but its result has not been delivered yet. The record
+	// contains the done message.
+	journalDone journalOp = "done"
+
+	// A job has left the queue (result delivered, or job discarded).
+	journalRemove journalOp = "remove"
+)
+
+// A journalRecord is a line of the journal.
+type journalRecord struct {
+	Op      journalOp       `json:"op"`
+	Id      string          `json:"id"`
+	Msg     *pythia.Message `json:"msg,omitempty"`
+	Session string          `json:"session,omitempty"`
+	Queued  time.Time       `json:"queued,omitempty"`
+}
+
+// A journalJob is a job recovered from the journal.
+type journalJob struct {
+	// The launch message
+	Msg pythia.Message
+
+	// The session of the client having submitted the job
+	Session string
+
+	// Time at which the job has been queued
+	Queued time.Time
+
+	// The done message if the job is done, or nil
+	Result *pythia.Message
+}
+
+// A queueJournal is a write-ahead log of the jobs submitted by identified
+// clients (i.e. having a session). It allows a restarted queue to recover its
+// waiting jobs and the results that have not been delivered yet.
+//
+// The journal is a file containing one JSON record per line. It is compacted
+// when opened and when it grows too large compared to the number of jobs in
+// the queue.
+//
+// All methods may be called on a nil journal, in which case they do nothing.
+// A queueJournal is not thread-safe. It shall only be used from the queue main
+// goroutine.
+type queueJournal struct {
+	// Path to the journal file
+	path string
+
+	// The journal file, opened for appending
+	file *os.File
+
+	// Number of records in the journal file
+	records int
+}
+
+// OpenJournal opens the journal located in directory dir, creating it if
+// needed, and returns the jobs recorded in it, in queuing order.
+func openJournal(dir string) (*queueJournal, []*journalJob, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, nil, err
+	}
+	j := &queueJournal{path: filepath.Join(dir, "journal")}
+	jobs, err := j.read()
+	if err != nil {
+		return nil, nil, err
+	}
+	var records []journalRecord
+	for _, job := range jobs {
+		records = append(records, journalJobRecords(job)...)
+	}
+	if err := j.rewrite(records); err != nil {
+		return nil, nil, err
+	}
+	return j, jobs, nil
+}
+
+// Read replays the journal file and returns the jobs that are still in the
+// queue, in queuing order.
+func (j *queueJournal) read() ([]*journalJob, error) {
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	jobs := make(map[string]*journalJob)
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var r journalRecord
+		if err := dec.Decode(&r); err == io.EOF {
+			break
+		} else if err != nil {
+			// The last record may be truncated if the queue crashed while
+			// writing it. Ignore it.
+			log.Println("Journal: ignoring corrupted record:", err)
+			break
+		}
+		switch r.Op {
+		case journalLaunch:
+			if r.Msg != nil {
+				jobs[r.Id] = &journalJob{
+					Msg:     *r.Msg,
+					Session: r.Session,
+					Queued:  r.Queued,
+				}
+			}
+		case journalDone:
+			if job := jobs[r.Id]; job != nil {
+				job.Result = r.Msg
+			}
+		case journalRemove:
+			delete(jobs, r.Id)
+		}
+	}
+	result := make([]*journalJob, 0, len(jobs))
+	for _, job := range jobs {
+		result = append(result, job)
+	}
+	sort.Sort(journalJobsByQueued(result))
+	return result, nil
+}
+
+// JournalJobsByQueued sorts recovered jobs by queuing time.
+type journalJobsByQueued []*journalJob
+
+func (s journalJobsByQueued) Len() int           { return len(s) }
+func (s journalJobsByQueued) Less(i, j int) bool { return s[i].Queued.Before(s[j].Queued) }
+func (s journalJobsByQueued) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// JournalJobRecords returns the records describing the current state of job.
+func journalJobRecords(job *journalJob) []journalRecord {
+	msg := job.Msg
+	records := []journalRecord{{
+		Op:      journalLaunch,
+		Id:      msg.Id,
+		Msg:     &msg,
+		Session: job.Session,
+		Queued:  job.Queued,
+	}}
+	if job.Result != nil {
+		records = append(records, journalRecord{
+			Op:  journalDone,
+			Id:  msg.Id,
+			Msg: job.Result,
+		})
+	}
+	return records
+}
+
+// Rewrite atomically replaces the journal file by the given records, and
+// reopens it for appending.
+func (j *queueJournal) rewrite(records []journalRecord) error {
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		return err
+	}
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0600)
+	j.records = len(records)
+	return err
+}
+
+// Write appends a record to the journal and flushes it to disk.
+func (j *queueJournal) write(r journalRecord) {
+	if j == nil {
+		return
+	}
+	b, err := json.Marshal(r)
+	if err == nil {
+		_, err = j.file.Write(append(b, '\n'))
+	}
+	if err == nil {
+		err = j.file.Sync()
+	}
+	if err != nil {
+		log.Println("Journal:", err)
+	}
+	j.records++
+}
+
+// Launch records that job has been queued.
+func (j *queueJournal) Launch(job *queueJob) {
+	if job.Session != "" {
+		msg := job.Msg
+		j.write(journalRecord{
+			Op:      journalLaunch,
+			Id:      job.Id,
+			Msg:     &msg,
+			Session: job.Session,
+			Queued:  job.Queued,
+		})
+	}
+}
+
+// Dispatch records that job has been dispatched to a pool.
+func (j *queueJournal) Dispatch(job *queueJob) {
+	if job.Session != "" {
+		j.write(journalRecord{Op: journalDispatch, Id: job.Id})
+	}
+}
+
+// Done records that job is done and its result is waiting to be delivered.
+func (j *queueJournal) Done(job *queueJob) {
+	if job.Session != "" {
+		j.write(journalRecord{Op: journalDone, Id: job.Id, Msg: job.Result})
+	}
+}
+
+// Remove records that job has left the queue.
+func (j *queueJournal) Remove(job *queueJob) {
+	if job.Session != "" {
+		j.write(journalRecord{Op: journalRemove, Id: job.Id})
+	}
+}
+
+// Compact rewrites the journal with the given jobs if the journal contains
+// too many obsolete records.
+func (j *queueJournal) Compact(jobs map[string]*queueJob) {
+	if j == nil || j.records < 1000 || j.records < 4*len(jobs) {
+		return
+	}
+	var records []journalRecord
+	for _, job := range jobs {
+		if job.Session != "" {
+			records = append(records, journalJobRecords(&journalJob{
+				Msg:     job.Msg,
+				Session: job.Session,
+				Queued:  job.Queued,
+				Result:  job.Result,
+			})...)
+		}
+	}
+	if err := j.rewrite(records); err != nil {
+		log.Println("Journal: compaction failed:", err)
+	}
+}
+
+// Close closes the journal file.
+func (j *queueJournal) Close() {
+	if j != nil && j.file != nil {
+		j.file.Close()
+	}
+}
+
+// vim:set sw=4 ts=4 noet:
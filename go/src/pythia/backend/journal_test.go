@@ -0,0 +1,155 @@
+// Copyright 2013 The Pythia Authors.
+// This file is part of Pythia.
+//
+// Pythia is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, version 3 of the License.
+//
+// Pythia is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Pythia.  If not, see <http://www.gnu.org/licenses/>.
+
+package backend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"pythia"
+	"testing"
+	"testutils"
+	"time"
+)
+
+// NewJournalTestJob creates a job launched within session, queued at time
+// queued.
+func newJournalTestJob(session, id string, queued time.Time) *queueJob {
+	id = "@" + session + ":" + id
+	return &queueJob{
+		Id:      id,
+		Msg:     pythia.Message{Message: pythia.LaunchMsg, Id: id},
+		Session: session,
+		Queued:  queued,
+	}
+}
+
+// JournalIds returns the ids of the recovered jobs.
+func journalIds(jobs []*journalJob) []string {
+	var ids []string
+	for _, job := range jobs {
+		ids = append(ids, job.Msg.Id)
+	}
+	return ids
+}
+
+func TestJournalReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pythia-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	j, jobs, err := openJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.Expect(t, "jobs", 0, len(jobs))
+	now := time.Now()
+	a := newJournalTestJob("s", "a", now)
+	b := newJournalTestJob("s", "b", now.Add(1))
+	c := newJournalTestJob("s", "c", now.Add(2))
+	anonymous := &queueJob{Id: "0:d", Msg: pythia.Message{Id: "0:d"}}
+	for _, job := range []*queueJob{c, a, b, anonymous} {
+		j.Launch(job)
+	}
+	j.Dispatch(a)
+	j.Dispatch(b)
+	a.Result = &pythia.Message{
+		Message: pythia.DoneMsg,
+		Id:      a.Id,
+		Status:  pythia.Success,
+	}
+	j.Done(a)
+	j.Remove(b)
+	j.Close()
+	j, jobs, err = openJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.Expect(t, "jobs", []string{"@s:a", "@s:c"}, journalIds(jobs))
+	testutils.Expect(t, "session", "s", jobs[0].Session)
+	testutils.Expect(t, "result", a.Result, jobs[0].Result)
+	if jobs[1].Result != nil {
+		t.Error("Unexpected result", jobs[1].Result)
+	}
+	testutils.Expect(t, "records", 3, j.records)
+	j.Close()
+}
+
+func TestJournalTruncated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pythia-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	j, _, err := openJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Launch(newJournalTestJob("s", "a", time.Now()))
+	// Simulate a crash while writing a record.
+	j.file.WriteString(`{"op":"launch","id":"@s:b","ms`)
+	j.Close()
+	j, jobs, err := openJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.Expect(t, "jobs", []string{"@s:a"}, journalIds(jobs))
+	j.Close()
+}
+
+func TestJournalCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pythia-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	j, _, err := openJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	jobs := make(map[string]*queueJob)
+	for i := 0; i < 1000; i++ {
+		job := newJournalTestJob("s", fmt.Sprint(i), now.Add(time.Duration(i)))
+		j.Launch(job)
+		if i%100 == 0 {
+			jobs[job.Id] = job
+		} else {
+			j.Remove(job)
+		}
+	}
+	j.Compact(jobs)
+	testutils.Expect(t, "records", len(jobs), j.records)
+	j.Close()
+	info, err := os.Stat(filepath.Join(dir, "journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, recovered, err := openJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.Expect(t, "jobs", len(jobs), len(recovered))
+	testutils.Expect(t, "records", len(jobs), j.records)
+	j.Close()
+	if info.Size() > 4096 {
+		t.Error("Journal not compacted:", info.Size(), "bytes")
+	}
+}
+
+// vim:set sw=4 ts=4 noet:
@@ -0,0 +1,1065 @@
+// Copyright 2013 The Pythia Authors.
+// This file is part of Pythia.
+//
+// Pythia is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, version 3 of the License.
+//
+// Pythia is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Pythia.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build linux
+// +build linux
+
+package backend
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"pythia"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// The namespace sandbox runs the tasks directly on the host kernel, isolated
+// in Linux namespaces and limited by a cgroup (v2), instead of booting a UML
+// virtual machine. It reproduces the environment set up by the init program of
+// the UML virtual machine (vm/init.c):
+//
+//  - the environment filesystem is the read-only root, with /proc, /sys, a
+//    tmpfs in /tmp, the task filesystem in /task and the input files in a
+//    read-only tmpfs in /tmp/input, private to the privileged user;
+//  - the commands of /task/control are executed in sequence, the ones
+//    starting with '!' as an unprivileged user without access to the input
+//    and the output, the other ones as a privileged non-root user reading the
+//    input on stdin;
+//  - the options of the steps are enforced, and the steps which did not
+//    succeed are reported to the host (see parseSteps);
+//  - all processes and IPC objects are destroyed after each command;
+//  - the execution stops when a privileged command fails or exceeds the limits
+//    of its step, unless the step is marked continue.
+//
+// The sandbox is set up by the pythia executable itself, launched as the init
+// process of new mount, pid, network, IPC and UTS namespaces. Each command is
+// then executed in its own user namespace, mapping the users of the sandbox to
+// unprivileged users of the host. Each running sandbox is given its own range
+// of host users, such that the processes of two sandboxes never share the
+// resources the kernel accounts per user (e.g. pending signals, inotify
+// instances or keyrings). The pool shall run as root to mount the filesystems
+// and to create the cgroups.
+
+func init() {
+	Sandboxes["ns"] = SandboxInfo{
+		Name:        "ns",
+		Description: "Linux namespaces and cgroups (no virtual machine)",
+		New: func(config *SandboxConfig) Sandbox {
+			return &nsSandbox{config: *config}
+		},
+	}
+	if len(os.Args) > 0 && os.Args[0] == nsInitName {
+		os.Exit(nsInit(os.Args[1:]))
+	}
+}
+
+const (
+	// Name given to the pythia executable when launched as the init process
+	// of a namespace sandbox.
+	nsInitName = "pythia-ns-init"
+
+	// Exit status of the init process when the sandbox cannot be set up.
+	nsInitFailure = 125
+
+	// User ids of the privileged and unprivileged users, inside the sandbox
+	nsUidMaster = 1
+	nsUidWorker = 2
+
+	// Number of host user ids mapped in a sandbox
+	nsUidRange = 3
+
+	// Children of the cgroup of a sandbox, holding the init process and the
+	// processes of the task respectively. The processes of the task are
+	// limited apart, such that the threads of the init process do not count.
+	nsCgroupInit = "init"
+	nsCgroupTask = "task"
+
+	// Maximum number of arguments in a command of /task/control
+	nsControlMaxArgs = 100
+)
+
+// First host user ids of the ranges used by the running sandboxes.
+var nsUidRanges = struct {
+	used  map[int]bool
+	mutex sync.Mutex
+}{used: make(map[int]bool)}
+
+// NsAcquireUids returns the first host user id of a range of nsUidRange ids,
+// starting from base, which is not used by another running sandbox. The range
+// shall be released with nsReleaseUids once the sandbox has terminated.
+func nsAcquireUids(base int) int {
+	nsUidRanges.mutex.Lock()
+	defer nsUidRanges.mutex.Unlock()
+	uid := base
+	for nsUidRanges.used[uid] {
+		uid += nsUidRange
+	}
+	nsUidRanges.used[uid] = true
+	return uid
+}
+
+// NsReleaseUids releases the range of host user ids starting at uid.
+func nsReleaseUids(uid int) {
+	nsUidRanges.mutex.Lock()
+	defer nsUidRanges.mutex.Unlock()
+	delete(nsUidRanges.used, uid)
+}
+
+// Environment used when launching the commands of /task/control.
+var nsEnvironment = []string{
+	"PATH=/usr/bin:/bin",
+	"LANG=C",
+	"HOME=/tmp",
+}
+
+// A nsSandbox executes a task in Linux namespaces.
+type nsSandbox struct {
+	config SandboxConfig
+	task   *pythia.Task
+
+	// Process id of the init process, or 0 if it is not running
+	pid int
+
+	// Cgroup of the running sandbox
+	cgroup string
+
+	// Whether Abort has been called
+	aborted bool
+
+	// Mutex protecting pid, cgroup and aborted
+	mutex sync.Mutex
+
+	result SandboxResult
+}
+
+// Prepare stores the task to execute.
+func (sb *nsSandbox) Prepare(task *pythia.Task) error {
+	sb.task = task
+	return nil
+}
+
+// Run sets up the sandbox, executes the task and waits for its termination.
+func (sb *nsSandbox) Run(input string, files map[string][]byte, stdout, stderr io.Writer) error {
+	inputfile, err := ioutil.TempFile("", "pythia-input-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(inputfile.Name())
+	defer inputfile.Close()
+	if _, err := io.WriteString(inputfile, input); err != nil {
+		return err
+	}
+	if _, err := inputfile.Seek(0, 0); err != nil {
+		return err
+	}
+	root, err := ioutil.TempDir("", "pythia-root-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(root)
+	// The users are released once the processes of the sandbox have
+	// terminated, after the removal of its cgroup.
+	uidbase := nsAcquireUids(sb.config.UidBase)
+	defer nsReleaseUids(uidbase)
+	cgroup, err := sb.createCgroup()
+	if err != nil {
+		return err
+	}
+	defer removeCgroup(cgroup)
+	limits := sb.task.Limits
+	separate, inputs := "0", "0"
+	if stderr != nil {
+		separate = "1"
+	}
+	if len(files) > 0 {
+		inputs = "1"
+	}
+	cmd := &exec.Cmd{
+		Path: "/proc/self/exe",
+		Args: []string{
+			nsInitName,
+			root,
+			path.Join(sb.config.EnvDir, sb.task.Environment) + ".sfs",
+			path.Join(sb.config.TasksDir, sb.task.TaskFS),
+			cgroup,
+			strconv.Itoa(limits.Memory * limits.Disk * 1024 / 100),
+			strconv.Itoa(uidbase),
+			separate,
+			sb.task.Results,
+			inputs,
+			strings.Join(processParams(sb.task), " "),
+		},
+		Stdin: inputfile,
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWNS | syscall.CLONE_NEWPID |
+			syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS,
+		Setsid:    true,
+		Pdeathsig: syscall.SIGKILL,
+	}
+	// Errors of the init process itself are reported on its standard error,
+	// while the standard error of the task is given as file descriptor 3, the
+	// file receiving the results archive as file descriptor 4, the archive of
+	// the input files as file descriptor 5, and the steps are reported on file
+	// descriptor 6.
+	var initErr bytes.Buffer
+	cmd.Stderr = &initErr
+	cmd.ExtraFiles = make([]*os.File, 4)
+	var out processOutput
+	defer out.close()
+	w, err := out.pipe(stdout)
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = w
+	var steps bytes.Buffer
+	if cmd.ExtraFiles[3], err = out.pipe(&steps); err != nil {
+		return err
+	}
+	if stderr != nil {
+		w, err := out.pipe(stderr)
+		if err != nil {
+			return err
+		}
+		cmd.ExtraFiles[0] = w
+	}
+	var resultsfile *os.File
+	if sb.task.Results != "" {
+		resultsfile, err = ioutil.TempFile("", "pythia-results-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(resultsfile.Name())
+		defer resultsfile.Close()
+		if err := resultsfile.Truncate(int64(resultsSize(sb.task))); err != nil {
+			return err
+		}
+		cmd.ExtraFiles[1] = resultsfile
+	}
+	if len(files) > 0 {
+		filesfile, err := ioutil.TempFile("", "pythia-files-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(filesfile.Name())
+		defer filesfile.Close()
+		if err := writeInputs(filesfile, files); err != nil {
+			return err
+		}
+		if _, err := filesfile.Seek(0, 0); err != nil {
+			return err
+		}
+		cmd.ExtraFiles[2] = filesfile
+	}
+	sb.mutex.Lock()
+	if sb.aborted {
+		sb.mutex.Unlock()
+		return nil
+	}
+	err = cmd.Start()
+	out.start()
+	if err != nil {
+		sb.mutex.Unlock()
+		out.wait()
+		return err
+	}
+	sb.pid = cmd.Process.Pid
+	sb.cgroup = cgroup
+	sb.mutex.Unlock()
+	if err = cmd.Wait(); err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			err = nil
+		}
+	}
+	// Killing the init process kills all processes of its pid namespace.
+	sb.mutex.Lock()
+	syscall.Kill(sb.pid, syscall.SIGKILL)
+	sb.pid = 0
+	sb.cgroup = ""
+	sb.mutex.Unlock()
+	if cerr := out.wait(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok &&
+		status.Exited() && status.ExitStatus() == nsInitFailure {
+		return errors.New(strings.TrimSpace(initErr.String()))
+	}
+	sb.result = processResult(cmd.ProcessState)
+	sb.result.Steps, sb.result.Stopped = parseSteps(steps.Bytes())
+	if resultsfile != nil {
+		if _, err := resultsfile.Seek(0, 0); err != nil {
+			return err
+		}
+		if sb.result.Results, err = ioutil.ReadAll(resultsfile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Abort kills the init process of the sandbox.
+func (sb *nsSandbox) Abort() {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	sb.aborted = true
+	if sb.pid != 0 {
+		syscall.Kill(sb.pid, syscall.SIGKILL)
+	}
+}
+
+// CpuTime returns the CPU time consumed by the processes of the cgroup of the
+// sandbox.
+func (sb *nsSandbox) CpuTime() time.Duration {
+	sb.mutex.Lock()
+	cgroup := sb.cgroup
+	sb.mutex.Unlock()
+	if cgroup == "" {
+		return 0
+	}
+	stat, err := ioutil.ReadFile(path.Join(cgroup, "cpu.stat"))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(stat), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "usage_usec" {
+			usec, _ := strconv.ParseInt(fields[1], 10, 64)
+			return time.Duration(usec) * time.Microsecond
+		}
+	}
+	return 0
+}
+
+// Result returns whether the sandbox terminated successfully, and the resources
+// used by its processes.
+func (sb *nsSandbox) Result() SandboxResult {
+	return sb.result
+}
+
+// CreateCgroup creates the cgroup of the sandbox and its children, with limits
+// mapped from the task limits, and returns its path. The memory limit applies
+// to the whole sandbox, and the limit on the number of processes to the
+// processes of the task.
+func (sb *nsSandbox) createCgroup() (string, error) {
+	parent := sb.config.CgroupDir
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return "", err
+	}
+	err := ioutil.WriteFile(path.Join(parent, "cgroup.subtree_control"),
+		[]byte("+memory +pids"), 0644)
+	if err != nil {
+		return "", err
+	}
+	cgroup, err := ioutil.TempDir(parent, "job-")
+	if err != nil {
+		return "", err
+	}
+	for _, child := range []string{nsCgroupInit, nsCgroupTask} {
+		if err := os.Mkdir(path.Join(cgroup, child), 0755); err != nil {
+			removeCgroup(cgroup)
+			return "", err
+		}
+	}
+	memory := "max"
+	if sb.task.Limits.Memory > 0 {
+		memory = strconv.Itoa(sb.task.Limits.Memory * 1024 * 1024)
+	}
+	processes := sb.task.Limits.Processes
+	if processes <= 0 {
+		processes = defaultProcesses
+	}
+	for _, limit := range []struct {
+		file, value string
+		optional    bool
+	}{
+		{"memory.max", memory, false},
+		{"memory.swap.max", "0", true},
+		{"cgroup.subtree_control", "+pids", false},
+		{path.Join(nsCgroupTask, "pids.max"), strconv.Itoa(processes), false},
+	} {
+		err := ioutil.WriteFile(path.Join(cgroup, limit.file),
+			[]byte(limit.value), 0644)
+		if err != nil && !limit.optional {
+			removeCgroup(cgroup)
+			return "", err
+		}
+	}
+	return cgroup, nil
+}
+
+// RemoveCgroup removes the cgroup of a sandbox and its children, waiting for
+// their processes to terminate.
+func removeCgroup(cgroup string) {
+	for _, dir := range []string{
+		path.Join(cgroup, nsCgroupInit),
+		path.Join(cgroup, nsCgroupTask),
+		cgroup,
+	} {
+		for i := 0; i < 100; i++ {
+			if err := os.Remove(dir); err == nil || os.IsNotExist(err) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Init process of the sandbox
+
+// NsInit is the entry point of the init process. It sets up the sandbox and
+// executes /task/control. The arguments are the root directory, the paths
+// to the environment and task filesystems, the cgroup path, the size of /tmp
+// in kilobytes, the first host user id of the sandbox, "1" if the standard
+// error of the task is written to file descriptor 3 instead of the output, the
+// results directory to archive on file descriptor 4 (if not empty), "1" if
+// the archive of the input files is given as file descriptor 5, and the limits
+// on the processes (see processParams). The steps are reported on file
+// descriptor 6. It returns the exit status of the process.
+func nsInit(args []string) int {
+	if len(args) != 10 {
+		fmt.Fprintln(os.Stderr, "init: invalid arguments")
+		return nsInitFailure
+	}
+	root, envfs, taskfs, cgroup := args[0], args[1], args[2], args[3]
+	disksize, uidbase := args[4], args[5]
+	base, err := strconv.Atoi(uidbase)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "init: invalid uid base")
+		return nsInitFailure
+	}
+	var stderr *os.File
+	if args[6] == "1" {
+		// Only the master commands shall inherit the standard error.
+		syscall.CloseOnExec(3)
+		stderr = os.NewFile(3, "stderr")
+	}
+	results := args[7]
+	if results != "" {
+		syscall.CloseOnExec(4)
+	}
+	inputs := args[8] == "1"
+	if inputs {
+		syscall.CloseOnExec(5)
+	}
+	syscall.CloseOnExec(6)
+	report := os.NewFile(6, "steps")
+	defer report.Close()
+	// The cgroup of the task is opened before leaving the host filesystem,
+	// for the commands to be created in it.
+	var taskCgroup *os.File
+	steps := []struct {
+		name string
+		f    func() error
+	}{
+		{"join cgroup", func() error {
+			return ioutil.WriteFile(path.Join(cgroup, nsCgroupInit, "cgroup.procs"),
+				[]byte("0"), 0644)
+		}},
+		{"open task cgroup", func() (err error) {
+			taskCgroup, err = os.Open(path.Join(cgroup, nsCgroupTask))
+			return
+		}},
+		{"make mounts private", func() error {
+			return syscall.Mount("none", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+		}},
+		{"mount root", func() error {
+			return loopMount(envfs, root)
+		}},
+		{"mount /proc", func() error {
+			return syscall.Mount("proc", path.Join(root, "proc"), "proc",
+				syscall.MS_NODEV|syscall.MS_NOSUID|syscall.MS_NOEXEC, "")
+		}},
+		{"mount /sys", func() error {
+			return syscall.Mount("sys", path.Join(root, "sys"), "sysfs",
+				syscall.MS_NODEV|syscall.MS_NOSUID|syscall.MS_NOEXEC|syscall.MS_RDONLY, "")
+		}},
+		{"mount /tmp", func() error {
+			return syscall.Mount("none", path.Join(root, "tmp"), "tmpfs",
+				syscall.MS_NODEV|syscall.MS_NOSUID, "mode=777,size="+disksize+"k")
+		}},
+		{"mount /task", func() error {
+			return loopMount(taskfs, path.Join(root, "task"))
+		}},
+		{"import input files", func() error {
+			if !inputs {
+				return nil
+			}
+			return nsImportInputs(os.NewFile(5, "inputs"),
+				path.Join(root, inputDir), base)
+		}},
+		{"chroot", func() error {
+			if err := syscall.Chroot(root); err != nil {
+				return err
+			}
+			return syscall.Chdir("/")
+		}},
+	}
+	for _, step := range steps {
+		if err := step.f(); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", step.name, err)
+			return nsInitFailure
+		}
+	}
+	// The resource limits are inherited by the commands, and lifted before
+	// exporting the results.
+	restore, err := nsSetRlimits(args[9])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "set resource limits:", err)
+		return nsInitFailure
+	}
+	nsRunControl(base, int(taskCgroup.Fd()), stderr, report)
+	restore()
+	if results != "" {
+		// As in the virtual machine, errors are ignored, and an archive which
+		// does not fit is detected by the host.
+		nsExportResults(os.NewFile(4, "results"), results)
+	}
+	return 0
+}
+
+// NsRlimits maps the names of the limits on the processes to the resource
+// limits applied to the commands of /task/control, and to their unit. The
+// number of processes is limited by the cgroup instead, such that the limit
+// applies to the whole sandbox.
+var nsRlimits = map[string]struct {
+	resource int
+	unit     uint64
+}{
+	"openfiles": {syscall.RLIMIT_NOFILE, 1},
+	"filesize":  {syscall.RLIMIT_FSIZE, 1024},
+	"stack":     {syscall.RLIMIT_STACK, 1024},
+}
+
+// NsSetRlimits applies the resource limits given as space-separated
+// name=value parameters to the init process, such that the commands inherit
+// them, and returns a function restoring the previous limits. As the init
+// process keeps a few files open, a very low limit on open files may prevent
+// it from launching the commands.
+func nsSetRlimits(params string) (restore func(), err error) {
+	var saved []func()
+	restore = func() {
+		for i := len(saved) - 1; i >= 0; i-- {
+			saved[i]()
+		}
+	}
+	for _, param := range strings.Fields(params) {
+		fields := strings.SplitN(param, "=", 2)
+		limit, ok := nsRlimits[fields[0]]
+		if !ok || len(fields) != 2 {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[1], 10, 31)
+		if err != nil {
+			restore()
+			return nil, fmt.Errorf("invalid limit '%s'", param)
+		}
+		var old syscall.Rlimit
+		if err := syscall.Getrlimit(limit.resource, &old); err != nil {
+			restore()
+			return nil, err
+		}
+		rlim := syscall.Rlimit{Cur: value * limit.unit, Max: value * limit.unit}
+		if err := syscall.Setrlimit(limit.resource, &rlim); err != nil {
+			restore()
+			return nil, err
+		}
+		saved = append(saved, func() {
+			syscall.Setrlimit(limit.resource, &old)
+		})
+	}
+	return restore, nil
+}
+
+// NsImportInputs extracts the archive of the input files in dir, on a tmpfs
+// which is then made read-only. As in the virtual machine, the files belong to
+// the master user and are private.
+func nsImportInputs(file *os.File, dir string, uidbase int) error {
+	defer file.Close()
+	uid, gid := uidbase+nsUidMaster, uidbase
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return err
+	}
+	err := syscall.Mount("none", dir, "tmpfs", syscall.MS_NODEV|syscall.MS_NOSUID,
+		fmt.Sprintf("mode=700,uid=%d,gid=%d", uid, gid))
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(file)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			return fmt.Errorf("Unsupported input file '%s'", hdr.Name)
+		}
+		if err := pythia.CheckFiles(map[string][]byte{hdr.Name: nil}); err != nil {
+			return err
+		}
+		// Create the directories of the file.
+		dirs := strings.Split(hdr.Name, "/")
+		for i := 1; i < len(dirs); i++ {
+			name := path.Join(dir, path.Join(dirs[:i]...))
+			if err := os.Mkdir(name, 0700); err != nil && !os.IsExist(err) {
+				return err
+			}
+			if err := os.Lchown(name, uid, gid); err != nil {
+				return err
+			}
+		}
+		f, err := os.OpenFile(path.Join(dir, hdr.Name),
+			os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		if err == nil {
+			err = f.Chown(uid, gid)
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return syscall.Mount("none", dir, "", syscall.MS_REMOUNT|syscall.MS_RDONLY|
+		syscall.MS_NODEV|syscall.MS_NOSUID, "")
+}
+
+// NsExportResults archives the regular files of dir on the results file, whose
+// size is the one allowed for the archive.
+func nsExportResults(file *os.File, dir string) error {
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	// Symbolic links are not followed, neither for the directory nor for its
+	// files, which are only archived if they are regular files.
+	var infos []os.FileInfo
+	if d, err := os.OpenFile(dir, os.O_RDONLY|syscall.O_NOFOLLOW, 0); err == nil {
+		infos, err = d.Readdir(-1)
+		d.Close()
+		if err != nil {
+			return err
+		}
+	}
+	tw := tar.NewWriter(&deviceWriter{W: file, Size: int(info.Size())})
+	for _, info := range infos {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		err := func() error {
+			f, err := os.OpenFile(path.Join(dir, info.Name()),
+				os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			hdr := &tar.Header{
+				Name:     info.Name(),
+				Mode:     0644,
+				Size:     info.Size(),
+				ModTime:  info.ModTime(),
+				Typeflag: tar.TypeReg,
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			_, err = io.CopyN(tw, f, info.Size())
+			return err
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// NsRunControl reads /task/control and executes the commands. As the init
+// program of the virtual machine, errors are reported on the output, and end
+// the execution normally. The standard error of master commands is written to
+// stderr, or to the output if it is nil. The steps which did not succeed are
+// reported on steps. The commands are created in the cgroup whose directory is
+// opened as cgroup.
+func nsRunControl(uidbase, cgroup int, stderr, steps *os.File) {
+	control, err := os.Open("/task/control")
+	if err != nil {
+		fmt.Println("open /task/control:", err)
+		return
+	}
+	defer control.Close()
+	scanner := bufio.NewScanner(control)
+	for n := 1; scanner.Scan(); n++ {
+		step, line, err := parseStep(scanner.Text())
+		if err != nil {
+			fmt.Println("/task/control:", err)
+			return
+		}
+		worker := strings.HasPrefix(line, "!")
+		if worker {
+			line = line[1:]
+		}
+		args, err := splitArgs(line)
+		if err != nil {
+			fmt.Println("splitargs:", err)
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		status := nsLaunch(args, worker, uidbase, cgroup, stderr, step)
+		// Kill all remaining processes of the pid namespace, and reap them.
+		syscall.Kill(-1, syscall.SIGKILL)
+		for {
+			var ws syscall.WaitStatus
+			if _, err := syscall.Wait4(-1, &ws, 0, nil); err != nil &&
+				err != syscall.EINTR {
+				break
+			}
+		}
+		if status == pythia.Success {
+			continue
+		}
+		stop := !worker && !step.cont
+		result := pythia.StepResult{Line: n, Name: step.name, Status: status}
+		switch status {
+		case pythia.Timeout:
+			result.Limit = pythia.TimeLimit
+		case pythia.Overflow:
+			result.Limit = pythia.OutputLimit
+		}
+		io.WriteString(steps, formatStep(result, stop))
+		if stop {
+			return
+		}
+	}
+}
+
+// A controlStep holds the options of a step of /task/control (see
+// pythia.Task).
+type controlStep struct {
+	// Name of the step, or empty
+	name string
+
+	// Time limit in seconds, and output limit in bytes, or 0
+	time, output int
+
+	// Whether to continue if the step fails
+	cont bool
+}
+
+// ParseStep splits a line of /task/control into the options of its step and
+// its command, following the conventions of the init program of the virtual
+// machine: the options are enclosed in brackets at the start of the line, and
+// separated by whitespace.
+func parseStep(line string) (step controlStep, cmd string, err error) {
+	if !strings.HasPrefix(line, "[") {
+		return step, line, nil
+	}
+	end := strings.IndexByte(line, ']')
+	if end < 0 {
+		return step, "", errors.New("unterminated step options")
+	}
+	for _, opt := range strings.Fields(line[1:end]) {
+		switch {
+		case opt == "continue":
+			step.cont = true
+		case strings.HasPrefix(opt, "name=") && len(opt) > 5:
+			step.name = opt[5:]
+		case strings.HasPrefix(opt, "time="):
+			step.time, err = parseStepLimit(opt[5:])
+		case strings.HasPrefix(opt, "output="):
+			step.output, err = parseStepLimit(opt[7:])
+		default:
+			err = errors.New("invalid step option")
+		}
+		if err != nil {
+			return step, "", err
+		}
+	}
+	return step, strings.TrimLeft(line[end+1:], " \t"), nil
+}
+
+// ParseStepLimit parses the value of a limit of a step.
+func parseStepLimit(value string) (int, error) {
+	limit, err := strconv.ParseUint(value, 10, 31)
+	if err != nil {
+		return 0, errors.New("invalid step limit")
+	}
+	return int(limit), nil
+}
+
+// A stepOutput copies the output of a step to W, up to Room bytes, and kills
+// the processes of the sandbox once the limit is exceeded.
+type stepOutput struct {
+	W        io.Writer
+	Room     int
+	Overflow bool
+}
+
+// Write copies the part of p which fits in the limit.
+func (out *stepOutput) Write(p []byte) (int, error) {
+	if out.Overflow {
+		return len(p), nil
+	}
+	if len(p) > out.Room {
+		out.W.Write(p[:out.Room])
+		out.Overflow = true
+		syscall.Kill(-1, syscall.SIGKILL)
+		return len(p), nil
+	}
+	out.Room -= len(p)
+	return out.W.Write(p)
+}
+
+// NsLaunch executes a command of /task/control and waits for its termination.
+// It returns the outcome of the step: success, crash if the command did not
+// exit successfully, or timeout or overflow if it exceeded the limits of step.
+// The output limit only applies to master commands. Once the command has
+// terminated, the remaining processes of the pid namespace are killed.
+//
+// The command is executed in its own user namespace, which maps the users of
+// the sandbox to host users starting from uidbase, and in its own IPC
+// namespace, such that its IPC objects are released when it terminates. It is
+// created in the cgroup whose directory is opened as cgroup.
+func nsLaunch(args []string, worker bool, uidbase, cgroup int, stderr *os.File, step controlStep) pythia.Status {
+	cmd := &exec.Cmd{
+		Path: args[0],
+		Args: args,
+		Env:  nsEnvironment,
+	}
+	// The output of the command goes through a pipe if it is limited.
+	var output *stepOutput
+	var r, w *os.File
+	mapping := []syscall.SysProcIDMap{{ContainerID: 0, HostID: uidbase, Size: nsUidRange}}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:                 syscall.CLONE_NEWUSER | syscall.CLONE_NEWIPC,
+		UidMappings:                mapping,
+		GidMappings:                mapping,
+		GidMappingsEnableSetgroups: true,
+		UseCgroupFD:                true,
+		CgroupFD:                   cgroup,
+		Credential: &syscall.Credential{
+			Uid:    nsUidMaster,
+			Gid:    0,
+			Groups: []uint32{},
+		},
+	}
+	if worker {
+		// Make new files public by default, and deny access to the input
+		// and the output.
+		cmd.SysProcAttr.Credential.Uid = nsUidWorker
+		cmd.SysProcAttr.Credential.Gid = nsUidWorker
+		syscall.Umask(000)
+	} else {
+		// Make new files private to master by default.
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stdout
+		if step.output > 0 {
+			var err error
+			if r, w, err = os.Pipe(); err != nil {
+				fmt.Println("pipe:", err)
+				return pythia.Crash
+			}
+			defer r.Close()
+			defer w.Close()
+			output = &stepOutput{W: os.Stdout, Room: step.output}
+			cmd.Stdout = w
+			cmd.Stderr = w
+		}
+		if stderr != nil {
+			cmd.Stderr = stderr
+		}
+		syscall.Umask(077)
+	}
+	if err := cmd.Start(); err != nil {
+		fmt.Println("execve:", err)
+		return pythia.Crash
+	}
+	copied := make(chan bool)
+	if output != nil {
+		w.Close()
+		go func() {
+			io.Copy(output, r)
+			close(copied)
+		}()
+	} else {
+		close(copied)
+	}
+	var timer *time.Timer
+	if step.time > 0 {
+		timer = time.AfterFunc(time.Duration(step.time)*time.Second, func() {
+			syscall.Kill(-1, syscall.SIGKILL)
+		})
+	}
+	err := cmd.Wait()
+	timeout := timer != nil && !timer.Stop()
+	// Kill the remaining processes, which may hold the output.
+	syscall.Kill(-1, syscall.SIGKILL)
+	<-copied
+	switch {
+	case output != nil && output.Overflow:
+		return pythia.Overflow
+	case timeout:
+		return pythia.Timeout
+	case err != nil:
+		return pythia.Crash
+	default:
+		return pythia.Success
+	}
+}
+
+// SplitArgs splits a command line into arguments, following the conventions
+// of the init program of the virtual machine:
+//   - arguments are separated by whitespace(s);
+//   - whitespace can be enclosed by single (') or double quotes (");
+//   - outside single quotes, a backslash escapes the next character as in C.
+func splitArgs(cmd string) ([]string, error) {
+	escapes := map[byte]byte{
+		'a': '\a', 'b': '\b', 'f': '\f', 'n': '\n', 'r': '\r', 't': '\t',
+		'v': '\v', '\\': '\\', '\'': '\'', '"': '"',
+	}
+	var args []string
+	var arg []byte
+	var quote byte
+	inArg := false
+	for i := 0; i < len(cmd); i++ {
+		c := cmd[i]
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			if quote != 0 {
+				arg = append(arg, c)
+			} else if inArg {
+				args = append(args, string(arg))
+				arg, inArg = nil, false
+			}
+			continue
+		case '"', '\'':
+			if !inArg || quote == 0 {
+				quote = c
+			} else if quote == c {
+				quote = 0
+			} else {
+				arg = append(arg, c)
+			}
+		case '\\':
+			r, ok := byte(0), false
+			if quote != '\'' && i+1 < len(cmd) {
+				r, ok = escapes[cmd[i+1]]
+			}
+			if ok {
+				arg = append(arg, r)
+				i++
+			} else {
+				arg = append(arg, c)
+			}
+		default:
+			arg = append(arg, c)
+		}
+		inArg = true
+	}
+	if quote != 0 {
+		return nil, errors.New("unbalanced quotes")
+	}
+	if inArg {
+		args = append(args, string(arg))
+	}
+	if len(args) > nsControlMaxArgs {
+		return nil, errors.New("arguments limit exceeded")
+	}
+	return args, nil
+}
+
+// Loop device ioctls and flags, from linux/loop.h
+const (
+	loopSetFd          = 0x4C00
+	loopClrFd          = 0x4C01
+	loopSetStatus64    = 0x4C04
+	loopCtlGetFree     = 0x4C82
+	loopFlagsReadOnly  = 1
+	loopFlagsAutoClear = 4
+)
+
+// LoopMount mounts the squashfs image file read-only on target, through a
+// loop device. The loop device is released when the filesystem is unmounted,
+// i.e. when the mount namespace is destroyed.
+func loopMount(file, target string) error {
+	image, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+	ctl, err := os.OpenFile("/dev/loop-control", os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer ctl.Close()
+	// Another sandbox may take the free device before us: retry.
+	for i := 0; ; i++ {
+		n, _, errno := syscall.Syscall(syscall.SYS_IOCTL, ctl.Fd(), loopCtlGetFree, 0)
+		if errno != 0 {
+			return errno
+		}
+		name := fmt.Sprintf("/dev/loop%d", n)
+		dev, err := os.OpenFile(name, os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, dev.Fd(), loopSetFd, image.Fd())
+		if errno == syscall.EBUSY && i < 10 {
+			dev.Close()
+			continue
+		} else if errno != 0 {
+			dev.Close()
+			return errno
+		}
+		// struct loop_info64 is 232 bytes long, with lo_flags at offset 52.
+		var info [232]byte
+		*(*uint32)(unsafe.Pointer(&info[52])) = loopFlagsReadOnly | loopFlagsAutoClear
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, dev.Fd(), loopSetStatus64,
+			uintptr(unsafe.Pointer(&info[0])))
+		if errno == 0 {
+			err = syscall.Mount(name, target, "squashfs",
+				syscall.MS_RDONLY|syscall.MS_NODEV|syscall.MS_NOSUID, "")
+		} else {
+			syscall.Syscall(syscall.SYS_IOCTL, dev.Fd(), loopClrFd, 0)
+			err = errno
+		}
+		dev.Close()
+		return err
+	}
+}
+
+// vim:set sw=4 ts=4 noet:
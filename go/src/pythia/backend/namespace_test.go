@@ -0,0 +1,196 @@
+// Copyright 2013 The Pythia Authors.
+// This file is part of Pythia.
+//
+// Pythia is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, version 3 of the License.
+//
+// Pythia is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Pythia.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build linux
+// +build linux
+
+package backend
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"pythia"
+	"strings"
+	"testing"
+	"testutils"
+	"testutils/pytest"
+)
+
+// NsTestCgroup returns the cgroup under which the tests create the cgroups of
+// the sandboxes, or skips the test if the host cannot run namespace sandboxes:
+// the tests shall run as root, with user namespaces and a cgroup v2 hierarchy
+// providing the memory and pids controllers.
+func nsTestCgroup(t *testing.T) string {
+	if os.Geteuid() != 0 {
+		t.Skip("namespace sandboxes need root")
+	}
+	if n, err := ioutil.ReadFile("/proc/sys/user/max_user_namespaces"); err != nil ||
+		strings.TrimSpace(string(n)) == "0" {
+		t.Skip("user namespaces are not available")
+	}
+	mounts, err := ioutil.ReadFile("/proc/self/mounts")
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, line := range strings.Split(string(mounts), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[2] != "cgroup2" {
+			continue
+		}
+		controllers, err := ioutil.ReadFile(path.Join(fields[1], "cgroup.subtree_control"))
+		if err != nil {
+			continue
+		}
+		enabled := make(map[string]bool)
+		for _, c := range strings.Fields(string(controllers)) {
+			enabled[c] = true
+		}
+		if enabled["memory"] && enabled["pids"] {
+			return path.Join(fields[1], "pythia-test")
+		}
+	}
+	t.Skip("no cgroup v2 hierarchy with the memory and pids controllers")
+	return ""
+}
+
+// RunNs executes task with input in a namespace sandbox, skipping the test if
+// this is not possible. If the UML virtual machine is available, the task is
+// also executed in it, and shall end with the same status and output.
+func runNs(t *testing.T, task pythia.Task, input string) (status pythia.Status, output string) {
+	cgroup := nsTestCgroup(t)
+	for _, fs := range []string{
+		path.Join(pytest.VmDir, task.Environment+".sfs"),
+		path.Join(pytest.TasksDir, task.TaskFS),
+	} {
+		if _, err := os.Stat(fs); err != nil {
+			t.Skip(err)
+		}
+	}
+	job := newTestJob(task, input)
+	job.Sandbox = "ns"
+	job.CgroupDir = cgroup
+	wd := testutils.Watchdog(t, task.Limits.Time+1)
+	status, output = job.Execute()
+	wd.Stop()
+	if info, err := os.Stat(pytest.UmlPath); err == nil && info.Mode().IsRegular() {
+		umlStatus, umlOutput := runTask(t, task, input)
+		testutils.Expect(t, "status (uml)", umlStatus, status)
+		testutils.Expect(t, "output (uml)", umlOutput, output)
+	}
+	return
+}
+
+func TestSplitArgs(t *testing.T) {
+	for _, c := range []struct {
+		cmd  string
+		args []string
+	}{
+		{"/bin/true\n", []string{"/bin/true"}},
+		{"  /bin/echo  a\tb  \n", []string{"/bin/echo", "a", "b"}},
+		{`/bin/echo "a b" 'c d'`, []string{"/bin/echo", "a b", "c d"}},
+		{`/bin/echo a"b c"d`, []string{"/bin/echo", "ab cd"}},
+		{`/bin/echo "a \"b\"" 'a \n'`, []string{"/bin/echo", `a "b"`, `a \n`}},
+		{`/bin/echo a\tb \x ""`, []string{"/bin/echo", "a\tb", `\x`, ""}},
+		{"", nil},
+	} {
+		args, err := splitArgs(c.cmd)
+		if err != nil {
+			t.Errorf("%q: %s", c.cmd, err)
+			continue
+		}
+		testutils.Expect(t, c.cmd, c.args, args)
+	}
+	for _, cmd := range []string{`/bin/echo "a`, "/bin/echo" +
+		strings.Repeat(" a", nsControlMaxArgs)} {
+		if _, err := splitArgs(cmd); err == nil {
+			t.Errorf("%q: expected error", cmd)
+		}
+	}
+}
+
+func TestParseStep(t *testing.T) {
+	for _, c := range []struct {
+		line string
+		step controlStep
+		cmd  string
+	}{
+		{"/bin/true", controlStep{}, "/bin/true"},
+		{"!/bin/true", controlStep{}, "!/bin/true"},
+		{"[time=5] /bin/true", controlStep{time: 5}, "/bin/true"},
+		{"[name=run output=100 continue]!/bin/true",
+			controlStep{name: "run", output: 100, cont: true}, "!/bin/true"},
+		{"[ ]\t/bin/true", controlStep{}, "/bin/true"},
+	} {
+		step, cmd, err := parseStep(c.line)
+		if err != nil {
+			t.Errorf("%q: %s", c.line, err)
+			continue
+		}
+		testutils.Expect(t, c.line+" step", c.step, step)
+		testutils.Expect(t, c.line+" command", c.cmd, cmd)
+	}
+	for _, line := range []string{"[time=5 /bin/true", "[time=-1] /bin/true",
+		"[time=] /bin/true", "[output=1k] /bin/true", "[name=] /bin/true",
+		"[retry] /bin/true"} {
+		if _, _, err := parseStep(line); err == nil {
+			t.Errorf("%q: expected error", line)
+		}
+	}
+}
+
+func TestNsTasks(t *testing.T) {
+	for _, c := range []struct {
+		task, input string
+		status      pythia.Status
+		output      string
+	}{
+		{"hello-world", "", pythia.Success, "Hello world!\n"},
+		{"hello-input", "me\npythia\n", pythia.Success, "Hello me!\nHello pythia!\n"},
+		{"overflow-kill", "", pythia.Overflow, "abcde"},
+	} {
+		status, output := runNs(t, pytest.ReadTask(t, c.task), c.input)
+		testutils.Expect(t, c.task+" status", c.status, status)
+		testutils.Expect(t, c.task+" output", c.output, output)
+	}
+}
+
+func TestNsLimits(t *testing.T) {
+	// The task is killed by the memory limit, or fails to start more
+	// processes than allowed, before printing Done.
+	task := pytest.ReadTask(t, "hog")
+	for _, limit := range []string{"memory", "processes"} {
+		status, output := runNs(t, task, limit+"\n")
+		testutils.Expect(t, limit+" status", pythia.Crash, status)
+		if !strings.HasPrefix(output, "Start\n") || strings.Contains(output, "Done") {
+			t.Errorf("%s: unexpected output %q", limit, output)
+		}
+	}
+}
+
+func TestNsUids(t *testing.T) {
+	// Running sandboxes get disjoint ranges, and released ranges are reused.
+	a, b := nsAcquireUids(1000), nsAcquireUids(1000)
+	testutils.Expect(t, "first range", 1000, a)
+	testutils.Expect(t, "second range", 1000+nsUidRange, b)
+	nsReleaseUids(a)
+	testutils.Expect(t, "reused range", 1000, nsAcquireUids(1000))
+	testutils.Expect(t, "third range", 1000+2*nsUidRange, nsAcquireUids(1000))
+	for _, uid := range []int{a, b, 1000 + 2*nsUidRange} {
+		nsReleaseUids(uid)
+	}
+}
+
+// vim:set sw=4 ts=4 noet:
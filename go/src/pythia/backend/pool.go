@@ -17,9 +17,14 @@ package backend
 
 import (
 	"flag"
+	"fmt"
 	"log"
+	"os"
+	"path/filepath"
 	"pythia"
+	"strings"
 	"sync"
+	"time"
 )
 
 func init() {
@@ -41,16 +46,31 @@ type Pool struct {
 	// Maximum number of sandboxes that may run at the same time
 	Capacity int
 
-	// Path to the UML executable
-	UmlPath string
+	// Maximum total memory (in megabytes) of the sandboxes running at the
+	// same time, or 0 for no limit
+	Memory int
 
-	// Path to the directory containing the environments
-	EnvDir string
+	// Parameters of the sandboxes
+	SandboxConfig
 
-	// Path to the directory containing the tasks
-	TasksDir string
+	// Number of sandboxes started ahead of time for each environment and
+	// memory limit of the jobs received, such that the next jobs do not wait
+	// for their sandbox to start. Only some sandbox implementations support
+	// it (see WarmSandbox); others are always started by the job. The
+	// sandboxes started ahead of time count in Memory, but not in Capacity.
+	Warm int
 
-	// Connection to the queue
+	// Whether to advertise the tasks found in TasksDir to the queue. If set,
+	// the queue will not send jobs for other tasks to this pool. Tasks added
+	// to TasksDir after the registration will then not be run by this pool.
+	AdvertiseTasks bool
+
+	// Session identifying the pool to the queue. If set, the pool reconnects
+	// when the connection to the queue is lost, and resumes its session
+	// without interrupting the running jobs. Otherwise, the pool terminates.
+	Session string
+
+	// Connection to the queue. Access is protected by mutex.
 	conn *pythia.Conn
 
 	// Channel to request shutdown
@@ -58,34 +78,76 @@ type Pool struct {
 
 	// Channel to abort all remaining jobs
 	abort chan bool
+
+	// Jobs currently running, mapped by job id. Access is protected by mutex.
+	jobs map[string]*Job
+
+	// Memory (in megabytes) allocated to the running jobs. Access is
+	// protected by mutex.
+	memoryUsed int
+
+	// Messages to send to the queue upon reconnection. Access is protected by
+	// mutex.
+	pending []pythia.Message
+
+	// Sandboxes started ahead of time and ready, and number of sandboxes
+	// being started, by environment and memory limit. Access is protected by
+	// mutex.
+	warm    map[warmKey][]WarmSandbox
+	booting map[warmKey]int
+
+	// Memory (in megabytes) allocated to the sandboxes started ahead of time,
+	// ready or being started. Access is protected by mutex.
+	warmMemory int
+
+	// Whether the pool has stopped, such that no sandbox shall be started
+	// anymore. Access is protected by mutex.
+	stopped bool
+
+	// Mutex protecting conn, jobs, memoryUsed, pending, and the state of the
+	// sandboxes started ahead of time
+	mutex sync.Mutex
+}
+
+// A warmKey identifies the sandboxes started ahead of time which a job may
+// use.
+type warmKey struct {
+	Environment string
+	Memory      int
 }
 
 // NewPool returns a new pool with default parameters.
 func NewPool() *Pool {
 	pool := new(Pool)
 	pool.Capacity = 1
-	pool.UmlPath = "vm/uml"
-	pool.EnvDir = "vm"
-	pool.TasksDir = "tasks"
+	pool.setDefaults()
 	pool.quit = make(chan bool, 1)
+	pool.jobs = make(map[string]*Job)
+	pool.warm = make(map[warmKey][]WarmSandbox)
+	pool.booting = make(map[warmKey]int)
 	return pool
 }
 
 // Setup the parameters with the command line flags in args.
 func (pool *Pool) Setup(fs *flag.FlagSet, args []string) error {
 	fs.IntVar(&pool.Capacity, "capacity", pool.Capacity, "max parallel sandboxes")
-	fs.StringVar(&pool.UmlPath, "uml", pool.UmlPath, "path to the UML executable")
-	fs.StringVar(&pool.EnvDir, "envdir", pool.EnvDir, "environments directory")
-	fs.StringVar(&pool.TasksDir, "tasksdir", pool.TasksDir, "tasks directory")
-	return fs.Parse(args)
+	fs.IntVar(&pool.Memory, "memory", pool.Memory,
+		"max total memory of parallel sandboxes in MB (0 for no limit)")
+	pool.setupFlags(fs)
+	fs.IntVar(&pool.Warm, "warm", pool.Warm,
+		"sandboxes started ahead of time per environment and memory limit")
+	fs.BoolVar(&pool.AdvertiseTasks, "advertisetasks", pool.AdvertiseTasks,
+		"only accept jobs for tasks found in the tasks directory")
+	fs.StringVar(&pool.Session, "session", pool.Session,
+		"session to resume when reconnecting to the queue (empty to quit)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return pool.check()
 }
 
 // Run the Pool component.
 func (pool *Pool) Run() {
-	conn := pythia.DialRetry(pythia.QueueAddr)
-	defer conn.Close()
-	pool.conn = conn
-	log.Println("Connected to queue", pythia.QueueAddr)
 	// Tokens is a buffered channel to enforce the capacity. Values do not
 	// matter.
 	tokens := make(chan bool, pool.Capacity)
@@ -94,27 +156,114 @@ func (pool *Pool) Run() {
 	}
 	pool.abort = make(chan bool, 1)
 	var wg sync.WaitGroup
-	conn.Send(pythia.Message{
-		Message:  pythia.RegisterPoolMsg,
-		Capacity: pool.Capacity,
-	})
-mainloop:
+	for {
+		pool.connect()
+		if pool.serve(tokens, &wg) || pool.Session == "" {
+			break
+		}
+		select {
+		case <-pool.quit:
+			// Shutdown requested while the connection was lost.
+		default:
+			log.Println("Connection to queue lost, reconnecting.")
+			continue
+		}
+		break
+	}
+	pool.mutex.Lock()
+	pool.conn.Close()
+	pool.stopWarm()
+	pool.mutex.Unlock()
+	pool.abort <- true
+	wg.Wait()
+}
+
+// Connect establishes the connection to the queue and registers the pool.
+// When resuming a session, the results of the jobs that finished while the
+// pool was disconnected are sent, and the jobs still running are advertised.
+func (pool *Pool) connect() {
+	conn := pythia.DialRetry(pythia.QueueAddr)
+	log.Println("Connected to queue", pythia.QueueAddr)
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	pool.conn = conn
+	if pool.Session != "" {
+		conn.Send(pythia.Message{
+			Message: pythia.IdentifyMsg,
+			Session: pool.Session,
+		})
+		for _, msg := range pool.pending {
+			conn.Send(msg)
+		}
+		pool.pending = nil
+	}
+	conn.Send(pool.registerMsg())
+}
+
+// Serve handles the messages from the queue until the connection is lost or
+// shutdown is requested. It returns whether shutdown has been requested.
+func (pool *Pool) serve(tokens chan bool, wg *sync.WaitGroup) bool {
+	conn := pool.conn
 	for {
 		select {
 		case msg, ok := <-conn.Receive():
 			if !ok {
-				break mainloop
+				return false
 			}
 			switch msg.Message {
 			case pythia.LaunchMsg:
+				// Input files with invalid names are rejected before taking
+				// a sandbox for the job.
+				if err := pythia.CheckFiles(msg.Files); err != nil {
+					log.Print("Job ", msg.Id, ": ", err)
+					conn.Send(pythia.Message{
+						Message: pythia.DoneMsg,
+						Id:      msg.Id,
+						Status:  pythia.Fatal,
+						Output:  fmt.Sprint(err),
+					})
+					break
+				}
 				select {
 				case <-tokens:
+					memory := msg.Task.Limits.Memory
+					// Register the job before launching it, such that an
+					// abort message following right away can find it.
+					job := pool.newJob(msg.Task, msg.Input, msg.Files)
+					pool.mutex.Lock()
+					if pool.Memory > 0 && pool.memoryUsed+memory > pool.Memory {
+						pool.mutex.Unlock()
+						tokens <- true
+						log.Print("Job ", msg.Id, ": memory exceeded.")
+						conn.Send(pythia.Message{
+							Message: pythia.DoneMsg,
+							Id:      msg.Id,
+							Status:  pythia.Error,
+							Output:  "Pool memory exceeded",
+						})
+						break
+					}
+					pool.memoryUsed += memory
+					pool.useWarm(job)
+					pool.jobs[msg.Id] = job
+					pool.mutex.Unlock()
+					var stream *outputSender
+					if msg.Stream {
+						stream = pool.newOutputSender(msg.Id)
+						job.Stream = stream.write
+					}
 					wg.Add(1)
-					go func(msg pythia.Message) {
-						pool.doJob(msg.Id, msg.Task, msg.Input)
+					go func(id string, job *Job, stream *outputSender) {
+						pool.doJob(id, job, stream)
+						pool.mutex.Lock()
+						pool.memoryUsed -= job.Task.Limits.Memory
+						// Memory may have been missing to start
+						// sandboxes ahead of time.
+						pool.startWarm(warmKey{job.Task.Environment, job.Task.Limits.Memory})
+						pool.mutex.Unlock()
 						tokens <- true
 						wg.Done()
-					}(msg)
+					}(msg.Id, job, stream)
 				default:
 					log.Print("Job ", msg.Id, ": capacity exceeded.")
 					log.Println("Capacity exceeded, cannot handle job.")
@@ -125,39 +274,134 @@ mainloop:
 						Output:  "Pool capacity exceeded",
 					})
 				}
+			case pythia.AbortMsg:
+				pool.mutex.Lock()
+				job := pool.jobs[msg.Id]
+				pool.mutex.Unlock()
+				if job == nil {
+					// The job has already finished, and its result has been
+					// sent to the queue.
+					log.Print("Job ", msg.Id, ": not running, ignoring abort.")
+				} else {
+					log.Print("Job ", msg.Id, ": aborting.")
+					job.Abort()
+				}
+			case pythia.IdentifyMsg:
+				// The queue reconciles the running jobs with the register-pool
+				// message.
 			default:
 				log.Println("Ignoring message", msg.Message)
 			}
 		case <-pool.quit:
-			break mainloop
+			return true
 		}
 	}
-	conn.Close()
-	pool.abort <- true
-	wg.Wait()
 }
 
-// DoJob executes a job and sends the result to the queue.
-// This function is meant to be run in its own goroutine, as it will block
-// until the end of the job execution.
-func (pool *Pool) doJob(id string, task *pythia.Task, input string) {
-	log.Print("Job ", id, ": executing.")
+// RegisterMsg returns the register-pool message advertising the capacity,
+// memory, environments, (if requested) tasks and running jobs of the pool.
+// It shall be called with pool.mutex held.
+func (pool *Pool) registerMsg() pythia.Message {
+	msg := pythia.Message{
+		Message:  pythia.RegisterPoolMsg,
+		Capacity: pool.Capacity,
+		Memory:   pool.Memory,
+	}
+	for id := range pool.jobs {
+		msg.Jobs = append(msg.Jobs, id)
+	}
+	envs, err := findSfs(pool.EnvDir, false)
+	if err != nil {
+		log.Println("Unable to list environments:", err)
+	}
+	for _, env := range envs {
+		msg.Environments = append(msg.Environments, strings.TrimSuffix(env, ".sfs"))
+	}
+	if pool.AdvertiseTasks {
+		msg.Tasks, err = findSfs(pool.TasksDir, true)
+		if err != nil {
+			log.Println("Unable to list tasks:", err)
+		}
+	}
+	return msg
+}
+
+// FindSfs returns the paths, relative to dir, of the squashfs images (.sfs
+// files) contained in dir. Subdirectories are searched if recursive is set.
+func findSfs(dir string, recursive bool) ([]string, error) {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != dir && !recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Ext(path) == ".sfs" {
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	return files, err
+}
+
+// NewJob creates a job configured with the parameters of the pool.
+func (pool *Pool) newJob(task *pythia.Task, input string, files map[string][]byte) *Job {
 	job := NewJob()
 	job.Task = *task
 	job.Input = input
-	job.UmlPath = pool.UmlPath
-	job.EnvDir = pool.EnvDir
-	job.TasksDir = pool.TasksDir
+	job.Files = files
+	job.SandboxConfig = pool.SandboxConfig
+	if pool.check() == nil {
+		// Create the sandbox beforehand, such that the job can be aborted
+		// before being executed. Otherwise, Execute reports the error.
+		job.sandbox = pool.newSandbox()
+	}
+	return job
+}
+
+// DoJob executes a job and sends the result to the queue. The job shall have
+// been registered in pool.jobs beforehand; it is removed once finished. If the
+// output of the job is streamed, its last chunks are sent before the result.
+// This function is meant to be run in its own goroutine, as it will block
+// until the end of the job execution.
+func (pool *Pool) doJob(id string, job *Job, stream *outputSender) {
+	if job.warm {
+		log.Print("Job ", id, ": executing in a warm sandbox.")
+	} else {
+		log.Print("Job ", id, ": executing.")
+	}
 	done := make(chan bool)
 	go func() {
 		status, output := job.Execute()
+		usage := job.Usage()
+		files, result := job.Results()
 		log.Print("Job ", id, ": finished with status ", status)
-		pool.conn.Send(pythia.Message{
+		if stream != nil {
+			stream.close()
+		}
+		pool.mutex.Lock()
+		delete(pool.jobs, id)
+		pool.send(pythia.Message{
 			Message: pythia.DoneMsg,
 			Id:      id,
 			Status:  status,
+			Limit:   job.Limit(),
 			Output:  output,
+			Stderr:  job.Stderr(),
+			Steps:   job.Steps(),
+			Files:   files,
+			Result:  result,
+			Usage:   &usage,
 		})
+		pool.mutex.Unlock()
 		done <- true
 	}()
 	select {
@@ -170,6 +414,222 @@ func (pool *Pool) doJob(id string, task *pythia.Task, input string) {
 	}
 }
 
+// UseWarm gives job a sandbox started ahead of time for its environment and
+// memory limit, if one is ready, and starts sandboxes for the next jobs. Ready
+// sandboxes are released if the memory of the pool is exceeded. This function
+// shall be called with pool.mutex held, once the memory of the job has been
+// allocated.
+func (pool *Pool) useWarm(job *Job) {
+	if pool.Warm <= 0 {
+		return
+	}
+	key := warmKey{job.Task.Environment, job.Task.Limits.Memory}
+	if sandboxes := pool.warm[key]; len(sandboxes) > 0 {
+		job.sandbox, job.warm = sandboxes[0], true
+		pool.warm[key] = sandboxes[1:]
+		pool.warmMemory -= key.Memory
+	}
+	for pool.Memory > 0 && pool.memoryUsed+pool.warmMemory > pool.Memory {
+		if !pool.releaseWarm() {
+			break
+		}
+	}
+	pool.startWarm(key)
+}
+
+// StartWarm starts sandboxes in the background for the jobs of key, up to
+// Warm of them, while they fit in the memory of the pool. This function shall
+// be called with pool.mutex held.
+func (pool *Pool) startWarm(key warmKey) {
+	if pool.check() != nil {
+		return
+	}
+	for !pool.stopped && len(pool.warm[key])+pool.booting[key] < pool.Warm {
+		if pool.Memory > 0 && pool.memoryUsed+pool.warmMemory+key.Memory > pool.Memory {
+			return
+		}
+		sandbox, ok := pool.newSandbox().(WarmSandbox)
+		if !ok {
+			return
+		}
+		pool.booting[key]++
+		pool.warmMemory += key.Memory
+		go pool.bootWarm(key, sandbox)
+	}
+}
+
+// BootWarm starts sandbox for the jobs of key, and makes it available to them
+// once ready. A sandbox failing to start is not replaced until the next job.
+func (pool *Pool) bootWarm(key warmKey, sandbox WarmSandbox) {
+	err := sandbox.Start(key.Environment, key.Memory)
+	if err != nil {
+		log.Println("Unable to start sandbox ahead of time:", err)
+	}
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	pool.booting[key]--
+	if err != nil || pool.stopped {
+		sandbox.Abort()
+		pool.warmMemory -= key.Memory
+		return
+	}
+	pool.warm[key] = append(pool.warm[key], sandbox)
+}
+
+// ReleaseWarm releases a ready sandbox started ahead of time, and returns
+// false if there is none. This function shall be called with pool.mutex held.
+func (pool *Pool) releaseWarm() bool {
+	for key, sandboxes := range pool.warm {
+		if len(sandboxes) == 0 {
+			continue
+		}
+		sandboxes[0].Abort()
+		pool.warm[key] = sandboxes[1:]
+		pool.warmMemory -= key.Memory
+		return true
+	}
+	return false
+}
+
+// StopWarm releases the sandboxes started ahead of time, and prevents
+// starting new ones. The sandboxes being started are released once started.
+// This function shall be called with pool.mutex held.
+func (pool *Pool) stopWarm() {
+	pool.stopped = true
+	for pool.releaseWarm() {
+	}
+}
+
+// Send sends msg to the queue. If the connection is lost and the pool has a
+// session, msg is kept to be sent upon reconnection. As the job is removed
+// from pool.jobs in the same critical section, a message lost with the
+// connection makes the queue reschedule the job when the pool resumes.
+// This function shall be called with pool.mutex held.
+func (pool *Pool) send(msg pythia.Message) {
+	if err := pool.conn.Send(msg); err != nil && pool.Session != "" {
+		pool.pending = append(pool.pending, msg)
+	}
+}
+
+// An outputSender sends the output of a job to the queue while the job is
+// running. The chunks of the output are gathered, and sent in a single message
+// at most every outputInterval, or as soon as outputBatch bytes are waiting.
+// Messages are sent from a dedicated goroutine, such that neither the job nor
+// the pool waits for the connection. Contrary to the other messages, the
+// chunks are not kept when the connection is lost, as the done message
+// contains the whole output.
+type outputSender struct {
+	pool *Pool
+	id   string
+
+	// Output not sent yet. Access is protected by mutex.
+	buf []byte
+
+	// Whether the job has finished. Access is protected by mutex.
+	closed bool
+
+	// Mutex protecting buf and closed
+	mutex sync.Mutex
+
+	// Channel to wake up the goroutine sending the output. Values do not
+	// matter.
+	wake chan bool
+
+	// Channel closed once the whole output has been sent
+	done chan bool
+}
+
+const (
+	// Interval between two output messages of a job
+	outputInterval = 100 * time.Millisecond
+
+	// Size of the output sent without waiting for the end of the interval
+	outputBatch = 4096
+)
+
+// NewOutputSender returns an outputSender for job id, whose goroutine is
+// running until the sender is closed.
+func (pool *Pool) newOutputSender(id string) *outputSender {
+	s := &outputSender{
+		pool: pool,
+		id:   id,
+		wake: make(chan bool, 1),
+		done: make(chan bool),
+	}
+	go s.run()
+	return s
+}
+
+// Write adds chunk to the output to send.
+func (s *outputSender) write(chunk string) {
+	s.mutex.Lock()
+	s.buf = append(s.buf, chunk...)
+	s.mutex.Unlock()
+	s.signal()
+}
+
+// Close sends the output not sent yet, and waits for the goroutine to
+// terminate.
+func (s *outputSender) close() {
+	s.mutex.Lock()
+	s.closed = true
+	s.mutex.Unlock()
+	s.signal()
+	<-s.done
+}
+
+// Signal wakes up the goroutine sending the output, if it is not already
+// about to wake up.
+func (s *outputSender) signal() {
+	select {
+	case s.wake <- true:
+	default:
+	}
+}
+
+// Ready returns whether the output shall be sent without waiting for the end
+// of the interval.
+func (s *outputSender) ready() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closed || len(s.buf) >= outputBatch
+}
+
+// Run sends the output until the sender is closed.
+func (s *outputSender) run() {
+	defer close(s.done)
+	for {
+		<-s.wake
+		timer := time.NewTimer(outputInterval)
+	wait:
+		for !s.ready() {
+			select {
+			case <-s.wake:
+			case <-timer.C:
+				break wait
+			}
+		}
+		timer.Stop()
+		s.mutex.Lock()
+		chunk, closed := string(s.buf), s.closed
+		s.buf = nil
+		s.mutex.Unlock()
+		if chunk != "" {
+			s.pool.mutex.Lock()
+			conn := s.pool.conn
+			s.pool.mutex.Unlock()
+			conn.Send(pythia.Message{
+				Message: pythia.OutputMsg,
+				Id:      s.id,
+				Output:  chunk,
+			})
+		}
+		if closed {
+			return
+		}
+	}
+}
+
 // Shut down the Pool component.
 func (pool *Pool) Shutdown() {
 	select {
@@ -17,10 +17,14 @@ package backend
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"pythia"
 	"testing"
 	"testutils"
 	"testutils/pytest"
+	"time"
 )
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -42,6 +46,14 @@ type PoolFixture struct {
 // The pool capacity is configured with capacity. The test will fail if the pool
 // does not register correctly.
 func SetupPoolFixture(t *testing.T, capacity int) *PoolFixture {
+	pool := NewPool()
+	pool.Capacity = capacity
+	return SetupPoolFixtureWith(t, pool)
+}
+
+// SetupPoolFixtureWith behaves like SetupPoolFixture, but runs the given pool,
+// which may have been configured by the caller.
+func SetupPoolFixtureWith(t *testing.T, pool *Pool) *PoolFixture {
 	var err error
 	f := new(PoolFixture)
 	// Setup mock queue
@@ -57,26 +69,34 @@ func SetupPoolFixture(t *testing.T, capacity int) *PoolFixture {
 	}
 	// Setup pool
 	t.Log("Setup pool")
-	f.Pool = NewPool()
-	f.Pool.Capacity = capacity
+	f.Pool = pool
 	f.Pool.UmlPath = pytest.UmlPath
 	f.Pool.EnvDir = pytest.VmDir
 	f.Pool.TasksDir = pytest.TasksDir
 	go f.Pool.Run()
-	// Establish connection
+	f.Accept(t)
+	return f
+}
+
+// Accept accepts the connection of the pool. The test will fail if the pool
+// does not register correctly.
+func (f *PoolFixture) Accept(t *testing.T) {
 	t.Log("Establish connection")
 	conn, err := f.Queue.Accept()
 	if err != nil {
 		f.Queue.Close()
 		t.Fatal(err)
 	}
-	f.Conn = &pytest.Conn{t, conn}
+	f.Conn = &pytest.Conn{T: t, Conn: conn, IgnoreUsage: true}
 	// Wait for register-pool message
-	f.Conn.Expect(2, pythia.Message{
-		Message:  pythia.RegisterPoolMsg,
-		Capacity: capacity,
-	})
-	return f
+	if f.Pool.Session == "" {
+		f.Conn.Expect(2, f.Pool.registerMsg())
+	} else {
+		f.Conn.Expect(2, pythia.Message{
+			Message: pythia.IdentifyMsg,
+			Session: f.Pool.Session,
+		}, f.Pool.registerMsg())
+	}
 }
 
 // TearDown tears down the fixture, closing the connections and shutting down
@@ -138,14 +158,83 @@ func TestPoolExceedCapacity(t *testing.T) {
 		Message: pythia.DoneMsg,
 		Id:      "1",
 		Status:  pythia.Timeout,
+		Limit:   pythia.TimeLimit,
 		Output:  "Start\n",
 	}, pythia.Message{
 		Message: pythia.DoneMsg,
 		Id:      "2",
 		Status:  pythia.Timeout,
+		Limit:   pythia.TimeLimit,
 		Output:  "Start\n",
 	})
 	f.TearDown()
 }
 
+func TestPoolAbort(t *testing.T) {
+	task := pytest.ReadTask(t, "timeout")
+	f := SetupPoolFixture(t, 1)
+	f.Conn.Send(pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      "timeout",
+		Task:    &task,
+	})
+	time.Sleep(1 * time.Second)
+	f.Conn.Send(pythia.Message{
+		Message: pythia.AbortMsg,
+		Id:      "timeout",
+	})
+	f.Conn.Expect(2, pythia.Message{
+		Message: pythia.DoneMsg,
+		Id:      "timeout",
+		Status:  pythia.Abort,
+		Output:  "Start\n",
+	})
+	f.TearDown()
+}
+
+func TestPoolRegisterEnvironments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pythia-pool-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"vm/busybox.sfs", "vm/python.sfs", "vm/uml",
+		"tasks/hello-world.sfs", "tasks/hello-world.task", "tasks/sub/q1.sfs"} {
+		name = filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pool := NewPool()
+	pool.Capacity = 2
+	pool.EnvDir = filepath.Join(dir, "vm")
+	pool.TasksDir = filepath.Join(dir, "tasks")
+	testutils.Expect(t, "message", pythia.Message{
+		Message:      pythia.RegisterPoolMsg,
+		Capacity:     2,
+		Environments: []string{"busybox", "python"},
+	}, pool.registerMsg())
+	pool.AdvertiseTasks = true
+	testutils.Expect(t, "message", pythia.Message{
+		Message:      pythia.RegisterPoolMsg,
+		Capacity:     2,
+		Environments: []string{"busybox", "python"},
+		Tasks:        []string{"hello-world.sfs", "sub/q1.sfs"},
+	}, pool.registerMsg())
+}
+
+func TestPoolResume(t *testing.T) {
+	pool := NewPool()
+	pool.Session = "p"
+	f := SetupPoolFixtureWith(t, pool)
+	// The pool shall reconnect and resume its session.
+	f.Conn.Close()
+	f.Accept(t)
+	f.Pool.Shutdown()
+	f.TearDown()
+}
+
 // vim:set sw=4 ts=4 noet:
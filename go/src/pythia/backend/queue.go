@@ -18,11 +18,12 @@ package backend
 import (
 	"container/list"
 	"flag"
-	"fmt"
 	"log"
 	"pythia"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 func init() {
@@ -40,23 +41,88 @@ type queueClient struct {
 	// Unique identifier of the connection
 	Id int
 
+	// The session the client has identified with, or empty if the client did
+	// not identify.
+	Session string
+
 	// The response channel.
 	Response chan<- pythia.Message
 
 	// The number of parallel jobs this pool can handle.
 	Capacity int
 
+	// The total memory (in megabytes) of the sandboxes this pool can handle,
+	// or 0 if there is no limit.
+	Memory int
+
+	// The memory (in megabytes) allocated to the jobs currently running in
+	// this pool.
+	MemoryUsed int
+
+	// The environments and task filesystems available in this pool. A nil
+	// set means that the pool did not advertise them, and is assumed to
+	// support any.
+	Environments, Tasks map[string]bool
+
 	// Jobs currently running in this pool, mapped by job id.
 	Running map[string]*queueJob
 
+	// Number of jobs executed by this pool, and number of them executed in
+	// a sandbox started ahead of time.
+	Executed, WarmHits int
+
 	// Jobs submitted (and not yet done) by this client, mapped by job id.
 	Submitted map[string]*queueJob
+
+	// Number of jobs submitted by this client that are currently waiting and
+	// running, respectively.
+	Waiting, InFlight int
+
+	// Whether the pool is being drained: no new job is dispatched to it.
+	Draining bool
+}
+
+// CanRun returns whether the client is a pool able to run job (regardless of
+// its current load).
+func (client *queueClient) CanRun(job *queueJob) bool {
+	task := job.Msg.Task
+	switch {
+	case client.Capacity == 0 || client.Draining || task == nil:
+		return false
+	case client.Memory > 0 && task.Limits.Memory > client.Memory:
+		return false
+	case client.Environments != nil && !client.Environments[task.Environment]:
+		return false
+	case client.Tasks != nil && !client.Tasks[task.TaskFS]:
+		return false
+	default:
+		return true
+	}
+}
+
+// Fits returns whether the client has enough free memory to run job right now.
+func (client *queueClient) Fits(job *queueJob) bool {
+	return client.Memory == 0 ||
+		client.MemoryUsed+job.Msg.Task.Limits.Memory <= client.Memory
+}
+
+// NewSet returns a set containing the given elements, or nil if there are no
+// elements.
+func newSet(elements []string) map[string]bool {
+	if len(elements) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(elements))
+	for _, e := range elements {
+		set[e] = true
+	}
+	return set
 }
 
 // A queueJob is an internal structure keeping information about a job during
 // its whole lifetime in the queue.
 //
-// Invariant: WaitingElement != nil || Pool != nil
+// Invariant: WaitingElement != nil || Pool != nil || Result != nil
 type queueJob struct {
 	// The job identifier. Must be the same as Msg.Id.
 	Id string
@@ -67,13 +133,32 @@ type queueJob struct {
 	// The client having submitted this job.
 	Origin *queueClient
 
-	// Element of the queue.waiting list pointing to this job, or nil if the job
-	// is currently running.
+	// The session of the client having submitted this job, or empty if the
+	// client did not identify.
+	Session string
+
+	// Element of the queue.waiting lists pointing to this job, or nil if the
+	// job is currently running.
 	WaitingElement *list.Element
 
+	// Time at which the job has been queued.
+	Queued time.Time
+
+	// Time at which the job has been dispatched to its pool, or zero if the
+	// job is not running.
+	Started time.Time
+
 	// Pool in which this job is currently running, or nil if the job is waiting
 	// to be scheduled.
 	Pool *queueClient
+
+	// The done message of the job if it is done, but the client holding its
+	// session has not connected yet.
+	Result *pythia.Message
+
+	// Output of the job not forwarded yet, as the origin was not ready to
+	// receive it.
+	Output string
 }
 
 // A queueMessage is an internal message from a queue connection handler to the
@@ -94,6 +179,9 @@ const (
 
 	// Shutdown has been requested
 	quitMsg pythia.MsgType = "-quit"
+
+	// The grace period of a disconnected session has elapsed
+	expireMsg pythia.MsgType = "-expire"
 )
 
 // The Queue is the central component of Pythia.
@@ -106,12 +194,32 @@ type Queue struct {
 	// The maximum number of jobs that can wait to be executed.
 	Capacity int
 
+	// The maximum number of jobs a single client can have waiting. Zero means
+	// no limit besides Capacity.
+	ClientCapacity int
+
+	// Interval after which the priority of a waiting job is increased by one,
+	// to prevent starvation of low-priority jobs. Zero disables aging.
+	AgingInterval time.Duration
+
+	// Directory of the journal recording the jobs of identified clients, to
+	// recover them after a restart. Empty disables the journal.
+	JournalDir string
+
+	// How long the jobs of a disconnected client having identified with a
+	// session are kept for the session to be resumed. Zero discards them on
+	// disconnection.
+	Grace time.Duration
+
 	// Channel to send messages to the main goroutine
 	master chan<- queueMessage
 
 	// Channel to request shutdown
 	quit chan bool
 
+	// Channel closed when the main goroutine has terminated
+	done chan bool
+
 	// WaitGroup for all goroutines
 	wg sync.WaitGroup
 
@@ -121,14 +229,24 @@ type Queue struct {
 	// Jobs to be processed/currently processing
 	jobs map[string]*queueJob
 
-	// List of jobs (*queueJob) waiting to be assigned.
-	waiting *list.List
+	// Jobs waiting to be assigned, ordered by priority.
+	waiting *waitingQueue
+
+	// Clients holding the sessions, mapped by session. The client of a session
+	// recovered from the journal has no connection until a client identifies
+	// with that session.
+	sessions map[string]*queueClient
+
+	// Journal of the jobs, or nil if disabled.
+	journal *queueJournal
 }
 
 // NewQueue returns a new queue with default parameters.
 func NewQueue() *Queue {
 	queue := new(Queue)
 	queue.Capacity = 500
+	queue.AgingInterval = time.Minute
+	queue.Grace = time.Minute
 	queue.quit = make(chan bool, 1)
 	return queue
 }
@@ -136,6 +254,14 @@ func NewQueue() *Queue {
 // Setup configures the queue with the command line flags in args.
 func (queue *Queue) Setup(fs *flag.FlagSet, args []string) error {
 	fs.IntVar(&queue.Capacity, "capacity", queue.Capacity, "queue capacity")
+	fs.IntVar(&queue.ClientCapacity, "clientcapacity", queue.ClientCapacity,
+		"max waiting jobs per client (0 for no limit)")
+	fs.DurationVar(&queue.AgingInterval, "aging", queue.AgingInterval,
+		"waiting time after which the priority of a job is increased")
+	fs.StringVar(&queue.JournalDir, "journal", queue.JournalDir,
+		"journal directory (empty to disable the journal)")
+	fs.DurationVar(&queue.Grace, "grace", queue.Grace,
+		"how long the jobs of a disconnected session are kept")
 	return fs.Parse(args)
 }
 
@@ -149,6 +275,7 @@ func (queue *Queue) Run() {
 	closing := false
 	master := make(chan queueMessage)
 	queue.master = master
+	queue.done = make(chan bool)
 	go func() {
 		<-queue.quit
 		closing = true
@@ -192,9 +319,20 @@ func (queue *Queue) Shutdown() {
 // Main goroutine responsible for scheduling the jobs.
 func (queue *Queue) main(master <-chan queueMessage) {
 	defer queue.wg.Done()
+	defer close(queue.done)
 	queue.clients = make(map[int]*queueClient)
 	queue.jobs = make(map[string]*queueJob)
-	queue.waiting = list.New()
+	queue.waiting = newWaitingQueue(queue.AgingInterval)
+	queue.sessions = make(map[string]*queueClient)
+	if queue.JournalDir != "" {
+		journal, jobs, err := openJournal(queue.JournalDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		queue.journal = journal
+		queue.restore(jobs)
+	}
+	defer queue.journal.Close()
 	for qm := range master {
 		switch qm.Msg.Message {
 		case connectMsg:
@@ -202,8 +340,40 @@ func (queue *Queue) main(master <-chan queueMessage) {
 			queue.clients[qm.Client.Id] = qm.Client
 		case pythia.RegisterPoolMsg:
 			log.Print("Client ", qm.Client.Id, ": pool capacity ",
-				qm.Msg.Capacity)
+				qm.Msg.Capacity, ", memory ", qm.Msg.Memory,
+				"MB, environments ", qm.Msg.Environments)
 			qm.Client.Capacity = qm.Msg.Capacity
+			qm.Client.Memory = qm.Msg.Memory
+			qm.Client.Environments = newSet(qm.Msg.Environments)
+			qm.Client.Tasks = newSet(qm.Msg.Tasks)
+			running := newSet(qm.Msg.Jobs)
+			for id, job := range qm.Client.Running {
+				if !running[id] {
+					// The pool has resumed its session, but the job has been
+					// lost while it was disconnected.
+					log.Print("Job ", id, ": lost by the pool, rescheduling.")
+					queue.reschedule(job)
+				}
+			}
+		case pythia.IdentifyMsg:
+			session := qm.Msg.Session
+			log.Print("Client ", qm.Client.Id, ": identified as ", session, ".")
+			qm.Client.Session = session
+			if old := queue.sessions[session]; old != nil {
+				queue.transfer(old, qm.Client)
+			}
+			queue.sessions[session] = qm.Client
+			var jobs []string
+			for id, job := range qm.Client.Submitted {
+				if job.Session == session {
+					jobs = append(jobs, id)
+				}
+			}
+			qm.Client.Response <- pythia.Message{
+				Message: pythia.IdentifyMsg,
+				Session: session,
+				Jobs:    jobs,
+			}
 		case pythia.LaunchMsg:
 			id := qm.Msg.Id
 			if _, ok := queue.jobs[id]; ok {
@@ -214,6 +384,23 @@ func (queue *Queue) main(master <-chan queueMessage) {
 					Status:  pythia.Fatal,
 					Output:  "Job already launched",
 				}
+			} else if queue.ClientCapacity > 0 &&
+				qm.Client.Waiting >= queue.ClientCapacity {
+				log.Print("Job ", id, ": client quota exceeded, rejecting.")
+				qm.Client.Response <- pythia.Message{
+					Message: pythia.DoneMsg,
+					Id:      id,
+					Status:  pythia.Error,
+					Output:  "Client quota exceeded",
+				}
+			} else if !queue.canServe(qm.Msg) {
+				log.Print("Job ", id, ": no pool can run it, rejecting.")
+				qm.Client.Response <- pythia.Message{
+					Message: pythia.DoneMsg,
+					Id:      id,
+					Status:  pythia.Fatal,
+					Output:  "No pool supports this task",
+				}
 			} else if queue.waiting.Len() >= queue.Capacity {
 				log.Print("Job ", id, ": queue full, rejecting.")
 				qm.Client.Response <- pythia.Message{
@@ -224,14 +411,37 @@ func (queue *Queue) main(master <-chan queueMessage) {
 				}
 			} else {
 				job := &queueJob{
-					Id:     id,
-					Msg:    qm.Msg,
-					Origin: qm.Client,
+					Id:      id,
+					Msg:     qm.Msg,
+					Origin:  qm.Client,
+					Session: qm.Client.Session,
+					Queued:  time.Now(),
 				}
 				qm.Client.Submitted[id] = job
 				queue.jobs[id] = job
-				job.WaitingElement = queue.waiting.PushBack(job)
-				log.Print("Job ", id, ": queued.")
+				queue.waiting.PushBack(job)
+				queue.journal.Launch(job)
+				log.Print("Job ", id, ": queued with priority ", job.Msg.Priority, ".")
+			}
+		case pythia.OutputMsg:
+			// Output chunks are only forwarded to a connected origin, and are
+			// not journaled. As the main goroutine shall not wait for an
+			// origin which is not keeping up, the chunks it is not ready to
+			// receive are coalesced with the next ones, and dropped if the
+			// job ends meanwhile (the done message contains the whole
+			// output).
+			job := queue.jobs[qm.Msg.Id]
+			if job == nil || job.Pool != qm.Client {
+				log.Println("Ignoring output of unknown job", qm.Msg.Id)
+			} else if job.Msg.Stream && job.Origin != nil && job.Origin.Response != nil {
+				msg := qm.Msg
+				msg.Output = job.Output + msg.Output
+				select {
+				case job.Origin.Response <- msg:
+					job.Output = ""
+				default:
+					job.Output = msg.Output
+				}
 			}
 		case pythia.DoneMsg:
 			id := qm.Msg.Id
@@ -246,43 +456,88 @@ func (queue *Queue) main(master <-chan queueMessage) {
 				log.Println("Ignoring message from wrong source", qm.Msg)
 				break
 			}
-			delete(queue.jobs, id)
+			job.Pool = nil
+			job.Output = ""
 			delete(pool.Running, id)
+			pool.MemoryUsed -= job.Msg.Task.Limits.Memory
+			if usage := qm.Msg.Usage; usage != nil {
+				pool.Executed++
+				if usage.Warm {
+					pool.WarmHits++
+				}
+			}
 			if job.Origin != nil {
-				// job.Origin is nil if the submitting client has disconnected
-				// before receiving the result.
-				delete(job.Origin.Submitted, id)
-				job.Origin.Response <- qm.Msg
+				job.Origin.InFlight--
 			}
+			queue.finish(job, qm.Msg)
+		case pythia.AbortMsg:
+			id := qm.Msg.Id
+			job := queue.jobs[id]
+			if job == nil || job.Origin != qm.Client {
+				log.Println("Ignoring abort for unknown job", qm.Msg)
+				break
+			}
+			if job.WaitingElement != nil || job.Pool != nil {
+				queue.abort(job)
+			}
+		case pythia.CancelMsg:
+			id := qm.Msg.Id
+			reply := pythia.Message{Message: pythia.CancelMsg, Id: id}
+			job := queue.jobs[id]
+			if job == nil || (job.WaitingElement == nil && job.Pool == nil) {
+				reply.Error = "Unknown job"
+			} else {
+				log.Print("Job ", id, ": cancelled by client ", qm.Client.Id, ".")
+				queue.abort(job)
+			}
+			qm.Client.Response <- reply
+		case pythia.DrainMsg, pythia.UndrainMsg:
+			reply := pythia.Message{Message: qm.Msg.Message, Id: qm.Msg.Id}
+			pool := queue.pool(qm.Msg.Id)
+			if pool == nil {
+				reply.Error = "Unknown pool"
+			} else {
+				pool.Draining = qm.Msg.Message == pythia.DrainMsg
+				log.Print("Client ", pool.Id, ": draining ", pool.Draining, ".")
+			}
+			qm.Client.Response <- reply
 		case closedMsg:
 			log.Print("Client ", qm.Client.Id, ": disconnected.")
 			close(qm.Client.Response)
 			delete(queue.clients, qm.Client.Id)
-			for _, job := range qm.Client.Running {
-				if job.Origin == nil {
-					// Submitter disconnected, we can discard the job.
-					delete(queue.jobs, job.Id)
-				} else {
-					// Otherwise, reschedule it.
-					job.Pool = nil
-					job.WaitingElement = queue.waiting.PushFront(job)
+			if queue.sessions[qm.Client.Session] == qm.Client {
+				delete(queue.sessions, qm.Client.Session)
+				if queue.Grace > 0 {
+					queue.detach(qm.Client)
 				}
 			}
-			for _, job := range qm.Client.Submitted {
-				if job.WaitingElement != nil {
-					// Job is in waiting queue, discard it.
-					queue.waiting.Remove(job.WaitingElement)
-					delete(queue.jobs, job.Id)
-				} else if job.Pool != nil {
-					// Job is running, abort it.
-					job.Origin = nil
-					job.Pool.Response <- pythia.Message{
-						Message: pythia.AbortMsg,
-						Id:      job.Id,
-					}
-					// Keep job in queue.jobs to handle abort result
-				}
+			queue.discard(qm.Client)
+		case pythia.StatusMsg:
+			qm.Client.Response <- pythia.Message{
+				Message: pythia.StatusMsg,
+				Queue:   queue.status(),
+			}
+		case pythia.ListJobsMsg:
+			qm.Client.Response <- pythia.Message{
+				Message: pythia.ListJobsMsg,
+				JobList: queue.listJobs(),
+			}
+		case pythia.JobInfoMsg:
+			reply := pythia.Message{Message: pythia.JobInfoMsg, Id: qm.Msg.Id}
+			if job := queue.jobs[qm.Msg.Id]; job != nil {
+				info := queue.jobInfo(job)
+				reply.Job = &info
+			}
+			qm.Client.Response <- reply
+		case expireMsg:
+			session := qm.Client.Session
+			if queue.sessions[session] != qm.Client {
+				// The session has been resumed meanwhile.
+				break
 			}
+			log.Print("Session ", session, ": expired.")
+			delete(queue.sessions, session)
+			queue.discard(qm.Client)
 		case quitMsg:
 			log.Println("Quitting.")
 			goto quit
@@ -292,6 +547,7 @@ func (queue *Queue) main(master <-chan queueMessage) {
 
 		// Schedule jobs
 		queue.schedule()
+		queue.journal.Compact(queue.jobs)
 	}
 
 quit:
@@ -316,20 +572,302 @@ quit:
 	}
 }
 
-// Schedule assigns waiting jobs to free sandboxes.
+// Restore adds the jobs recovered from the journal to the queue. Jobs that are
+// not done are queued again, including those that had been dispatched to a
+// pool before the restart. The jobs are held by disconnected clients, one per
+// session, until a client identifies with their session or the grace period
+// expires.
+// This function shall be called from the main goroutine.
+func (queue *Queue) restore(jobs []*journalJob) {
+	for _, j := range jobs {
+		origin := queue.sessions[j.Session]
+		if origin == nil {
+			origin = &queueClient{
+				Id:        -1,
+				Session:   j.Session,
+				Running:   make(map[string]*queueJob),
+				Submitted: make(map[string]*queueJob),
+			}
+			queue.sessions[j.Session] = origin
+			if queue.Grace > 0 {
+				queue.expireLater(origin)
+			}
+		}
+		job := &queueJob{
+			Id:      j.Msg.Id,
+			Msg:     j.Msg,
+			Origin:  origin,
+			Session: j.Session,
+			Queued:  j.Queued,
+			Result:  j.Result,
+		}
+		origin.Submitted[job.Id] = job
+		queue.jobs[job.Id] = job
+		if job.Result == nil {
+			queue.waiting.PushBack(job)
+		}
+	}
+	log.Print("Recovered ", len(jobs), " jobs from the journal.")
+}
+
+// Transfer moves the jobs of the session of to from client from to client to:
+// the jobs submitted within the session, and the jobs running in from and its
+// execution counters if it is a pool. If to is connected, the results kept for the session are delivered
+// to it, and the aborts of jobs whose submitter has left are sent to it.
+// This function shall be called from the main goroutine.
+func (queue *Queue) transfer(from, to *queueClient) {
+	for id, job := range from.Submitted {
+		if job.Session != to.Session {
+			continue
+		}
+		delete(from.Submitted, id)
+		if job.Result != nil && to.Response != nil {
+			delete(queue.jobs, id)
+			queue.journal.Remove(job)
+			to.Response <- *job.Result
+			continue
+		}
+		if job.WaitingElement != nil {
+			from.Waiting--
+			to.Waiting++
+		} else if job.Pool != nil {
+			from.InFlight--
+			to.InFlight++
+		}
+		job.Origin = to
+		to.Submitted[id] = job
+	}
+	for id, job := range from.Running {
+		delete(from.Running, id)
+		memory := job.Msg.Task.Limits.Memory
+		from.MemoryUsed -= memory
+		to.MemoryUsed += memory
+		job.Pool = to
+		to.Running[id] = job
+		if job.Origin == nil && to.Response != nil {
+			to.Response <- pythia.Message{Message: pythia.AbortMsg, Id: id}
+		}
+	}
+	to.Executed += from.Executed
+	to.WarmHits += from.WarmHits
+	from.Executed, from.WarmHits = 0, 0
+}
+
+// Finish delivers the result of job to its origin, or keeps it until a client
+// identifies with the session of the job if the origin is disconnected. The
+// job shall be neither waiting nor running anymore.
+// This function shall be called from the main goroutine.
+func (queue *Queue) finish(job *queueJob, result pythia.Message) {
+	if job.Origin == nil {
+		// job.Origin is nil if the submitting client has disconnected
+		// before receiving the result.
+		delete(queue.jobs, job.Id)
+		queue.journal.Remove(job)
+	} else if job.Origin.Response == nil {
+		// The submitting client is disconnected, but may resume its session.
+		// Keep the result.
+		job.Result = &result
+		queue.journal.Done(job)
+	} else {
+		delete(queue.jobs, job.Id)
+		delete(job.Origin.Submitted, job.Id)
+		queue.journal.Remove(job)
+		job.Origin.Response <- result
+	}
+}
+
+// Abort aborts job, which shall be waiting or running. The origin of the job
+// receives a done message with status abort, either right away or from the
+// pool running the job.
+// This function shall be called from the main goroutine.
+func (queue *Queue) abort(job *queueJob) {
+	result := pythia.Message{
+		Message: pythia.DoneMsg,
+		Id:      job.Id,
+		Status:  pythia.Abort,
+	}
+	if job.WaitingElement != nil {
+		log.Print("Job ", job.Id, ": aborted while waiting.")
+		queue.waiting.Remove(job)
+		queue.finish(job, result)
+	} else if job.Pool.Response == nil {
+		log.Print("Job ", job.Id, ": aborted while its pool is disconnected.")
+		// The abort is sent to the pool if it resumes its session (see
+		// transfer). Meanwhile, the job is kept without origin to account for
+		// the pool resources.
+		if origin := job.Origin; origin != nil {
+			origin.InFlight--
+			delete(origin.Submitted, job.Id)
+			job.Origin = nil
+			queue.journal.Remove(job)
+			if origin.Response != nil {
+				origin.Response <- result
+			}
+		}
+	} else {
+		log.Print("Job ", job.Id, ": aborting.")
+		// The pool will answer with a done message, which will be forwarded
+		// to the origin as usual.
+		job.Pool.Response <- pythia.Message{
+			Message: pythia.AbortMsg,
+			Id:      job.Id,
+		}
+	}
+}
+
+// Pool returns the connected pool whose connection identifier is id, or nil if
+// there is no such pool.
+// This function shall be called from the main goroutine.
+func (queue *Queue) pool(id string) *queueClient {
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return nil
+	}
+	client := queue.clients[n]
+	if client == nil || client.Capacity == 0 {
+		return nil
+	}
+	return client
+}
+
+// Detach moves the jobs of the session held by client, which has
+// disconnected, to a new disconnected client. The jobs are kept until a client
+// identifies with the session, or until the grace period expires.
+// This function shall be called from the main goroutine.
+func (queue *Queue) detach(client *queueClient) {
+	log.Print("Session ", client.Session, ": detached for ", queue.Grace, ".")
+	detached := &queueClient{
+		Id:        client.Id,
+		Session:   client.Session,
+		Running:   make(map[string]*queueJob),
+		Submitted: make(map[string]*queueJob),
+	}
+	queue.transfer(client, detached)
+	queue.sessions[client.Session] = detached
+	queue.expireLater(detached)
+}
+
+// ExpireLater requests the main goroutine to expire the session of the
+// disconnected client after the grace period.
+func (queue *Queue) expireLater(client *queueClient) {
+	master, done := queue.master, queue.done
+	time.AfterFunc(queue.Grace, func() {
+		select {
+		case master <- queueMessage{pythia.Message{Message: expireMsg}, client}:
+		case <-done:
+		}
+	})
+}
+
+// Discard releases the jobs of a client that has left for good. The jobs
+// running in it are rescheduled, and the jobs it submitted are discarded (or
+// aborted if they are running).
+// This function shall be called from the main goroutine.
+func (queue *Queue) discard(client *queueClient) {
+	for _, job := range client.Running {
+		queue.reschedule(job)
+	}
+	for _, job := range client.Submitted {
+		if job.WaitingElement != nil {
+			// Job is in waiting queue, discard it.
+			queue.waiting.Remove(job)
+			delete(queue.jobs, job.Id)
+			queue.journal.Remove(job)
+		} else if job.Pool != nil {
+			// Job is running, abort it. Keep job in queue.jobs to handle
+			// abort result.
+			job.Origin = nil
+			if job.Pool.Response != nil {
+				job.Pool.Response <- pythia.Message{
+					Message: pythia.AbortMsg,
+					Id:      job.Id,
+				}
+			}
+		} else {
+			// Job is done, discard its result.
+			delete(queue.jobs, job.Id)
+			queue.journal.Remove(job)
+		}
+	}
+}
+
+// Reschedule puts back a job running in a pool into the waiting queue, or
+// discards it if its submitter has left.
+// This function shall be called from the main goroutine.
+func (queue *Queue) reschedule(job *queueJob) {
+	delete(job.Pool.Running, job.Id)
+	job.Pool.MemoryUsed -= job.Msg.Task.Limits.Memory
+	job.Pool = nil
+	job.Started = time.Time{}
+	job.Output = ""
+	if job.Origin == nil {
+		// Submitter disconnected, we can discard the job.
+		delete(queue.jobs, job.Id)
+		queue.journal.Remove(job)
+	} else {
+		job.Origin.InFlight--
+		queue.waiting.Insert(job)
+	}
+}
+
+// CanServe returns whether the job launched by msg may be run by a registered
+// pool. If no pool has registered yet (or all pools are being drained), the job
+// is assumed to be runnable by a pool connecting later.
+// This function shall be called from the main goroutine.
+func (queue *Queue) canServe(msg pythia.Message) bool {
+	if msg.Task == nil {
+		return false
+	}
+	job := &queueJob{Id: msg.Id, Msg: msg}
+	registered := false
+	for _, client := range queue.clients {
+		if client.Capacity > 0 && !client.Draining {
+			registered = true
+			if client.CanRun(job) {
+				return true
+			}
+		}
+	}
+	return !registered
+}
+
+// Schedule assigns waiting jobs to free sandboxes able to run them, highest
+// priority first and fairly shared between clients (see waitingQueue).
+//
+// Jobs are packed in the pools according to their memory limit. If the next
+// job a pool can run does not fit in its remaining memory, no other job is
+// assigned to that pool until enough memory is released. Hence, large jobs are
+// not starved by smaller ones.
+//
 // This function shall be called from the main goroutine, as it manipulates
 // the queue data structures.
 func (queue *Queue) schedule() {
 	if queue.waiting.Len() == 0 {
 		return
 	}
+	now := time.Now()
 	for _, client := range queue.clients {
 		for len(client.Running) < client.Capacity {
-			job := queue.waiting.Remove(queue.waiting.Front()).(*queueJob)
-			job.WaitingElement = nil
+			job := queue.waiting.Front(now, client.CanRun)
+			if job == nil || !client.Fits(job) {
+				break
+			}
+			queue.waiting.Remove(job)
+			job.Origin.InFlight++
 			job.Pool = client
+			job.Started = now
 			client.Running[job.Id] = job
+			client.MemoryUsed += job.Msg.Task.Limits.Memory
 			client.Response <- job.Msg
+			queue.journal.Dispatch(job)
+			// Streamed jobs are always notified, so that the origin knows
+			// that the output starts over when a job is dispatched again.
+			if (job.Msg.Notify || job.Msg.Stream) && job.Origin.Response != nil {
+				job.Origin.Response <- pythia.Message{
+					Message: pythia.StartedMsg,
+					Id:      job.Id,
+				}
+			}
 			if queue.waiting.Len() == 0 {
 				return
 			}
@@ -338,7 +876,8 @@ func (queue *Queue) schedule() {
 }
 
 // Handle the connection with another component (front-end or pool).
-// All job ids are prepended by the client id to ensure unique ids.
+// All job ids are prepended by the client id to ensure unique ids, or by the
+// session (preceded by @) if the client has identified.
 func (queue *Queue) handle(conn *pythia.Conn, client *queueClient, response chan pythia.Message) {
 	defer queue.wg.Done()
 	defer conn.Close()
@@ -348,18 +887,34 @@ func (queue *Queue) handle(conn *pythia.Conn, client *queueClient, response chan
 		// the main goroutine.
 		defer queue.wg.Done()
 		defer func() { queue.master <- queueMessage{pythia.Message{Message: closedMsg}, client} }()
+		prefix := strconv.Itoa(client.Id)
+		identified := false
 		for msg := range conn.Receive() {
 			switch msg.Message {
 			case pythia.RegisterPoolMsg:
 				if msg.Capacity < 1 {
 					log.Println("Invalid pool capacity", msg.Capacity)
+				} else if msg.Memory < 0 {
+					log.Println("Invalid pool memory", msg.Memory)
+				} else {
+					queue.master <- queueMessage{msg, client}
+				}
+			case pythia.IdentifyMsg:
+				if identified {
+					log.Println("Ignoring duplicate identification", msg)
+				} else if msg.Session == "" || strings.Contains(msg.Session, ":") {
+					log.Println("Invalid session", msg.Session)
 				} else {
+					prefix = "@" + msg.Session
+					identified = true
 					queue.master <- queueMessage{msg, client}
 				}
-			case pythia.LaunchMsg:
-				msg.Id = fmt.Sprintf("%d:%s", client.Id, msg.Id)
+			case pythia.LaunchMsg, pythia.AbortMsg:
+				msg.Id = prefix + ":" + msg.Id
 				queue.master <- queueMessage{msg, client}
-			case pythia.DoneMsg:
+			case pythia.OutputMsg, pythia.DoneMsg, pythia.StatusMsg,
+				pythia.ListJobsMsg, pythia.JobInfoMsg, pythia.CancelMsg,
+				pythia.DrainMsg, pythia.UndrainMsg:
 				queue.master <- queueMessage{msg, client}
 			default:
 				log.Println("Ignoring message", msg)
@@ -369,11 +924,18 @@ func (queue *Queue) handle(conn *pythia.Conn, client *queueClient, response chan
 	// Handle responses from the main goroutine and send messages to the client.
 	for msg := range response {
 		switch msg.Message {
-		case pythia.LaunchMsg:
+		case pythia.LaunchMsg, pythia.AbortMsg, pythia.StatusMsg,
+			pythia.ListJobsMsg, pythia.JobInfoMsg, pythia.CancelMsg,
+			pythia.DrainMsg, pythia.UndrainMsg:
 			conn.Send(msg)
-		case pythia.DoneMsg:
+		case pythia.StartedMsg, pythia.OutputMsg, pythia.DoneMsg:
 			msg.Id = msg.Id[strings.Index(msg.Id, ":")+1:]
 			conn.Send(msg)
+		case pythia.IdentifyMsg:
+			for i, id := range msg.Jobs {
+				msg.Jobs[i] = id[strings.Index(id, ":")+1:]
+			}
+			conn.Send(msg)
 		default:
 			log.Fatal("Invalid internal message", msg)
 		}
@@ -16,10 +16,13 @@
 package backend
 
 import (
+	"io/ioutil"
+	"os"
 	"pythia"
 	"testing"
 	"testutils"
 	"testutils/pytest"
+	"time"
 )
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -38,11 +41,19 @@ type QueueFixture struct {
 // The queue capacity is configured with capacity.
 // A number of clients will be connected to the queue.
 func SetupQueueFixture(t *testing.T, capacity int, clients int) *QueueFixture {
+	queue := NewQueue()
+	queue.Capacity = capacity
+	return SetupQueueFixtureWith(t, queue, clients)
+}
+
+// SetupQueueFixtureWith behaves like SetupQueueFixture, but runs the given
+// queue, which may have been configured by the caller.
+func SetupQueueFixtureWith(t *testing.T, queue *Queue, clients int) *QueueFixture {
 	var err error
 	f := new(QueueFixture)
 	// Setup queue
 	t.Log("Setup queue")
-	f.Queue = NewQueue()
+	f.Queue = queue
 	addr, err := pythia.LocalAddr()
 	if err != nil {
 		t.Fatal(err)
@@ -114,4 +125,750 @@ func TestQueueSimple(t *testing.T) {
 	f.TearDown()
 }
 
+func TestQueueAbortWaiting(t *testing.T) {
+	f := SetupQueueFixture(t, 500, 1)
+	frontend := f.Clients[0]
+	task := pytest.ReadTask(t, "hello-world")
+	frontend.Send(pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      "test",
+		Task:    &task,
+	})
+	frontend.Send(pythia.Message{
+		Message: pythia.AbortMsg,
+		Id:      "test",
+	})
+	frontend.Expect(1, pythia.Message{
+		Message: pythia.DoneMsg,
+		Id:      "test",
+		Status:  pythia.Abort,
+	})
+	f.TearDown()
+}
+
+func TestQueueAbortRunning(t *testing.T) {
+	f := SetupQueueFixture(t, 500, 2)
+	frontend, pool := f.Clients[0], f.Clients[1]
+	pool.Send(pythia.Message{
+		Message:  pythia.RegisterPoolMsg,
+		Capacity: 1,
+	})
+	task := pytest.ReadTask(t, "hello-world")
+	frontend.Send(pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      "test",
+		Task:    &task,
+	})
+	pool.Expect(1, pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      "0:test",
+		Task:    &task,
+	})
+	frontend.Send(pythia.Message{
+		Message: pythia.AbortMsg,
+		Id:      "test",
+	})
+	pool.Expect(1, pythia.Message{
+		Message: pythia.AbortMsg,
+		Id:      "0:test",
+	})
+	pool.Send(pythia.Message{
+		Message: pythia.DoneMsg,
+		Id:      "0:test",
+		Status:  pythia.Abort,
+	})
+	frontend.Expect(1, pythia.Message{
+		Message: pythia.DoneMsg,
+		Id:      "test",
+		Status:  pythia.Abort,
+	})
+	f.TearDown()
+}
+
+func TestQueueNotify(t *testing.T) {
+	f := SetupQueueFixture(t, 500, 2)
+	frontend, pool := f.Clients[0], f.Clients[1]
+	pool.Send(pythia.Message{
+		Message:  pythia.RegisterPoolMsg,
+		Capacity: 1,
+	})
+	task := pytest.ReadTask(t, "hello-world")
+	frontend.Send(pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      "test",
+		Task:    &task,
+		Notify:  true,
+	})
+	pool.Expect(1, pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      "0:test",
+		Task:    &task,
+		Notify:  true,
+	})
+	frontend.Expect(1, pythia.Message{
+		Message: pythia.StartedMsg,
+		Id:      "test",
+	})
+	f.TearDown()
+}
+
+func TestQueueStream(t *testing.T) {
+	f := SetupQueueFixture(t, 500, 2)
+	frontend, pool := f.Clients[0], f.Clients[1]
+	pool.Send(pythia.Message{
+		Message:  pythia.RegisterPoolMsg,
+		Capacity: 1,
+	})
+	task := pytest.ReadTask(t, "hello-world")
+	frontend.Send(pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      "test",
+		Task:    &task,
+		Stream:  true,
+	})
+	pool.Expect(1, pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      "0:test",
+		Task:    &task,
+		Stream:  true,
+	})
+	pool.Send(pythia.Message{
+		Message: pythia.OutputMsg,
+		Id:      "0:test",
+		Output:  "Hello ",
+	})
+	// Streamed jobs are always notified.
+	frontend.Expect(1, pythia.Message{
+		Message: pythia.StartedMsg,
+		Id:      "test",
+	}, pythia.Message{
+		Message: pythia.OutputMsg,
+		Id:      "test",
+		Output:  "Hello ",
+	})
+	// Output of unknown jobs is ignored.
+	pool.Send(pythia.Message{
+		Message: pythia.OutputMsg,
+		Id:      "0:unknown",
+		Output:  "ignored",
+	})
+	pool.Send(pythia.Message{
+		Message: pythia.DoneMsg,
+		Id:      "0:test",
+		Status:  pythia.Success,
+		Output:  "Hello world!\n",
+	})
+	frontend.Expect(1, pythia.Message{
+		Message: pythia.DoneMsg,
+		Id:      "test",
+		Status:  pythia.Success,
+		Output:  "Hello world!\n",
+	})
+	f.TearDown()
+}
+
+func TestQueuePriority(t *testing.T) {
+	f := SetupQueueFixture(t, 500, 1)
+	// The client acts as both front-end and pool, so that messages are
+	// processed in order.
+	client := f.Clients[0]
+	task := pytest.ReadTask(t, "hello-world")
+	for _, id := range []string{"low", "high"} {
+		priority := 0
+		if id == "high" {
+			priority = 10
+		}
+		client.Send(pythia.Message{
+			Message:  pythia.LaunchMsg,
+			Id:       id,
+			Task:     &task,
+			Priority: priority,
+		})
+	}
+	client.Send(pythia.Message{
+		Message:  pythia.RegisterPoolMsg,
+		Capacity: 1,
+	})
+	client.Expect(1, pythia.Message{
+		Message:  pythia.LaunchMsg,
+		Id:       "0:high",
+		Task:     &task,
+		Priority: 10,
+	})
+	client.Send(pythia.Message{
+		Message: pythia.DoneMsg,
+		Id:      "0:high",
+		Status:  pythia.Success,
+	})
+	client.Expect(1, pythia.Message{
+		Message: pythia.DoneMsg,
+		Id:      "high",
+		Status:  pythia.Success,
+	}, pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      "0:low",
+		Task:    &task,
+	})
+	f.TearDown()
+}
+
+func TestQueueClientCapacity(t *testing.T) {
+	queue := NewQueue()
+	queue.ClientCapacity = 1
+	f := SetupQueueFixtureWith(t, queue, 1)
+	frontend := f.Clients[0]
+	task := pytest.ReadTask(t, "hello-world")
+	for _, id := range []string{"1", "2"} {
+		frontend.Send(pythia.Message{
+			Message: pythia.LaunchMsg,
+			Id:      id,
+			Task:    &task,
+		})
+	}
+	frontend.Expect(1, pythia.Message{
+		Message: pythia.DoneMsg,
+		Id:      "2",
+		Status:  pythia.Error,
+		Output:  "Client quota exceeded",
+	})
+	f.TearDown()
+}
+
+func TestQueueEnvironments(t *testing.T) {
+	f := SetupQueueFixture(t, 500, 3)
+	frontend, pool1, pool2 := f.Clients[0], f.Clients[1], f.Clients[2]
+	pool1.Send(pythia.Message{
+		Message:      pythia.RegisterPoolMsg,
+		Capacity:     1,
+		Environments: []string{"python"},
+	})
+	pool2.Send(pythia.Message{
+		Message:      pythia.RegisterPoolMsg,
+		Capacity:     1,
+		Environments: []string{"busybox"},
+	})
+	// Wait for both pools to be registered.
+	time.Sleep(50 * time.Millisecond)
+	task := pytest.ReadTask(t, "hello-world")
+	frontend.Send(pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      "busybox",
+		Task:    &task,
+	})
+	pool2.Expect(1, pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      "0:busybox",
+		Task:    &task,
+	})
+	java := task
+	java.Environment = "java"
+	frontend.Send(pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      "java",
+		Task:    &java,
+	})
+	frontend.Expect(1, pythia.Message{
+		Message: pythia.DoneMsg,
+		Id:      "java",
+		Status:  pythia.Fatal,
+		Output:  "No pool supports this task",
+	})
+	f.TearDown()
+}
+
+func TestQueueMemory(t *testing.T) {
+	f := SetupQueueFixture(t, 500, 1)
+	client := f.Clients[0]
+	task := pytest.ReadTask(t, "hello-world")
+	big, small := task, task
+	big.Limits.Memory = 600
+	small.Limits.Memory = 300
+	for _, job := range []struct {
+		id   string
+		task *pythia.Task
+	}{{"small1", &small}, {"big", &big}, {"small2", &small}} {
+		client.Send(pythia.Message{
+			Message: pythia.LaunchMsg,
+			Id:      job.id,
+			Task:    job.task,
+		})
+	}
+	client.Send(pythia.Message{
+		Message:  pythia.RegisterPoolMsg,
+		Capacity: 3,
+		Memory:   800,
+	})
+	// The big job does not fit next to small1, and small2 shall not overtake
+	// it.
+	client.Expect(1, pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      "0:small1",
+		Task:    &small,
+	})
+	client.Send(pythia.Message{
+		Message: pythia.DoneMsg,
+		Id:      "0:small1",
+		Status:  pythia.Success,
+	})
+	client.Expect(1, pythia.Message{
+		Message: pythia.DoneMsg,
+		Id:      "small1",
+		Status:  pythia.Success,
+	}, pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      "0:big",
+		Task:    &big,
+	})
+	// A job requiring more memory than the pool has can never run.
+	huge := task
+	huge.Limits.Memory = 1000
+	client.Send(pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      "huge",
+		Task:    &huge,
+	})
+	client.Expect(1, pythia.Message{
+		Message: pythia.DoneMsg,
+		Id:      "huge",
+		Status:  pythia.Fatal,
+		Output:  "No pool supports this task",
+	})
+	f.TearDown()
+}
+
+func TestQueueIdentify(t *testing.T) {
+	f := SetupQueueFixture(t, 500, 3)
+	old, pool, resumed := f.Clients[0], f.Clients[1], f.Clients[2]
+	old.Send(pythia.Message{Message: pythia.IdentifyMsg, Session: "s"})
+	old.Expect(1, pythia.Message{Message: pythia.IdentifyMsg, Session: "s"})
+	task := pytest.ReadTask(t, "hello-world")
+	old.Send(pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      "test",
+		Task:    &task,
+	})
+	pool.Send(pythia.Message{
+		Message:  pythia.RegisterPoolMsg,
+		Capacity: 1,
+	})
+	pool.Expect(1, pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      "@s:test",
+		Task:    &task,
+	})
+	// The last client identified with the session receives the result.
+	resumed.Send(pythia.Message{Message: pythia.IdentifyMsg, Session: "s"})
+	resumed.Expect(1, pythia.Message{
+		Message: pythia.IdentifyMsg,
+		Session: "s",
+		Jobs:    []string{"test"},
+	})
+	pool.Send(pythia.Message{
+		Message: pythia.DoneMsg,
+		Id:      "@s:test",
+		Status:  pythia.Success,
+	})
+	resumed.Expect(1, pythia.Message{
+		Message: pythia.DoneMsg,
+		Id:      "test",
+		Status:  pythia.Success,
+	})
+	f.TearDown()
+}
+
+func TestQueueRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pythia-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Simulate a queue that crashed with a job waiting and a job done.
+	task := pytest.ReadTask(t, "hello-world")
+	j, _, err := openJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waiting := &queueJob{
+		Id:      "@s:waiting",
+		Msg:     pythia.Message{Message: pythia.LaunchMsg, Id: "@s:waiting", Task: &task},
+		Session: "s",
+		Queued:  time.Now(),
+	}
+	done := &queueJob{
+		Id:      "@s:done",
+		Msg:     pythia.Message{Message: pythia.LaunchMsg, Id: "@s:done", Task: &task},
+		Session: "s",
+		Queued:  time.Now(),
+		Result: &pythia.Message{
+			Message: pythia.DoneMsg,
+			Id:      "@s:done",
+			Status:  pythia.Success,
+			Output:  "Hi",
+		},
+	}
+	j.Launch(waiting)
+	j.Launch(done)
+	j.Dispatch(done)
+	j.Done(done)
+	j.Close()
+	// Restart the queue.
+	queue := NewQueue()
+	queue.JournalDir = dir
+	f := SetupQueueFixtureWith(t, queue, 2)
+	frontend, pool := f.Clients[0], f.Clients[1]
+	pool.Send(pythia.Message{
+		Message:  pythia.RegisterPoolMsg,
+		Capacity: 1,
+	})
+	pool.Expect(1, pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      "@s:waiting",
+		Task:    &task,
+	})
+	frontend.Send(pythia.Message{Message: pythia.IdentifyMsg, Session: "s"})
+	frontend.Expect(1, pythia.Message{
+		Message: pythia.DoneMsg,
+		Id:      "done",
+		Status:  pythia.Success,
+		Output:  "Hi",
+	}, pythia.Message{
+		Message: pythia.IdentifyMsg,
+		Session: "s",
+		Jobs:    []string{"waiting"},
+	})
+	pool.Send(pythia.Message{
+		Message: pythia.DoneMsg,
+		Id:      "@s:waiting",
+		Status:  pythia.Success,
+	})
+	frontend.Expect(1, pythia.Message{
+		Message: pythia.DoneMsg,
+		Id:      "waiting",
+		Status:  pythia.Success,
+	})
+	f.TearDown()
+}
+
+func TestQueueResume(t *testing.T) {
+	f := SetupQueueFixture(t, 500, 2)
+	frontend, pool := f.Clients[0], f.Clients[1]
+	frontend.Send(pythia.Message{Message: pythia.IdentifyMsg, Session: "s"})
+	frontend.Expect(1, pythia.Message{Message: pythia.IdentifyMsg, Session: "s"})
+	task := pytest.ReadTask(t, "hello-world")
+	frontend.Send(pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      "test",
+		Task:    &task,
+	})
+	pool.Send(pythia.Message{
+		Message:  pythia.RegisterPoolMsg,
+		Capacity: 1,
+	})
+	pool.Expect(1, pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      "@s:test",
+		Task:    &task,
+	})
+	frontend.Close()
+	// Wait for the disconnection to be noticed.
+	time.Sleep(50 * time.Millisecond)
+	pool.Send(pythia.Message{
+		Message: pythia.DoneMsg,
+		Id:      "@s:test",
+		Status:  pythia.Success,
+	})
+	// Wait for the result to be kept for the session.
+	time.Sleep(50 * time.Millisecond)
+	frontend = pytest.DialRetry(t, pythia.QueueAddr)
+	f.Clients[0] = frontend
+	frontend.Send(pythia.Message{Message: pythia.IdentifyMsg, Session: "s"})
+	frontend.Expect(1, pythia.Message{
+		Message: pythia.DoneMsg,
+		Id:      "test",
+		Status:  pythia.Success,
+	}, pythia.Message{Message: pythia.IdentifyMsg, Session: "s"})
+	f.TearDown()
+}
+
+func TestQueueGrace(t *testing.T) {
+	queue := NewQueue()
+	queue.Grace = 100 * time.Millisecond
+	f := SetupQueueFixtureWith(t, queue, 2)
+	frontend, pool := f.Clients[0], f.Clients[1]
+	frontend.Send(pythia.Message{Message: pythia.IdentifyMsg, Session: "s"})
+	frontend.Expect(1, pythia.Message{Message: pythia.IdentifyMsg, Session: "s"})
+	task := pytest.ReadTask(t, "hello-world")
+	frontend.Send(pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      "test",
+		Task:    &task,
+	})
+	pool.Send(pythia.Message{
+		Message:  pythia.RegisterPoolMsg,
+		Capacity: 1,
+	})
+	pool.Expect(1, pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      "@s:test",
+		Task:    &task,
+	})
+	frontend.Close()
+	f.Clients[0] = nil
+	// The session is not resumed: the job is aborted after the grace period.
+	pool.Expect(1, pythia.Message{
+		Message: pythia.AbortMsg,
+		Id:      "@s:test",
+	})
+	f.TearDown()
+}
+
+func TestQueuePoolResume(t *testing.T) {
+	f := SetupQueueFixture(t, 500, 2)
+	frontend, pool := f.Clients[0], f.Clients[1]
+	pool.Send(pythia.Message{Message: pythia.IdentifyMsg, Session: "p"})
+	pool.Expect(1, pythia.Message{Message: pythia.IdentifyMsg, Session: "p"})
+	pool.Send(pythia.Message{
+		Message:  pythia.RegisterPoolMsg,
+		Capacity: 2,
+	})
+	task := pytest.ReadTask(t, "hello-world")
+	for _, id := range []string{"a", "b"} {
+		frontend.Send(pythia.Message{
+			Message: pythia.LaunchMsg,
+			Id:      id,
+			Task:    &task,
+		})
+	}
+	pool.Expect(1, pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      "0:a",
+		Task:    &task,
+	}, pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      "0:b",
+		Task:    &task,
+	})
+	pool.Close()
+	// The pool reconnects, reports that job a finished while it was
+	// disconnected, and that job b has been lost.
+	pool = pytest.DialRetry(t, pythia.QueueAddr)
+	f.Clients[1] = pool
+	pool.Send(pythia.Message{Message: pythia.IdentifyMsg, Session: "p"})
+	pool.Send(pythia.Message{
+		Message: pythia.DoneMsg,
+		Id:      "0:a",
+		Status:  pythia.Success,
+	})
+	pool.Send(pythia.Message{
+		Message:  pythia.RegisterPoolMsg,
+		Capacity: 2,
+	})
+	frontend.Expect(1, pythia.Message{
+		Message: pythia.DoneMsg,
+		Id:      "a",
+		Status:  pythia.Success,
+	})
+	pool.Expect(1, pythia.Message{
+		Message: pythia.IdentifyMsg,
+		Session: "p",
+	}, pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      "0:b",
+		Task:    &task,
+	})
+	f.TearDown()
+}
+
+func TestQueueIntrospection(t *testing.T) {
+	f := SetupQueueFixture(t, 500, 2)
+	frontend, pool := f.Clients[0], f.Clients[1]
+	task := pytest.ReadTask(t, "hello-world")
+	for _, id := range []string{"a", "b"} {
+		frontend.Send(pythia.Message{
+			Message: pythia.LaunchMsg,
+			Id:      id,
+			Task:    &task,
+		})
+	}
+	pool.Send(pythia.Message{
+		Message:  pythia.RegisterPoolMsg,
+		Capacity: 1,
+		Memory:   100,
+	})
+	pool.Expect(1, pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      "0:a",
+		Task:    &task,
+	})
+	frontend.Send(pythia.Message{Message: pythia.StatusMsg})
+	msg := frontend.Receive(1)
+	testutils.Expect(t, "message", pythia.StatusMsg, msg.Message)
+	if msg.Queue == nil {
+		t.Fatal("Missing queue information", msg)
+	}
+	testutils.Expect(t, "waiting", 1, msg.Queue.Waiting)
+	testutils.Expect(t, "running", 1, msg.Queue.Running)
+	testutils.Expect(t, "clients", []pythia.ClientInfo{{
+		Id:        0,
+		Connected: true,
+		Waiting:   1,
+		InFlight:  1,
+	}, {
+		Id:         1,
+		Connected:  true,
+		Capacity:   1,
+		Memory:     100,
+		MemoryUsed: task.Limits.Memory,
+		Running:    []string{"0:a"},
+	}}, msg.Queue.Clients)
+	frontend.Send(pythia.Message{Message: pythia.ListJobsMsg})
+	msg = frontend.Receive(1)
+	testutils.Expect(t, "message", pythia.ListJobsMsg, msg.Message)
+	if len(msg.JobList) != 2 {
+		t.Fatal("Invalid job list", msg)
+	}
+	a, b := msg.JobList[0], msg.JobList[1]
+	testutils.Expect(t, "id", "0:a", a.Id)
+	testutils.Expect(t, "state", "running", a.State)
+	testutils.Expect(t, "pool", 1, a.Pool)
+	testutils.Expect(t, "client", 0, a.Client)
+	if a.Queued == nil || a.Started == nil {
+		t.Error("Missing timing information", a)
+	}
+	testutils.Expect(t, "id", "0:b", b.Id)
+	testutils.Expect(t, "state", "waiting", b.State)
+	testutils.Expect(t, "pool", -1, b.Pool)
+	if b.Started != nil {
+		t.Error("Unexpected start time", b)
+	}
+	frontend.Send(pythia.Message{Message: pythia.JobInfoMsg, Id: "0:b"})
+	msg = frontend.Receive(1)
+	testutils.Expect(t, "job", b, *msg.Job)
+	frontend.Send(pythia.Message{Message: pythia.JobInfoMsg, Id: "unknown"})
+	frontend.Expect(1, pythia.Message{Message: pythia.JobInfoMsg, Id: "unknown"})
+	f.TearDown()
+}
+
+func TestQueueWarmHits(t *testing.T) {
+	f := SetupQueueFixture(t, 500, 2)
+	frontend, pool := f.Clients[0], f.Clients[1]
+	pool.Send(pythia.Message{
+		Message:  pythia.RegisterPoolMsg,
+		Capacity: 1,
+	})
+	task := pytest.ReadTask(t, "hello-world")
+	for _, warm := range []bool{false, true, true} {
+		frontend.Send(pythia.Message{
+			Message: pythia.LaunchMsg,
+			Id:      "test",
+			Task:    &task,
+		})
+		pool.Expect(1, pythia.Message{
+			Message: pythia.LaunchMsg,
+			Id:      "0:test",
+			Task:    &task,
+		})
+		usage := &pythia.Usage{Warm: warm}
+		pool.Send(pythia.Message{
+			Message: pythia.DoneMsg,
+			Id:      "0:test",
+			Status:  pythia.Success,
+			Usage:   usage,
+		})
+		frontend.Expect(1, pythia.Message{
+			Message: pythia.DoneMsg,
+			Id:      "test",
+			Status:  pythia.Success,
+			Usage:   usage,
+		})
+	}
+	frontend.Send(pythia.Message{Message: pythia.StatusMsg})
+	msg := frontend.Receive(1)
+	if msg.Queue == nil || len(msg.Queue.Clients) != 2 {
+		t.Fatal("Invalid queue information", msg)
+	}
+	info := msg.Queue.Clients[1]
+	testutils.Expect(t, "executed", 3, info.Executed)
+	testutils.Expect(t, "warm hits", 2, info.WarmHits)
+	f.TearDown()
+}
+
+func TestQueueCancel(t *testing.T) {
+	f := SetupQueueFixture(t, 500, 3)
+	frontend, pool, admin := f.Clients[0], f.Clients[1], f.Clients[2]
+	task := pytest.ReadTask(t, "hello-world")
+	for _, id := range []string{"a", "b"} {
+		frontend.Send(pythia.Message{
+			Message: pythia.LaunchMsg,
+			Id:      id,
+			Task:    &task,
+		})
+	}
+	pool.Send(pythia.Message{
+		Message:  pythia.RegisterPoolMsg,
+		Capacity: 1,
+	})
+	pool.Expect(1, pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      "0:a",
+		Task:    &task,
+	})
+	// Cancel the waiting job, then the running one.
+	admin.Send(pythia.Message{Message: pythia.CancelMsg, Id: "0:b"})
+	admin.Expect(1, pythia.Message{Message: pythia.CancelMsg, Id: "0:b"})
+	frontend.Expect(1, pythia.Message{
+		Message: pythia.DoneMsg,
+		Id:      "b",
+		Status:  pythia.Abort,
+	})
+	admin.Send(pythia.Message{Message: pythia.CancelMsg, Id: "0:a"})
+	admin.Expect(1, pythia.Message{Message: pythia.CancelMsg, Id: "0:a"})
+	pool.Expect(1, pythia.Message{Message: pythia.AbortMsg, Id: "0:a"})
+	admin.Send(pythia.Message{Message: pythia.CancelMsg, Id: "0:b"})
+	admin.Expect(1, pythia.Message{
+		Message: pythia.CancelMsg,
+		Id:      "0:b",
+		Error:   "Unknown job",
+	})
+	f.TearDown()
+}
+
+func TestQueueDrain(t *testing.T) {
+	f := SetupQueueFixture(t, 500, 2)
+	frontend, pool := f.Clients[0], f.Clients[1]
+	pool.Send(pythia.Message{
+		Message:  pythia.RegisterPoolMsg,
+		Capacity: 1,
+	})
+	// Wait for the pool to be registered.
+	time.Sleep(50 * time.Millisecond)
+	frontend.Send(pythia.Message{Message: pythia.DrainMsg, Id: "1"})
+	frontend.Expect(1, pythia.Message{Message: pythia.DrainMsg, Id: "1"})
+	task := pytest.ReadTask(t, "hello-world")
+	frontend.Send(pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      "test",
+		Task:    &task,
+	})
+	frontend.Send(pythia.Message{Message: pythia.JobInfoMsg, Id: "0:test"})
+	msg := frontend.Receive(1)
+	if msg.Job == nil || msg.Job.State != "waiting" {
+		t.Error("Job shall be waiting", msg)
+	}
+	frontend.Send(pythia.Message{Message: pythia.UndrainMsg, Id: "1"})
+	frontend.Expect(1, pythia.Message{Message: pythia.UndrainMsg, Id: "1"})
+	pool.Expect(1, pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      "0:test",
+		Task:    &task,
+	})
+	frontend.Send(pythia.Message{Message: pythia.DrainMsg, Id: "0"})
+	frontend.Expect(1, pythia.Message{
+		Message: pythia.DrainMsg,
+		Id:      "0",
+		Error:   "Unknown pool",
+	})
+	f.TearDown()
+}
+
 // vim:set sw=4 ts=4 noet:
@@ -0,0 +1,135 @@
+// Copyright 2013 The Pythia Authors.
+// This file is part of Pythia.
+//
+// Pythia is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, version 3 of the License.
+//
+// Pythia is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Pythia.  If not, see <http://www.gnu.org/licenses/>.
+
+package backend
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"pythia"
+	"sort"
+	"strings"
+)
+
+// The results directory of a task is exported from the sandbox as a tar
+// archive of its regular files, written on a device of fixed size. The archive
+// is written until the device is full, so that an archive which did not fit is
+// detected when reading it. Subdirectories of the results directory are not
+// exported, so that all the entries of the archive are at its top level.
+
+const (
+	// Size limit of the results archive when the task does not set one
+	defaultResultsLimit = 64 * 1024
+
+	// Name of the file of the results directory containing a JSON document
+	resultsDocument = "result.json"
+
+	// Size of tar blocks
+	tarBlockSize = 512
+)
+
+// ResultsSize returns the size of the device receiving the results archive of
+// task. The limit applies to the entries of the archive, and is rounded up to
+// whole tar blocks. The device has room for the end of the archive in addition.
+func resultsSize(task *pythia.Task) int {
+	limit := task.Limits.Results
+	if limit <= 0 {
+		limit = defaultResultsLimit
+	}
+	return (limit+tarBlockSize-1)/tarBlockSize*tarBlockSize + 2*tarBlockSize
+}
+
+// SortedNames returns the names of files in alphabetical order.
+func sortedNames(files map[string][]byte) []string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ReadResults extracts the files of a results archive written on a device of
+// the given size. It reports an overflow, along with the files which fitted,
+// if the archive did not fit on the device. Entries which are not regular files
+// are ignored, and an entry which is not at the top level of the archive is an
+// error.
+func readResults(archive []byte, size int) (files map[string][]byte, overflow bool, err error) {
+	r := bytes.NewReader(archive)
+	tr := tar.NewReader(r)
+	files = make(map[string][]byte)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, false, nil
+		} else if err == io.ErrUnexpectedEOF {
+			return files, true, nil
+		} else if err != nil {
+			return nil, false, err
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err == io.ErrUnexpectedEOF {
+			return files, true, nil
+		} else if err != nil {
+			return nil, false, err
+		}
+		// The device shall have room for the end of the archive after each
+		// entry.
+		end := len(archive) - r.Len()
+		end = (end + tarBlockSize - 1) / tarBlockSize * tarBlockSize
+		if end+2*tarBlockSize > size {
+			return files, true, nil
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if hdr.Name == "" || hdr.Name == "." || hdr.Name == ".." ||
+			strings.Contains(hdr.Name, "/") {
+			return nil, false, fmt.Errorf("Invalid file name '%s'", hdr.Name)
+		}
+		files[hdr.Name] = data
+	}
+}
+
+// ErrNoSpace is returned by a deviceWriter once full.
+var errNoSpace = errors.New("No space left on device")
+
+// A deviceWriter writes up to Size bytes to W, mimicking a device of that
+// size.
+type deviceWriter struct {
+	W    io.Writer
+	Size int
+}
+
+// Write writes p to the device, failing once it is full.
+func (d *deviceWriter) Write(p []byte) (int, error) {
+	if len(p) > d.Size {
+		n, err := d.W.Write(p[:d.Size])
+		d.Size -= n
+		if err == nil {
+			err = errNoSpace
+		}
+		return n, err
+	}
+	n, err := d.W.Write(p)
+	d.Size -= n
+	return n, err
+}
+
+// vim:set sw=4 ts=4 noet:
@@ -0,0 +1,332 @@
+// Copyright 2013 The Pythia Authors.
+// This file is part of Pythia.
+//
+// Pythia is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, version 3 of the License.
+//
+// Pythia is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Pythia.  If not, see <http://www.gnu.org/licenses/>.
+
+package backend
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"pythia"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A Sandbox is an isolated environment executing a single job.
+//
+// The job limits on time, CPU time and output size are enforced by the Job
+// running the sandbox, which aborts the sandbox when they are exceeded. A
+// sandbox is only responsible for enforcing the other limits, and for isolating
+// the task.
+type Sandbox interface {
+	// Prepare sets the sandbox up to execute task. It is called once, before
+	// Run.
+	Prepare(task *pythia.Task) error
+
+	// Run executes the task with input on its standard input and files in
+	// its input directory (see inputDir), writes its output to stdout and its
+	// standard error to stderr, and waits for its termination. If stderr is
+	// nil, the standard error is written to stdout. Run returns an error only
+	// if the sandbox itself failed; the outcome of the task is given by
+	// Result.
+	Run(input string, files map[string][]byte, stdout, stderr io.Writer) error
+
+	// Abort kills the task. It may be called from any goroutine, any number of
+	// times, before, during or after Run. If called before Run, Run shall
+	// return without executing the task.
+	Abort()
+
+	// CpuTime returns the CPU time consumed so far by the sandbox. It may be
+	// called from any goroutine while Run is executing the task, to enforce
+	// the CPU time limit of the task.
+	CpuTime() time.Duration
+
+	// Result returns the outcome of the task. It is only meaningful after Run
+	// returned without error.
+	Result() SandboxResult
+}
+
+// A WarmSandbox is a sandbox which can be started ahead of time, before its
+// task is known, to reduce the latency of jobs (see Pool.Warm).
+type WarmSandbox interface {
+	Sandbox
+
+	// Start starts the sandbox for the tasks of an environment with the given
+	// memory limit, and returns once the sandbox is ready to execute a task.
+	// Prepare shall then only be given such a task. A started sandbox which
+	// is not used shall be released with Abort.
+	Start(environment string, memory int) error
+}
+
+// A SandboxResult is the outcome of a task executed in a sandbox.
+type SandboxResult struct {
+	// Whether the task terminated successfully, as opposed to crashing or
+	// being killed
+	Success bool
+
+	// CPU time (user and system) consumed by the sandbox
+	CpuTime time.Duration
+
+	// Peak resident memory of the sandbox, in kilobytes
+	MaxRss int64
+
+	// Content of the device on which the archive of the results directory
+	// has been written, if the task declares one (see readResults)
+	Results []byte
+
+	// Steps of the control file which did not succeed, and whether the last
+	// of them ended the execution (see parseSteps)
+	Steps   []pythia.StepResult
+	Stopped bool
+}
+
+// ProcessResult returns the result of a sandbox running as the process whose
+// state is given.
+func processResult(state *os.ProcessState) SandboxResult {
+	result := SandboxResult{
+		Success: state.Success(),
+		CpuTime: state.UserTime() + state.SystemTime(),
+	}
+	if rusage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		result.MaxRss = int64(rusage.Maxrss)
+	}
+	return result
+}
+
+// Limit on the number of processes of each user of the sandbox, when the task
+// does not set one
+const defaultProcesses = 100
+
+// ProcessParams returns the parameters giving the limits of task on its
+// processes to the init process of the sandbox, as name=value strings. The
+// number of processes is always given, the other limits only if the task sets
+// them.
+func processParams(task *pythia.Task) []string {
+	processes := task.Limits.Processes
+	if processes <= 0 {
+		processes = defaultProcesses
+	}
+	params := []string{fmt.Sprintf("processes=%d", processes)}
+	for _, limit := range []struct {
+		name  string
+		value int
+	}{
+		{"openfiles", task.Limits.OpenFiles},
+		{"filesize", task.Limits.FileSize},
+		{"stack", task.Limits.Stack},
+	} {
+		if limit.value > 0 {
+			params = append(params, fmt.Sprintf("%s=%d", limit.name, limit.value))
+		}
+	}
+	return params
+}
+
+// Number of clock ticks per second in /proc/[pid]/stat. This is USER_HZ, as
+// returned by sysconf(_SC_CLK_TCK), which is not available without cgo. Linux
+// fixes it to 100 on the architectures it supports, whatever the frequency of
+// the kernel timer.
+const clockTicks = 100
+
+// TreeCpuTime returns the CPU time consumed by the process pid and its
+// descendants, including their terminated children, as read from /proc. Only
+// the processes of the tree are visited, through the children files of their
+// threads.
+func treeCpuTime(pid int) time.Duration {
+	var ticks uint64
+	pids := []string{strconv.Itoa(pid)}
+	for len(pids) > 0 {
+		dir := path.Join("/proc", pids[len(pids)-1])
+		pids = pids[:len(pids)-1]
+		stat, err := ioutil.ReadFile(path.Join(dir, "stat"))
+		if err != nil {
+			// The process has terminated.
+			continue
+		}
+		// The fields following the command name, which is enclosed in
+		// parentheses, start with the state and the parent process id.
+		fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+		if len(fields) < 15 {
+			continue
+		}
+		// Fields utime, stime, cutime and cstime
+		for _, field := range fields[11:15] {
+			n, _ := strconv.ParseUint(field, 10, 64)
+			ticks += n
+		}
+		tasks, _ := filepath.Glob(path.Join(dir, "task", "*", "children"))
+		for _, task := range tasks {
+			children, err := ioutil.ReadFile(task)
+			if err == nil {
+				pids = append(pids, strings.Fields(string(children))...)
+			}
+		}
+	}
+	return time.Duration(ticks) * time.Second / clockTicks
+}
+
+// A processOutput copies the output streams of a sandbox process to writers,
+// through pipes created by the sandbox. Reading from our own pipes ensures that
+// the copy only stops when every process holding them has exited.
+type processOutput struct {
+	// Read and write ends of the pipes
+	readers, writers []*os.File
+
+	// Destination of each pipe
+	dests []io.Writer
+
+	// Receives the result of each copy
+	done chan error
+}
+
+// Pipe creates a pipe whose content will be copied to w, and returns its write
+// end, to be given to the process.
+func (out *processOutput) pipe(w io.Writer) (*os.File, error) {
+	r, wf, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	out.readers = append(out.readers, r)
+	out.writers = append(out.writers, wf)
+	out.dests = append(out.dests, w)
+	return wf, nil
+}
+
+// Start closes our copies of the write ends and starts copying. It shall be
+// called once the process has been started, or has failed to start.
+func (out *processOutput) start() {
+	out.done = make(chan error, len(out.readers))
+	for i, r := range out.readers {
+		out.writers[i].Close()
+		go func(r *os.File, w io.Writer) {
+			_, err := io.Copy(w, r)
+			out.done <- err
+		}(r, out.dests[i])
+	}
+	out.writers = nil
+}
+
+// Wait waits for the copies to finish and returns the first error.
+func (out *processOutput) wait() (err error) {
+	for range out.readers {
+		if cerr := <-out.done; err == nil {
+			err = cerr
+		}
+	}
+	return
+}
+
+// Close closes the pipes. The copies shall be finished.
+func (out *processOutput) close() {
+	for _, f := range out.writers {
+		f.Close()
+	}
+	for _, f := range out.readers {
+		f.Close()
+	}
+}
+
+// A SandboxInfo describes a sandbox implementation.
+type SandboxInfo struct {
+	// Name of the implementation, used to select it
+	Name string
+
+	// Short description
+	Description string
+
+	// Function creating a new sandbox with the given configuration
+	New func(config *SandboxConfig) Sandbox
+}
+
+// Sandboxes contains the available sandbox implementations, mapped by name.
+var Sandboxes = make(map[string]SandboxInfo)
+
+// DefaultSandbox is the name of the sandbox implementation used by default.
+const DefaultSandbox = "uml"
+
+// A SandboxConfig holds the parameters used to create sandboxes. It is shared
+// by the components executing jobs.
+type SandboxConfig struct {
+	// Name of the sandbox implementation
+	Sandbox string
+
+	// Path to the UML executable
+	UmlPath string
+
+	// Path to the directory containing the environments
+	EnvDir string
+
+	// Path to the directory containing the tasks
+	TasksDir string
+
+	// Path to the cgroup (v2) under which the ns sandboxes are created
+	CgroupDir string
+
+	// First host user id to which the users of the ns sandboxes are mapped.
+	// Each running sandbox uses its own range of ids from there.
+	UidBase int
+}
+
+// SetDefaults fills config with the default parameters.
+func (config *SandboxConfig) setDefaults() {
+	config.Sandbox = DefaultSandbox
+	config.UmlPath = "vm/uml"
+	config.EnvDir = "vm"
+	config.TasksDir = "tasks"
+	config.CgroupDir = "/sys/fs/cgroup/pythia"
+	config.UidBase = 100000
+}
+
+// SetupFlags defines the command line flags configuring the sandboxes in fs.
+func (config *SandboxConfig) setupFlags(fs *flag.FlagSet) {
+	var names []string
+	for name := range Sandboxes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fs.StringVar(&config.Sandbox, "sandbox", config.Sandbox,
+		fmt.Sprintf("sandbox implementation (%s)", strings.Join(names, ", ")))
+	fs.StringVar(&config.UmlPath, "uml", config.UmlPath, "path to the UML executable")
+	fs.StringVar(&config.EnvDir, "envdir", config.EnvDir, "environments directory")
+	fs.StringVar(&config.TasksDir, "tasksdir", config.TasksDir, "tasks directory")
+	fs.StringVar(&config.CgroupDir, "cgroup", config.CgroupDir,
+		"cgroup under which the ns sandboxes are created")
+	fs.IntVar(&config.UidBase, "uidbase", config.UidBase,
+		"first host user id used by the ns sandboxes")
+}
+
+// Check returns an error if the sandbox implementation is unknown.
+func (config *SandboxConfig) check() error {
+	if _, ok := Sandboxes[config.Sandbox]; !ok {
+		return fmt.Errorf("Unknown sandbox '%s'", config.Sandbox)
+	}
+	return nil
+}
+
+// NewSandbox creates a new sandbox. The sandbox implementation shall have been
+// checked beforehand.
+func (config *SandboxConfig) newSandbox() Sandbox {
+	return Sandboxes[config.Sandbox].New(config)
+}
+
+// vim:set sw=4 ts=4 noet:
@@ -0,0 +1,74 @@
+// Copyright 2013 The Pythia Authors.
+// This file is part of Pythia.
+//
+// Pythia is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, version 3 of the License.
+//
+// Pythia is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Pythia.  If not, see <http://www.gnu.org/licenses/>.
+
+package backend
+
+import (
+	"fmt"
+	"pythia"
+	"strconv"
+	"strings"
+)
+
+// The init process of the sandbox reports the steps of the control file which
+// did not succeed (see pythia.Task) on a dedicated channel, one line per step:
+//
+//	LINE STATUS LIMIT ACTION [NAME]
+//
+// where LIMIT is "-" if no limit has been exceeded, and ACTION is "stop" if
+// the step ended the execution, or "continue" otherwise.
+
+// FormatStep returns the report line of step.
+func formatStep(step pythia.StepResult, stop bool) string {
+	limit, action := string(step.Limit), "continue"
+	if limit == "" {
+		limit = "-"
+	}
+	if stop {
+		action = "stop"
+	}
+	return strings.TrimSpace(fmt.Sprintf("%d %s %s %s %s", step.Line,
+		step.Status, limit, action, step.Name)) + "\n"
+}
+
+// ParseSteps returns the steps reported by the init process, and whether the
+// last of them ended the execution. Invalid lines are ignored.
+func parseSteps(report []byte) (steps []pythia.StepResult, stopped bool) {
+	for _, line := range strings.Split(string(report), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || len(fields) > 5 {
+			continue
+		}
+		n, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		step := pythia.StepResult{
+			Line:   n,
+			Status: pythia.Status(fields[1]),
+		}
+		if fields[2] != "-" {
+			step.Limit = pythia.Limit(fields[2])
+		}
+		if len(fields) == 5 {
+			step.Name = fields[4]
+		}
+		steps = append(steps, step)
+		stopped = fields[3] == "stop"
+	}
+	return
+}
+
+// vim:set sw=4 ts=4 noet:
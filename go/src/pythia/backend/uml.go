@@ -0,0 +1,585 @@
+// Copyright 2013 The Pythia Authors.
+// This file is part of Pythia.
+//
+// Pythia is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, version 3 of the License.
+//
+// Pythia is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Pythia.  If not, see <http://www.gnu.org/licenses/>.
+
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"pythia"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+func init() {
+	Sandboxes["uml"] = SandboxInfo{
+		Name:        "uml",
+		Description: "User-mode Linux virtual machine",
+		New: func(config *SandboxConfig) Sandbox {
+			return &umlSandbox{config: *config}
+		},
+	}
+}
+
+// An umlSandbox executes a task in a User-mode Linux virtual machine. The
+// environment, the task and the input are given to the VM as read-only block
+// devices, and the output is read from the VM console. The input files and
+// the results are archived on other block devices.
+//
+// The VM may also be booted ahead of time by Start, in which case the devices
+// of the job are attached at boot and filled by Run (see umlWarm).
+type umlSandbox struct {
+	config SandboxConfig
+	task   *pythia.Task
+
+	// Process id of the VM, or 0 if it is not running
+	pid int
+
+	// Whether Abort has been called
+	aborted bool
+
+	// Largest CPU time consumed by the UML processes, as sampled while the VM
+	// was running (see sampleCpuTime)
+	cpuTime time.Duration
+
+	// Mutex protecting pid, aborted, cpuTime and the state of warm
+	mutex sync.Mutex
+
+	result SandboxResult
+
+	// VM booted ahead of time by Start, or nil
+	warm *umlWarm
+}
+
+// Prepare stores the task to execute. If the VM has been started, the task
+// shall match its environment and memory limit.
+func (sb *umlSandbox) Prepare(task *pythia.Task) error {
+	if sb.warm != nil && (task.Environment != sb.warm.environment ||
+		task.Limits.Memory != sb.warm.memory) {
+		return errors.New("Virtual machine started for another environment")
+	}
+	sb.task = task
+	return nil
+}
+
+// Run boots the VM and waits for it to halt. The output is read from the
+// first console of the VM, the standard error from the second one if stderr is
+// given, and the steps reported by the init process from the fourth one.
+func (sb *umlSandbox) Run(input string, files map[string][]byte, stdout, stderr io.Writer) error {
+	if sb.warm != nil {
+		return sb.runWarm(input, files, stdout, stderr)
+	}
+	// Write input to a temporary file. This is needed because UML has trouble
+	// reading on the standard input. Hence, we feed the input as a block
+	// device.
+	inputfile, err := ioutil.TempFile("", "pythia-input-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(inputfile.Name())
+	defer inputfile.Close()
+	if _, err := io.WriteString(inputfile, input); err != nil {
+		return err
+	}
+	inputfile.Close()
+	// Create and configure command.
+	cmd := exec.Command(sb.config.UmlPath,
+		fmt.Sprintf("ubd0r=%s.sfs", path.Join(sb.config.EnvDir, sb.task.Environment)),
+		fmt.Sprintf("ubd1r=%s", path.Join(sb.config.TasksDir, sb.task.TaskFS)),
+		fmt.Sprintf("ubd2r=%s", inputfile.Name()),
+		"con0=null,fd:1",
+		"init=/init",
+		"ro",
+		"quiet",
+		fmt.Sprintf("mem=%dm", sb.task.Limits.Memory),
+		fmt.Sprintf("disksize=%d%%", sb.task.Limits.Disk))
+	cmd.Args = append(cmd.Args, processParams(sb.task)...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	cmd.Stdin = nil
+	// The results directory is archived by the init process on a writable
+	// block device of the size allowed for the archive.
+	var resultsfile *os.File
+	if sb.task.Results != "" {
+		resultsfile, err = ioutil.TempFile("", "pythia-results-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(resultsfile.Name())
+		defer resultsfile.Close()
+		if err := resultsfile.Truncate(int64(resultsSize(sb.task))); err != nil {
+			return err
+		}
+		cmd.Args = append(cmd.Args,
+			fmt.Sprintf("ubd3=%s", resultsfile.Name()),
+			fmt.Sprintf("results=%s", sb.task.Results))
+	}
+	// The input files are archived on another read-only block device, and
+	// extracted by the init process.
+	if len(files) > 0 {
+		filesfile, err := ioutil.TempFile("", "pythia-files-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(filesfile.Name())
+		defer filesfile.Close()
+		if err := writeInputs(filesfile, files); err != nil {
+			return err
+		}
+		cmd.Args = append(cmd.Args,
+			fmt.Sprintf("ubd4r=%s", filesfile.Name()),
+			"inputfiles=1")
+	}
+	// The output is read through our own pipes, such that reading does not
+	// stop when the main UML process exits, but when the whole process group
+	// has been killed.
+	var out processOutput
+	defer out.close()
+	w, err := out.pipe(stdout)
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = w
+	cmd.Stderr = w
+	if stderr != nil {
+		// The second console is given as file descriptor 3, and the init
+		// process is told to send the standard error there.
+		w, err := out.pipe(stderr)
+		if err != nil {
+			return err
+		}
+		cmd.ExtraFiles = []*os.File{w}
+		cmd.Args = append(cmd.Args, "con1=null,fd:3", "stderr=1")
+	}
+	// The steps are reported by the init process on the fourth console.
+	var steps bytes.Buffer
+	if w, err = out.pipe(&steps); err != nil {
+		return err
+	}
+	cmd.ExtraFiles = append(cmd.ExtraFiles, w)
+	cmd.Args = append(cmd.Args, fmt.Sprintf("con3=null,fd:%d", 2+len(cmd.ExtraFiles)))
+	// Run the VM
+	sb.mutex.Lock()
+	if sb.aborted {
+		sb.mutex.Unlock()
+		return nil
+	}
+	err = cmd.Start()
+	out.start()
+	if err != nil {
+		sb.mutex.Unlock()
+		out.wait()
+		return err
+	}
+	sb.pid = cmd.Process.Pid
+	sb.mutex.Unlock()
+	if err = cmd.Wait(); err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			// Ignore this error, cmd.ProcessState will be read below.
+			err = nil
+		}
+	}
+	// Send the KILL signal to the whole UML process group. Do this even when
+	// the job is already done to ensure no zombie processes are left.
+	sb.mutex.Lock()
+	syscall.Kill(-sb.pid, syscall.SIGKILL)
+	sb.pid = 0
+	sb.mutex.Unlock()
+	if cerr := out.wait(); err == nil {
+		err = cerr
+	}
+	if cmd.ProcessState != nil {
+		sb.setResult(cmd.ProcessState, steps.Bytes())
+	}
+	if err == nil && resultsfile != nil {
+		sb.result.Results, err = ioutil.ReadAll(resultsfile)
+	}
+	return err
+}
+
+// Size of the sparse files backing the devices of a VM booted ahead of time.
+// As the size of a device is fixed at boot, it bounds the size of the task
+// filesystems, of the input and of the input files.
+const warmDeviceSize = 4 << 30
+
+// Maximum time to boot a VM ahead of time
+const warmBootTimeout = time.Minute
+
+// An umlWarm is a VM booted ahead of time, waiting for its job.
+//
+// The VM is booted with the devices of the job (see Run) backed by sparse
+// placeholder files, and with the warm parameter, telling the init process
+// to wait for the parameters of the job on its third console (/dev/tty2).
+// Before sending them, Run replaces the placeholder of the task filesystem by a
+// link to the actual file, and writes the input and the input files in their
+// placeholders. This works because UML opens the file backing a device when
+// the device is opened in the VM, and reads zeros beyond the end of the file.
+// The parameters tell the sizes of the input and of the results archive, as
+// the devices are larger.
+type umlWarm struct {
+	// Environment and memory limit of the VM
+	environment string
+	memory      int
+
+	// Temporary directory containing the placeholder files
+	dir string
+
+	cmd *exec.Cmd
+
+	// Copies the consoles of the VM to stdout, stderr, ready and steps
+	out processOutput
+
+	// Destinations of the output and of the standard error, set by Run
+	stdout, stderr switchWriter
+
+	// Steps reported by the init process, to be read once the VM has halted
+	steps bytes.Buffer
+
+	// Write end of the input of the third console
+	control *os.File
+
+	// Closed when the third console signals that the VM is ready
+	ready chan bool
+
+	// Whether Run has been called, and whether the VM has halted. An unused
+	// VM cleans up after itself when it halts. Protected by the mutex of the
+	// sandbox.
+	used, halted bool
+
+	// Closed when the VM has halted
+	exited chan bool
+}
+
+// Start boots the VM for the tasks of environment with the given memory limit,
+// and waits until the VM is ready to receive its job.
+func (sb *umlSandbox) Start(environment string, memory int) error {
+	dir, err := ioutil.TempDir("", "pythia-warm-")
+	if err != nil {
+		return err
+	}
+	warm := &umlWarm{
+		environment: environment,
+		memory:      memory,
+		dir:         dir,
+		ready:       make(chan bool),
+		exited:      make(chan bool),
+	}
+	for _, name := range []string{"task", "input", "results", "files"} {
+		f, err := os.Create(filepath.Join(dir, name))
+		if err == nil {
+			err = f.Truncate(warmDeviceSize)
+			f.Close()
+		}
+		if err != nil {
+			warm.cleanup()
+			return err
+		}
+	}
+	warm.cmd = exec.Command(sb.config.UmlPath,
+		fmt.Sprintf("ubd0r=%s.sfs", path.Join(sb.config.EnvDir, environment)),
+		fmt.Sprintf("ubd1r=%s", filepath.Join(dir, "task")),
+		fmt.Sprintf("ubd2r=%s", filepath.Join(dir, "input")),
+		fmt.Sprintf("ubd3=%s", filepath.Join(dir, "results")),
+		fmt.Sprintf("ubd4r=%s", filepath.Join(dir, "files")),
+		"con0=null,fd:1",
+		"con1=null,fd:3",
+		"con2=fd:4,fd:5",
+		"con3=null,fd:6",
+		"init=/init",
+		"ro",
+		"quiet",
+		fmt.Sprintf("mem=%dm", memory),
+		"warm=1")
+	warm.cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	warm.cmd.Stdin = nil
+	var once sync.Once
+	signal := writerFunc(func(p []byte) (int, error) {
+		once.Do(func() { close(warm.ready) })
+		return len(p), nil
+	})
+	var files []*os.File
+	for _, w := range []io.Writer{&warm.stdout, &warm.stderr, signal, &warm.steps} {
+		f, err := warm.out.pipe(w)
+		if err != nil {
+			warm.cleanup()
+			return err
+		}
+		files = append(files, f)
+	}
+	warm.cmd.Stdout = files[0]
+	warm.cmd.Stderr = files[0]
+	r, w, err := os.Pipe()
+	if err != nil {
+		warm.cleanup()
+		return err
+	}
+	warm.control = w
+	warm.cmd.ExtraFiles = []*os.File{files[1], r, files[2], files[3]}
+	// Boot the VM
+	sb.mutex.Lock()
+	if sb.aborted {
+		sb.mutex.Unlock()
+		r.Close()
+		warm.cleanup()
+		return errors.New("Sandbox aborted")
+	}
+	err = warm.cmd.Start()
+	r.Close()
+	warm.out.start()
+	if err != nil {
+		sb.mutex.Unlock()
+		warm.out.wait()
+		warm.cleanup()
+		return err
+	}
+	sb.pid = warm.cmd.Process.Pid
+	sb.warm = warm
+	sb.mutex.Unlock()
+	go sb.waitWarm()
+	select {
+	case <-warm.ready:
+		return nil
+	case <-warm.exited:
+		return errors.New("Virtual machine halted while booting")
+	case <-time.After(warmBootTimeout):
+		sb.Abort()
+		return errors.New("Virtual machine boot timed out")
+	}
+}
+
+// WaitWarm waits for the VM booted by Start to halt, and kills the remaining
+// UML processes. If the VM has not been used, its files are removed.
+func (sb *umlSandbox) waitWarm() {
+	warm := sb.warm
+	warm.cmd.Wait()
+	sb.mutex.Lock()
+	syscall.Kill(-sb.pid, syscall.SIGKILL)
+	sb.pid = 0
+	sb.mutex.Unlock()
+	warm.out.wait()
+	sb.mutex.Lock()
+	warm.halted = true
+	if !warm.used {
+		warm.cleanup()
+	}
+	sb.mutex.Unlock()
+	close(warm.exited)
+}
+
+// RunWarm gives its job to the VM booted by Start, and waits for the VM to
+// halt.
+func (sb *umlSandbox) runWarm(input string, files map[string][]byte, stdout, stderr io.Writer) error {
+	warm := sb.warm
+	sb.mutex.Lock()
+	if sb.aborted {
+		sb.mutex.Unlock()
+		return nil
+	}
+	if warm.halted {
+		sb.mutex.Unlock()
+		return errors.New("Virtual machine halted before running its job")
+	}
+	warm.used = true
+	sb.mutex.Unlock()
+	defer warm.cleanup()
+	err := warm.attach(sb.config.TasksDir, sb.task, input, files)
+	if err == nil {
+		warm.stdout.set(stdout)
+		warm.stderr.set(stderr)
+		params := []string{
+			fmt.Sprintf("disksize=%d%%", sb.task.Limits.Disk),
+			fmt.Sprintf("inputsize=%d", len(input)),
+		}
+		params = append(params, processParams(sb.task)...)
+		if sb.task.Results != "" {
+			params = append(params,
+				fmt.Sprintf("results=%s", sb.task.Results),
+				fmt.Sprintf("resultsize=%d", resultsSize(sb.task)))
+		}
+		if len(files) > 0 {
+			params = append(params, "inputfiles=1")
+		}
+		if stderr != nil {
+			params = append(params, "stderr=1")
+		}
+		_, err = io.WriteString(warm.control, strings.Join(params, " ")+"\n")
+	}
+	if err != nil {
+		sb.Abort()
+	}
+	<-warm.exited
+	if err != nil {
+		return err
+	}
+	if warm.cmd.ProcessState != nil {
+		sb.setResult(warm.cmd.ProcessState, warm.steps.Bytes())
+	}
+	if sb.task.Results != "" {
+		f, err := os.Open(filepath.Join(warm.dir, "results"))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		sb.result.Results, err = ioutil.ReadAll(io.LimitReader(f, int64(resultsSize(sb.task))))
+		return err
+	}
+	return nil
+}
+
+// Attach fills the placeholders of the devices of the job: the task
+// filesystem (found in tasksdir), the input and the input files.
+func (warm *umlWarm) attach(tasksdir string, task *pythia.Task, input string, files map[string][]byte) error {
+	taskfs, err := filepath.Abs(filepath.Join(tasksdir, task.TaskFS))
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(taskfs); err != nil {
+		return err
+	} else if info.Size() > warmDeviceSize {
+		return errors.New("Task filesystem too large for a warm virtual machine")
+	}
+	if len(input) > warmDeviceSize {
+		return errors.New("Input too large for a warm virtual machine")
+	}
+	placeholder := filepath.Join(warm.dir, "task")
+	if err := os.Remove(placeholder); err != nil {
+		return err
+	}
+	if err := os.Symlink(taskfs, placeholder); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(warm.dir, "input"), []byte(input), 0600); err != nil {
+		return err
+	}
+	if len(files) > 0 {
+		f, err := os.OpenFile(filepath.Join(warm.dir, "files"), os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := writeInputs(f, files); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Cleanup closes the pipes and removes the placeholder files. The VM shall
+// have halted or not have been booted.
+func (warm *umlWarm) cleanup() {
+	warm.out.close()
+	if warm.control != nil {
+		warm.control.Close()
+	}
+	os.RemoveAll(warm.dir)
+}
+
+// A switchWriter forwards the writes to a writer set later, and discards them
+// until then.
+type switchWriter struct {
+	w     io.Writer
+	mutex sync.Mutex
+}
+
+// Set sets the writer receiving the next writes.
+func (s *switchWriter) set(w io.Writer) {
+	s.mutex.Lock()
+	s.w = w
+	s.mutex.Unlock()
+}
+
+// Write forwards p to the writer, if set.
+func (s *switchWriter) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	w := s.w
+	s.mutex.Unlock()
+	if w == nil {
+		return len(p), nil
+	}
+	return w.Write(p)
+}
+
+// A writerFunc is a function implementing io.Writer.
+type writerFunc func(p []byte) (int, error)
+
+// Write calls f(p).
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+// SetResult sets the result of the VM from the state of the main UML process
+// and the steps reported by the init process. The rusage of the main process
+// misses the processes of the VM killed along with it, so the CPU time is the
+// largest of the rusage and of the samples taken while the VM was running.
+func (sb *umlSandbox) setResult(state *os.ProcessState, steps []byte) {
+	sb.result = processResult(state)
+	sb.result.Steps, sb.result.Stopped = parseSteps(steps)
+	sb.mutex.Lock()
+	if sb.cpuTime > sb.result.CpuTime {
+		sb.result.CpuTime = sb.cpuTime
+	}
+	sb.mutex.Unlock()
+}
+
+// Abort kills the VM. The CPU time is sampled one last time before, as the
+// processes of the VM are not accounted to the main UML process when killed
+// along with it.
+func (sb *umlSandbox) Abort() {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	sb.aborted = true
+	if sb.pid != 0 {
+		sb.sampleCpuTime()
+		syscall.Kill(-sb.pid, syscall.SIGKILL)
+	}
+}
+
+// CpuTime returns the CPU time consumed by the UML processes. It includes the
+// time spent by the VM booting.
+func (sb *umlSandbox) CpuTime() time.Duration {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	if sb.pid == 0 {
+		return 0
+	}
+	return sb.sampleCpuTime()
+}
+
+// SampleCpuTime returns the CPU time consumed by the processes of the running
+// VM, and keeps the largest sample in sb.cpuTime. This function shall be
+// called with sb.mutex held.
+func (sb *umlSandbox) sampleCpuTime() time.Duration {
+	cpu := treeCpuTime(sb.pid)
+	if cpu > sb.cpuTime {
+		sb.cpuTime = cpu
+	}
+	return cpu
+}
+
+// Result returns whether the VM exited successfully, and the resources used by
+// the VM.
+func (sb *umlSandbox) Result() SandboxResult {
+	return sb.result
+}
+
+// vim:set sw=4 ts=4 noet:
@@ -0,0 +1,179 @@
+// Copyright 2013 The Pythia Authors.
+// This file is part of Pythia.
+//
+// Pythia is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, version 3 of the License.
+//
+// Pythia is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Pythia.  If not, see <http://www.gnu.org/licenses/>.
+
+package backend
+
+import (
+	"container/list"
+	"time"
+)
+
+// A waitingQueue holds the jobs waiting to be scheduled.
+//
+// Jobs with a higher priority are scheduled first. To prevent low-priority
+// jobs from starving, the effective priority of a job increases by one every
+// aging interval it spends waiting.
+//
+// Among jobs of the same priority, the queue shares the pools fairly between
+// the clients having submitted them: the next job is taken from the client
+// having the fewest jobs running. Jobs of the same client are scheduled in
+// FIFO order.
+//
+// Waiting jobs shall have a non-nil Origin. A waitingQueue keeps the Waiting
+// counters of the origins up-to-date.
+//
+// A waitingQueue is not thread-safe. It shall only be used from the queue main
+// goroutine.
+type waitingQueue struct {
+	// Interval after which the priority of a waiting job is increased by one.
+	// Aging is disabled if the interval is not positive.
+	Aging time.Duration
+
+	// Waiting jobs (*queueJob), one list per client and priority level. Empty
+	// lists are removed from the map.
+	lists map[waitingKey]*list.List
+
+	// Total number of waiting jobs
+	length int
+}
+
+// A waitingKey identifies a list of the waiting queue. Jobs submitted within a
+// session are keyed by session rather than by client, as the client holding a
+// session may change while the jobs are waiting.
+type waitingKey struct {
+	Client   int
+	Session  string
+	Priority int
+}
+
+// NewWaitingQueue returns an empty waiting queue.
+func newWaitingQueue(aging time.Duration) *waitingQueue {
+	return &waitingQueue{
+		Aging: aging,
+		lists: make(map[waitingKey]*list.List),
+	}
+}
+
+// Len returns the number of waiting jobs.
+func (w *waitingQueue) Len() int {
+	return w.length
+}
+
+// Key returns the key of the list holding job.
+func (w *waitingQueue) key(job *queueJob) waitingKey {
+	if job.Session != "" {
+		return waitingKey{-1, job.Session, job.Msg.Priority}
+	}
+	return waitingKey{job.Origin.Id, "", job.Msg.Priority}
+}
+
+// List returns the list holding job, creating it if needed.
+func (w *waitingQueue) list(job *queueJob) *list.List {
+	key := w.key(job)
+	l := w.lists[key]
+	if l == nil {
+		l = list.New()
+		w.lists[key] = l
+	}
+	return l
+}
+
+// PushBack adds a new job at the end of its list.
+func (w *waitingQueue) PushBack(job *queueJob) {
+	job.WaitingElement = w.list(job).PushBack(job)
+	job.Origin.Waiting++
+	w.length++
+}
+
+// Insert adds a job to its list, ahead of the jobs queued after it. This is
+// used for jobs that need to be rescheduled, which keep the time at which they
+// were queued, such that each list stays ordered by queuing time.
+func (w *waitingQueue) Insert(job *queueJob) {
+	l := w.list(job)
+	e := l.Front()
+	for e != nil && !job.Queued.Before(e.Value.(*queueJob).Queued) {
+		e = e.Next()
+	}
+	if e == nil {
+		job.WaitingElement = l.PushBack(job)
+	} else {
+		job.WaitingElement = l.InsertBefore(job, e)
+	}
+	job.Origin.Waiting++
+	w.length++
+}
+
+// Remove removes a job from the waiting queue.
+func (w *waitingQueue) Remove(job *queueJob) {
+	key := w.key(job)
+	l := w.lists[key]
+	l.Remove(job.WaitingElement)
+	job.WaitingElement = nil
+	job.Origin.Waiting--
+	w.length--
+	if l.Len() == 0 {
+		delete(w.lists, key)
+	}
+}
+
+// Priority returns the effective priority of a job at time now.
+func (w *waitingQueue) priority(job *queueJob, now time.Time) int {
+	if w.Aging <= 0 {
+		return job.Msg.Priority
+	}
+	return job.Msg.Priority + int(now.Sub(job.Queued)/w.Aging)
+}
+
+// Before returns whether job a, of effective priority pa, shall be scheduled
+// before job b, of effective priority pb. Ties between effective priorities
+// are broken in favor of the least loaded client, and then of the job waiting
+// for the longest time.
+func before(a *queueJob, pa int, b *queueJob, pb int) bool {
+	if pa != pb {
+		return pa > pb
+	}
+	if a.Origin.InFlight != b.Origin.InFlight {
+		return a.Origin.InFlight < b.Origin.InFlight
+	}
+	return a.Queued.Before(b.Queued)
+}
+
+// Front returns the job that shall be scheduled next at time now among the
+// jobs accepted by the accept function, or nil if there is no such job.
+func (w *waitingQueue) Front(now time.Time, accept func(*queueJob) bool) *queueJob {
+	var best *queueJob
+	bestPriority := 0
+	for _, l := range w.lists {
+		// The first accepted job of each list has waited the longest, hence it
+		// has the highest effective priority of its list.
+		var job *queueJob
+		for e := l.Front(); e != nil; e = e.Next() {
+			if j := e.Value.(*queueJob); accept(j) {
+				job = j
+				break
+			}
+		}
+		if job == nil {
+			continue
+		}
+		priority := w.priority(job, now)
+		if best == nil || before(job, priority, best, bestPriority) {
+			best, bestPriority = job, priority
+		}
+	}
+	return best
+}
+
+// vim:set sw=4 ts=4 noet:
@@ -0,0 +1,156 @@
+// Copyright 2013 The Pythia Authors.
+// This file is part of Pythia.
+//
+// Pythia is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, version 3 of the License.
+//
+// Pythia is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Pythia.  If not, see <http://www.gnu.org/licenses/>.
+
+package backend
+
+import (
+	"fmt"
+	"pythia"
+	"testing"
+	"testutils"
+	"time"
+)
+
+// NewWaitingTestJob creates a job submitted by origin with the given priority,
+// queued at time queued.
+func newWaitingTestJob(origin *queueClient, id string, priority int, queued time.Time) *queueJob {
+	return &queueJob{
+		Id:     id,
+		Msg:    pythia.Message{Message: pythia.LaunchMsg, Id: id, Priority: priority},
+		Origin: origin,
+		Queued: queued,
+	}
+}
+
+// AcceptAll accepts any job.
+func acceptAll(job *queueJob) bool {
+	return true
+}
+
+// PopAll removes all jobs from w at time now and returns their ids in
+// scheduling order.
+func popAll(w *waitingQueue, now time.Time) []string {
+	var ids []string
+	for w.Len() > 0 {
+		job := w.Front(now, acceptAll)
+		w.Remove(job)
+		ids = append(ids, job.Id)
+	}
+	return ids
+}
+
+func TestWaitingPriority(t *testing.T) {
+	now := time.Now()
+	c := &queueClient{Id: 0}
+	w := newWaitingQueue(0)
+	w.PushBack(newWaitingTestJob(c, "low1", 0, now))
+	w.PushBack(newWaitingTestJob(c, "high1", 5, now.Add(1)))
+	w.PushBack(newWaitingTestJob(c, "low2", 0, now.Add(2)))
+	w.PushBack(newWaitingTestJob(c, "high2", 5, now.Add(3)))
+	w.PushBack(newWaitingTestJob(c, "mid", 1, now.Add(4)))
+	testutils.Expect(t, "length", 5, w.Len())
+	testutils.Expect(t, "order",
+		[]string{"high1", "high2", "mid", "low1", "low2"},
+		popAll(w, now.Add(time.Hour)))
+	testutils.Expect(t, "length", 0, w.Len())
+}
+
+func TestWaitingAging(t *testing.T) {
+	now := time.Now()
+	c := &queueClient{Id: 0}
+	w := newWaitingQueue(time.Minute)
+	w.PushBack(newWaitingTestJob(c, "old", 0, now))
+	w.PushBack(newWaitingTestJob(c, "new", 2, now.Add(150*time.Second)))
+	// At t+150s, old has effective priority 2 and has waited longer.
+	testutils.Expect(t, "order", []string{"old", "new"},
+		popAll(w, now.Add(150*time.Second)))
+	w.PushBack(newWaitingTestJob(c, "old", 0, now))
+	w.PushBack(newWaitingTestJob(c, "new", 3, now.Add(150*time.Second)))
+	testutils.Expect(t, "order", []string{"new", "old"},
+		popAll(w, now.Add(150*time.Second)))
+}
+
+func TestWaitingInsert(t *testing.T) {
+	now := time.Now()
+	c := &queueClient{Id: 0}
+	w := newWaitingQueue(0)
+	w.PushBack(newWaitingTestJob(c, "a", 0, now))
+	w.PushBack(newWaitingTestJob(c, "c", 0, now.Add(2)))
+	// Rescheduled jobs are put back in the order they were queued.
+	w.Insert(newWaitingTestJob(c, "b", 0, now.Add(1)))
+	w.Insert(newWaitingTestJob(c, "d", 0, now.Add(3)))
+	w.Insert(newWaitingTestJob(c, "z", 0, now.Add(-1)))
+	testutils.Expect(t, "order", []string{"z", "a", "b", "c", "d"}, popAll(w, now))
+}
+
+func TestWaitingRemove(t *testing.T) {
+	now := time.Now()
+	c := &queueClient{Id: 0}
+	w := newWaitingQueue(0)
+	a := newWaitingTestJob(c, "a", 0, now)
+	b := newWaitingTestJob(c, "b", 1, now)
+	w.PushBack(a)
+	w.PushBack(b)
+	w.Remove(b)
+	if b.WaitingElement != nil {
+		t.Error("Removed job still has a waiting element")
+	}
+	w.Insert(b)
+	w.Remove(a)
+	testutils.Expect(t, "waiting", 1, c.Waiting)
+	testutils.Expect(t, "order", []string{"b"}, popAll(w, now))
+	testutils.Expect(t, "waiting", 0, c.Waiting)
+}
+
+func TestWaitingFairShare(t *testing.T) {
+	now := time.Now()
+	noisy := &queueClient{Id: 0}
+	quiet := &queueClient{Id: 1}
+	w := newWaitingQueue(0)
+	for i := 0; i < 3; i++ {
+		w.PushBack(newWaitingTestJob(noisy, fmt.Sprint("noisy", i), 0,
+			now.Add(time.Duration(i))))
+	}
+	w.PushBack(newWaitingTestJob(quiet, "quiet0", 0, now.Add(10)))
+	w.PushBack(newWaitingTestJob(quiet, "quiet1", 0, now.Add(11)))
+	testutils.Expect(t, "waiting", 3, noisy.Waiting)
+	// Simulate the dispatching done by the queue.
+	var ids []string
+	for w.Len() > 0 {
+		job := w.Front(now, acceptAll)
+		w.Remove(job)
+		job.Origin.InFlight++
+		ids = append(ids, job.Id)
+	}
+	testutils.Expect(t, "order",
+		[]string{"noisy0", "quiet0", "noisy1", "quiet1", "noisy2"}, ids)
+}
+
+func TestWaitingAccept(t *testing.T) {
+	now := time.Now()
+	c := &queueClient{Id: 0}
+	w := newWaitingQueue(0)
+	w.PushBack(newWaitingTestJob(c, "a", 0, now))
+	w.PushBack(newWaitingTestJob(c, "b", 0, now.Add(1)))
+	w.PushBack(newWaitingTestJob(c, "c", 0, now.Add(2)))
+	job := w.Front(now, func(job *queueJob) bool { return job.Id != "a" })
+	testutils.Expect(t, "job", "b", job.Id)
+	job = w.Front(now, func(job *queueJob) bool { return false })
+	if job != nil {
+		t.Error("Unexpected job", job.Id)
+	}
+}
+
+// vim:set sw=4 ts=4 noet:
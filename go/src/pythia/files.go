@@ -0,0 +1,87 @@
+// Copyright 2013 The Pythia Authors.
+// This file is part of Pythia.
+//
+// Pythia is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, version 3 of the License.
+//
+// Pythia is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Pythia.  If not, see <http://www.gnu.org/licenses/>.
+
+package pythia
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// MaxFileNameLength is the maximum length of the name of an input file,
+// including its directories.
+const MaxFileNameLength = 99
+
+// CheckFiles returns an error if the names of the input files are not valid.
+// Names are slash-separated paths relative to the input directory of the task.
+// They shall be clean, shall only contain printable ASCII characters, shall
+// not leave the input directory, and a file shall not be a directory of
+// another one.
+func CheckFiles(files map[string][]byte) error {
+	for name := range files {
+		if name == "" || len(name) > MaxFileNameLength || path.IsAbs(name) ||
+			path.Clean(name) != name || name == "." || name == ".." ||
+			strings.HasPrefix(name, "../") || !printable(name) {
+			return fmt.Errorf("Invalid input file name '%s'", name)
+		}
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			if _, ok := files[dir]; ok {
+				return fmt.Errorf("Input file '%s' is also a directory", dir)
+			}
+		}
+	}
+	return nil
+}
+
+// Printable returns whether s only contains printable ASCII characters.
+func printable(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < ' ' || s[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// ReadFiles reads the regular files of dir and of its subdirectories, to be
+// given as input files to a task.
+func ReadFiles(dir string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = content
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, CheckFiles(files)
+}
+
+// vim:set sw=4 ts=4 noet:
@@ -0,0 +1,55 @@
+// Copyright 2013 The Pythia Authors.
+// This file is part of Pythia.
+//
+// Pythia is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, version 3 of the License.
+//
+// Pythia is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Pythia.  If not, see <http://www.gnu.org/licenses/>.
+
+package pythia
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckFiles(t *testing.T) {
+	for _, c := range []struct {
+		names []string
+		valid bool
+	}{
+		{nil, true},
+		{[]string{"main.c", "src/a.c", "src/lib/b.h", "a..b", ".hidden"}, true},
+		{[]string{strings.Repeat("a", MaxFileNameLength)}, true},
+		{[]string{strings.Repeat("a", MaxFileNameLength+1)}, false},
+		{[]string{""}, false},
+		{[]string{"."}, false},
+		{[]string{".."}, false},
+		{[]string{"../a"}, false},
+		{[]string{"/etc/passwd"}, false},
+		{[]string{"a/../b"}, false},
+		{[]string{"a//b"}, false},
+		{[]string{"a/"}, false},
+		{[]string{"é"}, false},
+		{[]string{"a\nb"}, false},
+		{[]string{"src", "src/a.c"}, false},
+		{[]string{"a/b", "a/b/c/d"}, false},
+	} {
+		files := make(map[string][]byte)
+		for _, name := range c.names {
+			files[name] = nil
+		}
+		if err := CheckFiles(files); (err == nil) != c.valid {
+			t.Errorf("%q: expected valid=%v, got error %v", c.names, c.valid, err)
+		}
+	}
+}
+
+// vim:set sw=4 ts=4 noet:
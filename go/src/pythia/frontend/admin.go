@@ -0,0 +1,401 @@
+// Copyright 2013 The Pythia Authors.
+// This file is part of Pythia.
+//
+// Pythia is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, version 3 of the License.
+//
+// Pythia is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Pythia.  If not, see <http://www.gnu.org/licenses/>.
+
+package frontend
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"pythia"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func init() {
+	pythia.Components["admin"] = pythia.ComponentInfo{
+		Name:        "admin",
+		Description: "Administration tool for a running queue",
+		New:         func() pythia.Component { return NewAdmin() },
+	}
+}
+
+// An adminCommand is a subcommand of the admin component.
+type adminCommand struct {
+	// Names of the arguments, shown in the usage.
+	Args []string
+
+	// Short description shown in the usage.
+	Description string
+
+	// Function executing the command.
+	Run func(admin *Admin, args []string) error
+}
+
+// The admin subcommands, mapped by name.
+var adminCommands = map[string]adminCommand{
+	"status": {nil, "print queue statistics", (*Admin).status},
+	"pools":  {nil, "list the pools", (*Admin).pools},
+	"jobs":   {nil, "list the jobs", (*Admin).jobs},
+	"job":    {[]string{"ID"}, "show a job", (*Admin).job},
+	"abort":  {[]string{"ID"}, "abort a job", (*Admin).abort},
+	"drain":  {[]string{"POOL"}, "stop dispatching jobs to a pool", (*Admin).drain},
+	"undrain": {[]string{"POOL"}, "resume dispatching jobs to a drained pool",
+		(*Admin).drain},
+}
+
+// An Admin is a component sending a single command to a running queue and
+// printing the answer, as tables or as JSON.
+//
+// New admin components shall be created by the NewAdmin function.
+type Admin struct {
+	// Whether to print the answers as JSON
+	JSON bool
+
+	// How long to wait for the answer of the queue
+	Timeout time.Duration
+
+	// The command to execute, and its arguments
+	command string
+	args    []string
+
+	// Connection to the queue
+	conn *pythia.Conn
+
+	// Where to print the answers
+	out io.Writer
+}
+
+// NewAdmin returns a new admin component with default parameters.
+func NewAdmin() *Admin {
+	admin := new(Admin)
+	admin.Timeout = 10 * time.Second
+	admin.out = os.Stdout
+	return admin
+}
+
+// Setup configures the admin component with the command line flags in args.
+func (admin *Admin) Setup(fs *flag.FlagSet, args []string) error {
+	fs.BoolVar(&admin.JSON, "json", admin.JSON, "print the answers as JSON")
+	fs.DurationVar(&admin.Timeout, "timeout", admin.Timeout,
+		"how long to wait for the answer of the queue")
+	usage := fs.Usage
+	fs.Usage = func() {
+		if usage != nil {
+			usage()
+		}
+		printAdminCommands(os.Stderr)
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("Missing command")
+	}
+	admin.command, admin.args = fs.Arg(0), fs.Args()[1:]
+	command, ok := adminCommands[admin.command]
+	if !ok {
+		return fmt.Errorf("Unknown command '%s'", admin.command)
+	}
+	if len(admin.args) != len(command.Args) {
+		return fmt.Errorf("Invalid arguments for command '%s'", admin.command)
+	}
+	return nil
+}
+
+// PrintAdminCommands prints the list of admin commands on w.
+func printAdminCommands(w io.Writer) {
+	var names []string
+	for name := range adminCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "\nCommands:")
+	for _, name := range names {
+		command := adminCommands[name]
+		usage := strings.Join(append([]string{name}, command.Args...), " ")
+		fmt.Fprintf(w, "  %-14s %s\n", usage, command.Description)
+	}
+}
+
+// Run executes the command. The program exits with a non-zero status if the
+// command fails.
+func (admin *Admin) Run() {
+	if err := admin.run(); err != nil {
+		fmt.Fprintln(os.Stderr, "admin:", err)
+		os.Exit(1)
+	}
+}
+
+// Run connects to the queue and executes the command.
+func (admin *Admin) run() error {
+	conn, err := pythia.Dial(pythia.QueueAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	admin.conn = conn
+	return adminCommands[admin.command].Run(admin, admin.args)
+}
+
+// Shutdown aborts the command.
+func (admin *Admin) Shutdown() {
+	if admin.conn != nil {
+		admin.conn.Close()
+	}
+}
+
+// Request sends msg to the queue and returns its answer, i.e. the next
+// message of the same type.
+func (admin *Admin) request(msg pythia.Message) (pythia.Message, error) {
+	if err := admin.conn.Send(msg); err != nil {
+		return pythia.Message{}, err
+	}
+	timeout := time.After(admin.Timeout)
+	for {
+		select {
+		case reply, ok := <-admin.conn.Receive():
+			if !ok {
+				return pythia.Message{}, errors.New("Connection to queue lost")
+			}
+			if reply.Message == msg.Message {
+				return reply, nil
+			}
+		case <-timeout:
+			return pythia.Message{}, errors.New("No answer from queue")
+		}
+	}
+}
+
+// PrintJSON prints v as indented JSON.
+func (admin *Admin) printJSON(v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(admin.out, "%s\n", b)
+	return err
+}
+
+// PrintTable prints rows as a table with aligned columns. The first row is the
+// header.
+func (admin *Admin) printTable(rows [][]string) error {
+	w := tabwriter.NewWriter(admin.out, 0, 8, 2, ' ', 0)
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+// Status prints the queue statistics.
+func (admin *Admin) status(args []string) error {
+	reply, err := admin.request(pythia.Message{Message: pythia.StatusMsg})
+	if err != nil {
+		return err
+	}
+	info := reply.Queue
+	if info == nil {
+		return errors.New("Invalid answer from queue")
+	}
+	if admin.JSON {
+		return admin.printJSON(info)
+	}
+	pools, capacity, clients := 0, 0, 0
+	for _, client := range info.Clients {
+		if client.Capacity > 0 {
+			pools++
+			capacity += client.Capacity
+		}
+		if client.Connected {
+			clients++
+		}
+	}
+	return admin.printTable([][]string{
+		{"Waiting:", fmt.Sprint(info.Waiting, "/", info.Capacity)},
+		{"Running:", fmt.Sprint(info.Running, "/", capacity)},
+		{"Done:", fmt.Sprint(info.Done)},
+		{"Pools:", fmt.Sprint(pools)},
+		{"Clients:", fmt.Sprint(clients)},
+	})
+}
+
+// Pools prints the pools registered in the queue.
+func (admin *Admin) pools(args []string) error {
+	reply, err := admin.request(pythia.Message{Message: pythia.StatusMsg})
+	if err != nil {
+		return err
+	}
+	if reply.Queue == nil {
+		return errors.New("Invalid answer from queue")
+	}
+	pools := []pythia.ClientInfo{}
+	for _, client := range reply.Queue.Clients {
+		if client.Capacity > 0 {
+			pools = append(pools, client)
+		}
+	}
+	if admin.JSON {
+		return admin.printJSON(pools)
+	}
+	rows := [][]string{{"POOL", "SESSION", "STATE", "RUNNING", "MEMORY",
+		"WARM", "ENVIRONMENTS"}}
+	for _, pool := range pools {
+		state := "active"
+		if !pool.Connected {
+			state = "disconnected"
+		} else if pool.Draining {
+			state = "draining"
+		}
+		memory := fmt.Sprint(pool.MemoryUsed, "/", pool.Memory)
+		if pool.Memory == 0 {
+			memory = fmt.Sprint(pool.MemoryUsed, "/-")
+		}
+		// Ratio of the executed jobs which did not wait for their sandbox
+		// to start
+		warm := "-"
+		if pool.Executed > 0 {
+			warm = fmt.Sprintf("%d/%d (%d%%)", pool.WarmHits, pool.Executed,
+				100*pool.WarmHits/pool.Executed)
+		}
+		envs := strings.Join(pool.Environments, ",")
+		if envs == "" {
+			envs = "*"
+		}
+		rows = append(rows, []string{
+			fmt.Sprint(pool.Id),
+			orDash(pool.Session),
+			state,
+			fmt.Sprint(len(pool.Running), "/", pool.Capacity),
+			memory,
+			warm,
+			envs,
+		})
+	}
+	return admin.printTable(rows)
+}
+
+// Jobs prints the jobs known by the queue.
+func (admin *Admin) jobs(args []string) error {
+	reply, err := admin.request(pythia.Message{Message: pythia.ListJobsMsg})
+	if err != nil {
+		return err
+	}
+	jobs := reply.JobList
+	if jobs == nil {
+		jobs = []pythia.JobInfo{}
+	}
+	if admin.JSON {
+		return admin.printJSON(jobs)
+	}
+	return admin.printJobs(jobs)
+}
+
+// Job prints a job known by the queue.
+func (admin *Admin) job(args []string) error {
+	reply, err := admin.request(pythia.Message{
+		Message: pythia.JobInfoMsg,
+		Id:      args[0],
+	})
+	if err != nil {
+		return err
+	}
+	if reply.Job == nil {
+		return errors.New("Unknown job")
+	}
+	if admin.JSON {
+		return admin.printJSON(reply.Job)
+	}
+	return admin.printJobs([]pythia.JobInfo{*reply.Job})
+}
+
+// PrintJobs prints a table of jobs.
+func (admin *Admin) printJobs(jobs []pythia.JobInfo) error {
+	now := time.Now()
+	rows := [][]string{{"ID", "STATE", "PRIORITY", "CLIENT", "POOL", "TASK",
+		"AGE", "RUNTIME"}}
+	for _, job := range jobs {
+		task := "-"
+		if job.Task != nil {
+			task = job.Task.TaskFS
+		}
+		age, runtime := "-", "-"
+		if job.Queued != nil {
+			age = fmt.Sprint(now.Sub(*job.Queued) / time.Second * time.Second)
+		}
+		if job.Started != nil && job.State == "running" {
+			runtime = fmt.Sprint(now.Sub(*job.Started) / time.Second * time.Second)
+		}
+		rows = append(rows, []string{
+			job.Id,
+			job.State,
+			fmt.Sprint(job.Priority),
+			orDash(job.Session, fmt.Sprint(job.Client)),
+			fmt.Sprint(job.Pool),
+			task,
+			age,
+			runtime,
+		})
+	}
+	return admin.printTable(rows)
+}
+
+// Abort aborts a job.
+func (admin *Admin) abort(args []string) error {
+	return admin.control(pythia.Message{Message: pythia.CancelMsg, Id: args[0]})
+}
+
+// Drain drains a pool, or resumes a drained pool.
+func (admin *Admin) drain(args []string) error {
+	msg := pythia.Message{Message: pythia.DrainMsg, Id: args[0]}
+	if admin.command == "undrain" {
+		msg.Message = pythia.UndrainMsg
+	}
+	return admin.control(msg)
+}
+
+// Control sends a control message and checks its answer.
+func (admin *Admin) control(msg pythia.Message) error {
+	reply, err := admin.request(msg)
+	if err != nil {
+		return err
+	}
+	if admin.JSON {
+		if err := admin.printJSON(reply); err != nil {
+			return err
+		}
+	}
+	if reply.Error != "" {
+		return errors.New(reply.Error)
+	}
+	return nil
+}
+
+// OrDash returns the first non-empty string among values, or "-" if they are
+// all empty.
+func orDash(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return "-"
+}
+
+// vim:set sw=4 ts=4 noet:
@@ -0,0 +1,127 @@
+// Copyright 2013 The Pythia Authors.
+// This file is part of Pythia.
+//
+// Pythia is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, version 3 of the License.
+//
+// Pythia is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Pythia.  If not, see <http://www.gnu.org/licenses/>.
+
+package frontend
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"pythia"
+	"strings"
+	"testing"
+	"testutils"
+	"testutils/pytest"
+)
+
+// RunAdmin runs the admin component with the given command line arguments
+// against a mock queue, which answers the request with reply. It returns the
+// output of the command and its error.
+func runAdmin(t *testing.T, args []string, request, reply pythia.Message) (string, error) {
+	addr, err := pythia.LocalAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pythia.QueueAddr = addr
+	queue, err := pythia.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+	admin := NewAdmin()
+	if err := admin.Setup(flag.NewFlagSet("admin", flag.ContinueOnError), args); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	admin.out = &out
+	result := make(chan error)
+	go func() {
+		result <- admin.run()
+	}()
+	conn, err := queue.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &pytest.Conn{T: t, Conn: conn}
+	c.Expect(1, request)
+	c.Send(reply)
+	err = <-result
+	c.Close()
+	return out.String(), err
+}
+
+func TestAdminSetup(t *testing.T) {
+	for _, args := range [][]string{{}, {"unknown"}, {"abort"}, {"jobs", "x"}} {
+		admin := NewAdmin()
+		fs := flag.NewFlagSet("admin", flag.ContinueOnError)
+		fs.SetOutput(&bytes.Buffer{})
+		if admin.Setup(fs, args) == nil {
+			t.Error("Invalid arguments accepted:", args)
+		}
+	}
+}
+
+func TestAdminJobs(t *testing.T) {
+	task := pytest.ReadTask(t, "hello-world")
+	out, err := runAdmin(t, []string{"jobs"},
+		pythia.Message{Message: pythia.ListJobsMsg},
+		pythia.Message{
+			Message: pythia.ListJobsMsg,
+			JobList: []pythia.JobInfo{{
+				Id:     "0:a",
+				State:  "waiting",
+				Task:   &task,
+				Client: 0,
+				Pool:   -1,
+			}},
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	testutils.Expect(t, "lines", 2, len(lines))
+	testutils.Expect(t, "row", []string{"0:a", "waiting", "0", "0", "-1",
+		"hello-world.sfs", "-", "-"}, strings.Fields(lines[1]))
+}
+
+func TestAdminStatusJSON(t *testing.T) {
+	info := pythia.QueueInfo{
+		Capacity: 500,
+		Waiting:  2,
+		Clients:  []pythia.ClientInfo{{Id: 0, Connected: true, Capacity: 1}},
+	}
+	out, err := runAdmin(t, []string{"-json", "status"},
+		pythia.Message{Message: pythia.StatusMsg},
+		pythia.Message{Message: pythia.StatusMsg, Queue: &info})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded pythia.QueueInfo
+	if err := json.Unmarshal([]byte(out), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	testutils.Expect(t, "info", info, decoded)
+}
+
+func TestAdminAbortError(t *testing.T) {
+	_, err := runAdmin(t, []string{"abort", "0:a"},
+		pythia.Message{Message: pythia.CancelMsg, Id: "0:a"},
+		pythia.Message{Message: pythia.CancelMsg, Id: "0:a", Error: "Unknown job"})
+	if err == nil || err.Error() != "Unknown job" {
+		t.Error("Expected unknown job error, got", err)
+	}
+}
+
+// vim:set sw=4 ts=4 noet:
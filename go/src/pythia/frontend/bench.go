@@ -0,0 +1,367 @@
+// Copyright 2013 The Pythia Authors.
+// This file is part of Pythia.
+//
+// Pythia is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, version 3 of the License.
+//
+// Pythia is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Pythia.  If not, see <http://www.gnu.org/licenses/>.
+
+package frontend
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"pythia"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+func init() {
+	pythia.Components["bench"] = pythia.ComponentInfo{
+		Name:        "bench",
+		Description: "Benchmark a running queue with a batch of jobs",
+		New:         func() pythia.Component { return NewBench() },
+	}
+}
+
+// A benchSample records the events of a benchmark job.
+type benchSample struct {
+	Status                       pythia.Status
+	Submitted, Started, Finished time.Time
+}
+
+// A benchDist summarizes a distribution of durations, in seconds.
+type benchDist struct {
+	Count int     `json:"count"`
+	Mean  float64 `json:"mean"`
+	Min   float64 `json:"min"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+	Max   float64 `json:"max"`
+}
+
+// A benchStats gathers the statistics of the jobs ending with a given status.
+// The queue wait is the time between the submission and the start of the job,
+// the execution time the time between its start and its end, and the latency
+// the time between its submission and its end. Jobs that never started (e.g.
+// rejected by the queue) only count in the latency.
+type benchStats struct {
+	Status  string    `json:"status"`
+	Count   int       `json:"count"`
+	Wait    benchDist `json:"wait"`
+	Exec    benchDist `json:"exec"`
+	Latency benchDist `json:"latency"`
+}
+
+// A benchReport is the result of a benchmark.
+type benchReport struct {
+	Jobs       int          `json:"jobs"`
+	Duration   float64      `json:"duration"`
+	Throughput float64      `json:"throughput"`
+	Stats      []benchStats `json:"stats"`
+}
+
+// A Bench is a component submitting a batch of identical jobs to a running
+// queue, either at a fixed rate or with a bounded number of jobs in flight, and
+// reporting throughput and latency statistics. It is meant to size pools.
+//
+// New bench components shall be created by the NewBench function.
+type Bench struct {
+	// Number of jobs to submit
+	Jobs int
+
+	// Submission rate in jobs per second, or 0 for no limit
+	Rate float64
+
+	// Maximum number of jobs in flight, or 0 for no limit
+	Concurrency int
+
+	// Priority of the jobs
+	Priority int
+
+	// Output format: text, json or csv
+	Format string
+
+	// The task to launch and its input
+	task  pythia.Task
+	input string
+
+	// Connection to the queue
+	conn *pythia.Conn
+
+	// Where to print the report
+	out io.Writer
+}
+
+// NewBench returns a new bench component with default parameters.
+func NewBench() *Bench {
+	bench := new(Bench)
+	bench.Jobs = 100
+	bench.Concurrency = 10
+	bench.Format = "text"
+	bench.out = os.Stdout
+	return bench
+}
+
+// Setup configures the bench component with the command line flags in args,
+// and reads the task and input files.
+func (bench *Bench) Setup(fs *flag.FlagSet, args []string) error {
+	taskfile := fs.String("task", "", "path to the task description (mandatory)")
+	inputfile := fs.String("input", "", "path to the input of the jobs (default empty)")
+	fs.IntVar(&bench.Jobs, "n", bench.Jobs, "number of jobs to submit")
+	fs.Float64Var(&bench.Rate, "rate", bench.Rate,
+		"submission rate in jobs per second (0 for no limit)")
+	fs.IntVar(&bench.Concurrency, "concurrency", bench.Concurrency,
+		"maximum number of jobs in flight (0 for no limit)")
+	fs.IntVar(&bench.Priority, "priority", bench.Priority, "priority of the jobs")
+	fs.StringVar(&bench.Format, "format", bench.Format,
+		"output format (text, json or csv)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return errors.New("Unexpected arguments")
+	}
+	if bench.Jobs <= 0 {
+		return errors.New("Number of jobs must be positive")
+	}
+	if bench.Rate < 0 || bench.Concurrency < 0 {
+		return errors.New("Rate and concurrency must not be negative")
+	}
+	switch bench.Format {
+	case "text", "json", "csv":
+	default:
+		return fmt.Errorf("Unknown format '%s'", bench.Format)
+	}
+	if len(*taskfile) == 0 {
+		return errors.New("Missing task file")
+	}
+	content, err := ioutil.ReadFile(*taskfile)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(content, &bench.task); err != nil {
+		return err
+	}
+	if len(*inputfile) > 0 {
+		content, err := ioutil.ReadFile(*inputfile)
+		if err != nil {
+			return err
+		}
+		bench.input = string(content)
+	}
+	return nil
+}
+
+// Run executes the benchmark and prints its report. The program exits with a
+// non-zero status if the benchmark cannot be completed.
+func (bench *Bench) Run() {
+	if err := bench.run(); err != nil {
+		fmt.Fprintln(os.Stderr, "bench:", err)
+		os.Exit(1)
+	}
+}
+
+// Run executes the benchmark and prints its report.
+func (bench *Bench) run() error {
+	conn := pythia.DialRetry(pythia.QueueAddr)
+	defer conn.Close()
+	bench.conn = conn
+	samples := make([]benchSample, bench.Jobs)
+	start := time.Now()
+	sent, finished := 0, 0
+	for finished < len(samples) {
+		var launch <-chan time.Time
+		if sent < len(samples) &&
+			(bench.Concurrency == 0 || sent-finished < bench.Concurrency) {
+			var wait time.Duration
+			if bench.Rate > 0 {
+				next := time.Duration(float64(sent) / bench.Rate * float64(time.Second))
+				wait = next - time.Since(start)
+			}
+			if wait <= 0 {
+				err := conn.Send(pythia.Message{
+					Message:  pythia.LaunchMsg,
+					Id:       strconv.Itoa(sent),
+					Task:     &bench.task,
+					Input:    bench.input,
+					Priority: bench.Priority,
+				})
+				if err != nil {
+					return err
+				}
+				samples[sent].Submitted = time.Now()
+				sent++
+				continue
+			}
+			launch = time.After(wait)
+		}
+		select {
+		case msg, ok := <-conn.Receive():
+			if !ok {
+				return errors.New("Connection to queue lost")
+			}
+			i, err := strconv.Atoi(msg.Id)
+			if err != nil || i < 0 || i >= sent || !samples[i].Finished.IsZero() {
+				log.Println("Ignoring message", msg)
+				continue
+			}
+			switch msg.Message {
+			case pythia.StartedMsg:
+				samples[i].Started = time.Now()
+			case pythia.DoneMsg:
+				samples[i].Status = msg.Status
+				samples[i].Finished = time.Now()
+				finished++
+			default:
+				log.Println("Ignoring message", msg)
+			}
+		case <-launch:
+		}
+	}
+	return bench.print(newBenchReport(samples, time.Since(start)))
+}
+
+// Shutdown interrupts the benchmark. The queue aborts the jobs when the
+// connection is closed.
+func (bench *Bench) Shutdown() {
+	if bench.conn != nil {
+		bench.conn.Close()
+	}
+}
+
+// NewBenchReport computes the report of a benchmark that lasted duration.
+// The statistics of all jobs come first, followed by the statistics of each
+// status, sorted by name.
+func newBenchReport(samples []benchSample, duration time.Duration) *benchReport {
+	report := &benchReport{
+		Jobs:     len(samples),
+		Duration: duration.Seconds(),
+	}
+	if duration > 0 {
+		report.Throughput = float64(len(samples)) / duration.Seconds()
+	}
+	byStatus := make(map[string][]benchSample)
+	var statuses []string
+	for _, sample := range samples {
+		status := string(sample.Status)
+		if _, ok := byStatus[status]; !ok {
+			statuses = append(statuses, status)
+		}
+		byStatus[status] = append(byStatus[status], sample)
+	}
+	sort.Strings(statuses)
+	report.Stats = append(report.Stats, newBenchStats("all", samples))
+	for _, status := range statuses {
+		report.Stats = append(report.Stats, newBenchStats(status, byStatus[status]))
+	}
+	return report
+}
+
+// NewBenchStats computes the statistics of samples.
+func newBenchStats(status string, samples []benchSample) benchStats {
+	var wait, exec, latency []float64
+	for _, sample := range samples {
+		if !sample.Started.IsZero() {
+			wait = append(wait, sample.Started.Sub(sample.Submitted).Seconds())
+			exec = append(exec, sample.Finished.Sub(sample.Started).Seconds())
+		}
+		latency = append(latency, sample.Finished.Sub(sample.Submitted).Seconds())
+	}
+	return benchStats{
+		Status:  status,
+		Count:   len(samples),
+		Wait:    newBenchDist(wait),
+		Exec:    newBenchDist(exec),
+		Latency: newBenchDist(latency),
+	}
+}
+
+// NewBenchDist summarizes values. Percentiles use the nearest-rank method.
+func newBenchDist(values []float64) benchDist {
+	dist := benchDist{Count: len(values)}
+	if len(values) == 0 {
+		return dist
+	}
+	sort.Float64s(values)
+	sum := 0.
+	for _, v := range values {
+		sum += v
+	}
+	percentile := func(p int) float64 {
+		rank := (p*len(values) + 99) / 100
+		if rank < 1 {
+			rank = 1
+		}
+		return values[rank-1]
+	}
+	dist.Mean = sum / float64(len(values))
+	dist.Min = values[0]
+	dist.P50 = percentile(50)
+	dist.P90 = percentile(90)
+	dist.P99 = percentile(99)
+	dist.Max = values[len(values)-1]
+	return dist
+}
+
+// Print prints report in the configured format.
+func (bench *Bench) print(report *benchReport) error {
+	if bench.Format == "json" {
+		b, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(bench.out, "%s\n", b)
+		return err
+	}
+	rows := [][]string{{"status", "metric", "count", "mean", "min", "p50",
+		"p90", "p99", "max"}}
+	for _, stats := range report.Stats {
+		for _, metric := range []struct {
+			name string
+			dist benchDist
+		}{{"wait", stats.Wait}, {"exec", stats.Exec}, {"latency", stats.Latency}} {
+			d := metric.dist
+			row := []string{stats.Status, metric.name, fmt.Sprint(d.Count)}
+			for _, v := range []float64{d.Mean, d.Min, d.P50, d.P90, d.P99, d.Max} {
+				row = append(row, strconv.FormatFloat(v, 'f', 3, 64))
+			}
+			rows = append(rows, row)
+		}
+	}
+	if bench.Format == "csv" {
+		w := csv.NewWriter(bench.out)
+		w.WriteAll(rows)
+		return w.Error()
+	}
+	fmt.Fprintf(bench.out, "Jobs:       %d\n", report.Jobs)
+	fmt.Fprintf(bench.out, "Duration:   %.3fs\n", report.Duration)
+	fmt.Fprintf(bench.out, "Throughput: %.3f jobs/s\n\n", report.Throughput)
+	w := tabwriter.NewWriter(bench.out, 0, 8, 2, ' ', tabwriter.AlignRight)
+	for _, row := range rows {
+		for _, cell := range row {
+			fmt.Fprint(w, cell, "\t")
+		}
+		fmt.Fprintln(w)
+	}
+	return w.Flush()
+}
+
+// vim:set sw=4 ts=4 noet:
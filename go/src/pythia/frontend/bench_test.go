@@ -0,0 +1,114 @@
+// Copyright 2013 The Pythia Authors.
+// This file is part of Pythia.
+//
+// Pythia is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, version 3 of the License.
+//
+// Pythia is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Pythia.  If not, see <http://www.gnu.org/licenses/>.
+
+package frontend
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"path"
+	"pythia"
+	"testing"
+	"testutils"
+	"testutils/pytest"
+	"time"
+)
+
+func TestBench(t *testing.T) {
+	addr, err := pythia.LocalAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pythia.QueueAddr = addr
+	queue, err := pythia.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+	bench := NewBench()
+	args := []string{"-n", "3", "-concurrency", "2", "-format", "json",
+		"-task", path.Join(pytest.TasksDir, "hello-world.task")}
+	if err := bench.Setup(flag.NewFlagSet("bench", flag.ContinueOnError), args); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	bench.out = &out
+	done := make(chan error)
+	go func() {
+		done <- bench.run()
+	}()
+	conn, err := queue.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &pytest.Conn{T: t, Conn: conn}
+	task := pytest.ReadTask(t, "hello-world")
+	launch := func(id string) pythia.Message {
+		return pythia.Message{Message: pythia.LaunchMsg, Id: id, Task: &task}
+	}
+	c.Expect(1, launch("0"), launch("1"))
+	c.Send(pythia.Message{Message: pythia.StartedMsg, Id: "0"})
+	c.Send(pythia.Message{Message: pythia.DoneMsg, Id: "0", Status: pythia.Success})
+	c.Expect(1, launch("2"))
+	c.Send(pythia.Message{Message: pythia.DoneMsg, Id: "1", Status: pythia.Error})
+	c.Send(pythia.Message{Message: pythia.StartedMsg, Id: "2"})
+	c.Send(pythia.Message{Message: pythia.DoneMsg, Id: "2", Status: pythia.Success})
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	var report benchReport
+	if err := json.Unmarshal(out.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	testutils.Expect(t, "jobs", 3, report.Jobs)
+	var counts [][]int
+	var statuses []string
+	for _, stats := range report.Stats {
+		statuses = append(statuses, stats.Status)
+		counts = append(counts, []int{stats.Count, stats.Wait.Count,
+			stats.Exec.Count, stats.Latency.Count})
+	}
+	testutils.Expect(t, "statuses", []string{"all", "error", "success"}, statuses)
+	testutils.Expect(t, "counts", [][]int{{3, 2, 2, 3}, {1, 0, 0, 1}, {2, 2, 2, 2}},
+		counts)
+}
+
+func TestBenchDist(t *testing.T) {
+	var samples []benchSample
+	start := time.Now()
+	for i := 1; i <= 100; i++ {
+		samples = append(samples, benchSample{
+			Status:    pythia.Success,
+			Submitted: start,
+			Started:   start,
+			Finished:  start.Add(time.Duration(i) * time.Second),
+		})
+	}
+	stats := newBenchStats("success", samples)
+	testutils.Expect(t, "exec", benchDist{
+		Count: 100,
+		Mean:  50.5,
+		Min:   1,
+		P50:   50,
+		P90:   90,
+		P99:   99,
+		Max:   100,
+	}, stats.Exec)
+	testutils.Expect(t, "wait", 0., stats.Wait.Max)
+}
+
+// vim:set sw=4 ts=4 noet:
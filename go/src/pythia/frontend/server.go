@@ -16,16 +16,25 @@
 package frontend
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
 	"os"
 	"os/signal"
+	"path"
 	"pythia"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
 func init() {
@@ -44,29 +53,211 @@ type taskRequest struct {
 
 	// The input to be used for the task execution.
 	Response string
+
+	// The input files, mapped by their path in the input directory of the
+	// sandbox (optional, base64-encoded in JSON).
+	Files map[string][]byte
+
+	// The priority of the job (optional, defaults to 0).
+	Priority int
+
+	// Whether the output shall be streamed while the job is running (see
+	// outputHandler).
+	Stream bool
+}
+
+// Maximum amount of memory used to parse a multipart request. Larger uploads
+// are stored in temporary files.
+const maxFormMemory = 32 << 20
+
+// State of a job submitted through the server.
+type jobState string
+
+const (
+	queuedState  jobState = "queued"  // waiting in the queue
+	runningState jobState = "running" // dispatched to a pool
+	doneState    jobState = "done"    // finished, result available
+)
+
+// A serverJob is an internal structure keeping track of a job submitted to the
+// queue by the server.
+type serverJob struct {
+	// The job identifier, shared by the client and the queue.
+	Id string
+
+	// The task identifier, as given in the request.
+	Tid string
+
+	// The current state of the job.
+	State jobState
+
+	// Times at which the job was submitted, dispatched to a pool and finished.
+	// Started and Finished are zero until the corresponding event happens.
+	Submitted, Started, Finished time.Time
+
+	// The done message received from the queue. Only valid in done state.
+	Result pythia.Message
+
+	// The output received so far, if streamed. Replaced by the output of the
+	// result in done state.
+	Output string
+
+	// Number of times the job has been dispatched again, after the loss of
+	// its pool. Output is reset each time, as the job starts over.
+	restarts int
+
+	// Channel closed when the job reaches the done state.
+	done chan bool
+
+	// Channel closed, and replaced, each time some output is received or the
+	// job restarts.
+	updated chan bool
+}
+
+// A jobResponse is the JSON representation of a job sent to the client.
+type jobResponse struct {
+	Id     string        `json:"id"`
+	Tid    string        `json:"tid"`
+	State  jobState      `json:"state"`
+	Status pythia.Status `json:"status,omitempty"`
+	Limit  pythia.Limit  `json:"limit,omitempty"`
+	Output string        `json:"output,omitempty"`
+	Stderr string        `json:"stderr,omitempty"`
+
+	// Steps of the control file which did not succeed, once the job is done.
+	Steps []pythia.StepResult `json:"steps,omitempty"`
+
+	// Result files and JSON result document, once the job is done.
+	Files  map[string][]byte `json:"files,omitempty"`
+	Result json.RawMessage   `json:"result,omitempty"`
+
+	// Timing information. Times are omitted until the event happens.
+	Submitted *time.Time `json:"submitted,omitempty"`
+	Started   *time.Time `json:"started,omitempty"`
+	Finished  *time.Time `json:"finished,omitempty"`
+
+	// Time elapsed between submission and completion, in seconds.
+	Duration float64 `json:"duration,omitempty"`
+
+	// Resources used by the execution, once the job is done.
+	Usage *pythia.Usage `json:"usage,omitempty"`
+}
+
+// Response returns the JSON representation of the job. It shall be called
+// with the server mutex held.
+func (job *serverJob) response() jobResponse {
+	resp := jobResponse{
+		Id:     job.Id,
+		Tid:    job.Tid,
+		State:  job.State,
+		Status: job.Result.Status,
+		Limit:  job.Result.Limit,
+		Output: job.Result.Output,
+		Stderr: job.Result.Stderr,
+		Steps:  job.Result.Steps,
+		Files:  job.Result.Files,
+		Result: job.Result.Result,
+		Usage:  job.Result.Usage,
+	}
+	if job.State != doneState {
+		resp.Output = job.Output
+	}
+	if !job.Submitted.IsZero() {
+		t := job.Submitted
+		resp.Submitted = &t
+	}
+	if !job.Started.IsZero() {
+		t := job.Started
+		resp.Started = &t
+	}
+	if !job.Finished.IsZero() {
+		t := job.Finished
+		resp.Finished = &t
+		resp.Duration = job.Finished.Sub(job.Submitted).Seconds()
+	}
+	return resp
+}
+
+// StatusCode returns the HTTP status code corresponding to the result status
+// of a job executed synchronously:
+//
+//	success, timeout, overflow, crash, abort  200 OK
+//	error                                     503 Service Unavailable
+//	fatal                                     422 Unprocessable Entity
+//
+// Statuses due to the submitted code (e.g. an infinite loop causing a timeout)
+// are successful requests. An error is a (maybe temporary) platform failure,
+// such as a full queue, and the request may be retried later. A fatal error
+// means that the task cannot be executed at all (e.g. misformatted task).
+func statusCode(status pythia.Status) int {
+	switch status {
+	case pythia.Error:
+		return http.StatusServiceUnavailable
+	case pythia.Fatal:
+		return 422
+	default:
+		return http.StatusOK
+	}
 }
 
 // A Server is a component that allows client to execute tasks.
 //
 // New servers shall be created by the NewServer function.
 //
-// A Server connects to the Queue to execute the task, waits for its complete
-// execution and sends back the result to the client.
+// A Server keeps a single connection to the Queue, over which the jobs of all
+// clients are multiplexed. Clients may either wait for the complete execution
+// of a job (/execute), or submit a job and poll for its result later (/jobs).
+// The output of jobs submitted with streaming may also be followed while they
+// run (/jobs/{id}/output).
 type Server struct {
 	// The port number on which this server is listening.
 	Port int
+
+	// Path to the directory containing the tasks
+	TasksDir string
+
+	// How long the result of a finished job is kept for polling clients.
+	Retention time.Duration
+
+	// Session identifying the server to the queue. A random session is
+	// generated if empty.
+	Session string
+
+	// Connection to the queue
+	conn *pythia.Conn
+
+	// Jobs submitted through this server, mapped by id.
+	jobs map[string]*serverJob
+
+	// Jobs pending when the connection to the queue was lost, until the queue
+	// tells which of them it still knows. Nil if not resuming.
+	resuming map[string]bool
+
+	// Mutex protecting conn, jobs and resuming
+	mutex sync.Mutex
+
+	// Whether the server is shutting down
+	quitting bool
 }
 
 // NewServer returns a new server with default parameters.
 func NewServer() *Server {
 	server := new(Server)
 	server.Port = 8080
+	server.TasksDir = "tasks"
+	server.Retention = 10 * time.Minute
+	server.jobs = make(map[string]*serverJob)
 	return server
 }
 
 // Setup configures the server with the command line flags in args.
 func (server *Server) Setup(fs *flag.FlagSet, args []string) error {
 	fs.IntVar(&server.Port, "port", server.Port, "server port")
+	fs.StringVar(&server.TasksDir, "tasksdir", server.TasksDir, "tasks directory")
+	fs.DurationVar(&server.Retention, "retention", server.Retention,
+		"how long results of finished jobs are kept")
+	fs.StringVar(&server.Session, "session", server.Session,
+		"session identifying the server to the queue (default random)")
 	return fs.Parse(args)
 }
 
@@ -81,63 +272,501 @@ func (server *Server) Run() {
 		signal.Stop(ch)
 		os.Exit(0)
 	}()
+	// Connect to the queue
+	server.connect()
 	// Start the web server
-	http.HandleFunc("/execute", handler)
 	log.Println("Server listening on", server.Port)
-	if err := http.ListenAndServe(fmt.Sprint(":", server.Port), nil); err != nil {
+	if err := http.ListenAndServe(fmt.Sprint(":", server.Port), server.handler()); err != nil {
 		log.Fatal(err)
 	}
 }
 
 // Shut down the Server component.
 func (server *Server) Shutdown() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.quitting = true
+	if server.conn != nil {
+		server.conn.Close()
+	}
 }
 
-// Handler function for the server.
-func handler(rw http.ResponseWriter, req *http.Request) {
-	log.Println("Client connected: ", req.URL)
-	if req.Method != "POST" {
-		rw.WriteHeader(http.StatusMethodNotAllowed)
+// Connect establishes the connection to the queue, identifies the server with
+// its session and starts the goroutine receiving messages from it.
+func (server *Server) connect() {
+	if server.Session == "" {
+		session, err := newJobId()
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.Session = session
+	}
+	conn := pythia.DialRetry(pythia.QueueAddr)
+	log.Println("Connected to queue", pythia.QueueAddr)
+	conn.Send(pythia.Message{
+		Message: pythia.IdentifyMsg,
+		Session: server.Session,
+	})
+	server.mutex.Lock()
+	server.conn = conn
+	server.mutex.Unlock()
+	go server.receive(conn)
+}
+
+// Receive is a goroutine handling the messages sent by the queue on conn.
+// When the connection is lost, a new connection is established, and the
+// session is resumed to get the results of the pending jobs. When shutting
+// down, all pending jobs fail.
+func (server *Server) receive(conn *pythia.Conn) {
+	for msg := range conn.Receive() {
+		switch msg.Message {
+		case pythia.StartedMsg:
+			server.mutex.Lock()
+			if job := server.jobs[msg.Id]; job != nil && job.State == queuedState {
+				job.State = runningState
+				job.Started = time.Now()
+			} else if job != nil && job.State == runningState {
+				// The job has been rescheduled after the loss of its pool,
+				// and its output starts over.
+				job.Started = time.Now()
+				job.Output = ""
+				job.restarts++
+				close(job.updated)
+				job.updated = make(chan bool)
+			}
+			server.mutex.Unlock()
+		case pythia.OutputMsg:
+			server.mutex.Lock()
+			if job := server.jobs[msg.Id]; job != nil && job.State != doneState {
+				job.Output += msg.Output
+				close(job.updated)
+				job.updated = make(chan bool)
+			}
+			server.mutex.Unlock()
+		case pythia.DoneMsg:
+			server.finish(msg)
+		case pythia.IdentifyMsg:
+			server.resume(msg.Jobs)
+		default:
+			log.Println("Ignoring message", msg)
+		}
+	}
+	server.mutex.Lock()
+	quitting := server.quitting
+	server.resuming = make(map[string]bool)
+	for id, job := range server.jobs {
+		if job.State != doneState {
+			server.resuming[id] = true
+		}
+	}
+	server.mutex.Unlock()
+	if quitting {
+		server.resume(nil)
+	} else {
+		log.Println("Connection to queue lost, reconnecting.")
+		server.connect()
+	}
+}
+
+// Resume fails the jobs that were pending when the connection to the queue was
+// lost and that the queue does not know anymore (known lists the jobs it
+// knows), e.g. because the queue has restarted without journal.
+func (server *Server) resume(known []string) {
+	server.mutex.Lock()
+	lost := server.resuming
+	server.resuming = nil
+	for _, id := range known {
+		delete(lost, id)
+	}
+	for id := range lost {
+		if job := server.jobs[id]; job == nil || job.State == doneState {
+			// The result has been delivered when resuming.
+			delete(lost, id)
+		}
+	}
+	server.mutex.Unlock()
+	for id := range lost {
+		server.finish(pythia.Message{
+			Message: pythia.DoneMsg,
+			Id:      id,
+			Status:  pythia.Error,
+			Output:  "Connection to queue lost",
+		})
+	}
+}
+
+// Finish records the result of a job and wakes up the clients waiting for it.
+// The job is forgotten after the retention period.
+func (server *Server) finish(msg pythia.Message) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	job := server.jobs[msg.Id]
+	if job == nil || job.State == doneState {
+		log.Println("Ignoring result for unknown job", msg)
 		return
 	}
-	// Reading the task request
+	log.Print("Job ", msg.Id, ": done with status ", msg.Status)
+	job.State = doneState
+	job.Result = msg
+	job.Finished = time.Now()
+	close(job.done)
+	time.AfterFunc(server.Retention, func() {
+		server.forget(job.Id)
+	})
+}
+
+// Forget removes a job from the list of known jobs.
+func (server *Server) forget(id string) {
+	server.mutex.Lock()
+	delete(server.jobs, id)
+	server.mutex.Unlock()
+}
+
+// Submit reads the task description of the request and sends a launch
+// message to the queue. On error, it returns the result status describing the
+// failure (see statusCode).
+func (server *Server) submit(taskReq taskRequest) (*serverJob, pythia.Status, error) {
+	if taskReq.Tid == "" || strings.ContainsAny(taskReq.Tid, "/\\") {
+		return nil, pythia.Fatal, errors.New("Invalid task identifier")
+	}
+	if err := pythia.CheckFiles(taskReq.Files); err != nil {
+		return nil, pythia.Fatal, err
+	}
+	content, err := ioutil.ReadFile(path.Join(server.TasksDir, taskReq.Tid+".task"))
+	if err != nil {
+		return nil, pythia.Fatal, err
+	}
+	var task pythia.Task
+	if err := json.Unmarshal(content, &task); err != nil {
+		return nil, pythia.Fatal, err
+	}
+	id, err := newJobId()
+	if err != nil {
+		return nil, pythia.Error, err
+	}
+	job := &serverJob{
+		Id:        id,
+		Tid:       taskReq.Tid,
+		State:     queuedState,
+		Submitted: time.Now(),
+		done:      make(chan bool),
+		updated:   make(chan bool),
+	}
+	server.mutex.Lock()
+	server.jobs[id] = job
+	conn := server.conn
+	server.mutex.Unlock()
+	log.Print("Job ", id, ": submitting task ", taskReq.Tid)
+	err = conn.Send(pythia.Message{
+		Message:  pythia.LaunchMsg,
+		Id:       id,
+		Task:     &task,
+		Input:    taskReq.Response,
+		Files:    taskReq.Files,
+		Priority: taskReq.Priority,
+		Notify:   true,
+		Stream:   taskReq.Stream,
+	})
+	if err != nil {
+		server.forget(id)
+		return nil, pythia.Error, err
+	}
+	return job, "", nil
+}
+
+// Lookup returns a snapshot of the job with identifier id, or false if there
+// is no such job.
+func (server *Server) lookup(id string) (jobResponse, bool) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	job := server.jobs[id]
+	if job == nil {
+		return jobResponse{}, false
+	}
+	return job.response(), true
+}
+
+// NewJobId generates a random job identifier.
+func newJobId() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Handler returns the HTTP handler serving all the routes of the server.
+func (server *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/execute", server.executeHandler)
+	mux.HandleFunc("/jobs", server.jobsHandler)
+	mux.HandleFunc("/jobs/", server.jobHandler)
+	return mux
+}
+
+// ReadTaskRequest parses the body of req, either a JSON object or a multipart
+// form. On error, the response is written and false is returned.
+func readTaskRequest(rw http.ResponseWriter, req *http.Request) (taskRequest, bool) {
+	var taskReq taskRequest
+	mediatype, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediatype == "multipart/form-data" {
+		return readMultipartTaskRequest(rw, req)
+	}
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		rw.WriteHeader(http.StatusInternalServerError)
-		return
+		return taskReq, false
+	}
+	if err := json.Unmarshal(body, &taskReq); err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return taskReq, false
 	}
+	return taskReq, true
+}
+
+// ReadMultipartTaskRequest parses a multipart/form-data body, whose tid,
+// response, priority and stream fields hold the task request, and whose files are the
+// input files, named by their form field. On error, the response is written
+// and false is returned.
+func readMultipartTaskRequest(rw http.ResponseWriter, req *http.Request) (taskRequest, bool) {
 	var taskReq taskRequest
-	if err := json.Unmarshal([]byte(body), &taskReq); err != nil {
+	if err := req.ParseMultipartForm(maxFormMemory); err != nil {
 		rw.WriteHeader(http.StatusBadRequest)
+		return taskReq, false
+	}
+	defer req.MultipartForm.RemoveAll()
+	taskReq.Tid = req.FormValue("tid")
+	taskReq.Response = req.FormValue("response")
+	if priority := req.FormValue("priority"); priority != "" {
+		var err error
+		if taskReq.Priority, err = strconv.Atoi(priority); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return taskReq, false
+		}
+	}
+	if stream := req.FormValue("stream"); stream != "" {
+		var err error
+		if taskReq.Stream, err = strconv.ParseBool(stream); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return taskReq, false
+		}
+	}
+	for name, headers := range req.MultipartForm.File {
+		if len(headers) != 1 {
+			rw.WriteHeader(http.StatusBadRequest)
+			return taskReq, false
+		}
+		f, err := headers[0].Open()
+		if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return taskReq, false
+		}
+		content, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return taskReq, false
+		}
+		if taskReq.Files == nil {
+			taskReq.Files = make(map[string][]byte)
+		}
+		taskReq.Files[name] = content
+	}
+	return taskReq, true
+}
+
+// WriteSubmitError sends the failure to submit a job to the client, in the same
+// format as the result of a job.
+func writeSubmitError(rw http.ResponseWriter, taskReq taskRequest, status pythia.Status, err error) {
+	log.Println(err)
+	writeJSON(rw, statusCode(status), jobResponse{
+		Tid:    taskReq.Tid,
+		State:  doneState,
+		Status: status,
+		Output: err.Error(),
+	})
+}
+
+// WriteJSON writes v as the JSON body of the response with the given code.
+func writeJSON(rw http.ResponseWriter, code int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	if err := json.NewEncoder(rw).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+// ExecuteHandler executes a task and waits for its completion. The result is
+// sent as a JSON object, with the HTTP status code given by statusCode. If the
+// client disconnects before, the job is aborted, as nobody would get its
+// result.
+func (server *Server) executeHandler(rw http.ResponseWriter, req *http.Request) {
+	log.Println("Client connected: ", req.URL)
+	if req.Method != "POST" {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-	// Connection to the pool and execution of the task
-	conn := pythia.DialRetry(pythia.QueueAddr)
-	defer conn.Close()
-	content, err := ioutil.ReadFile("tasks/" + taskReq.Tid + ".task")
+	taskReq, ok := readTaskRequest(rw, req)
+	if !ok {
+		return
+	}
+	job, status, err := server.submit(taskReq)
 	if err != nil {
-		rw.WriteHeader(422)
+		writeSubmitError(rw, taskReq, status, err)
 		return
 	}
-	var task pythia.Task
-	if err := json.Unmarshal([]byte(content), &task); err != nil {
-		rw.WriteHeader(http.StatusInternalServerError)
+	select {
+	case <-job.done:
+	case <-req.Context().Done():
+		server.mutex.Lock()
+		conn := server.conn
+		server.mutex.Unlock()
+		log.Print("Job ", job.Id, ": client disconnected, aborting.")
+		if err := conn.Send(pythia.Message{Message: pythia.AbortMsg, Id: job.Id}); err != nil {
+			log.Println(err)
+		}
+		server.forget(job.Id)
 		return
 	}
-	conn.Send(pythia.Message{
-		Message: pythia.LaunchMsg,
-		Id:      "test",
-		Task:    &task,
-		Input:   taskReq.Response,
-	})
-	if msg, ok := <-conn.Receive(); ok {
-		switch msg.Status {
-		case "success":
-			fmt.Fprintf(rw, msg.Output)
+	resp, _ := server.lookup(job.Id)
+	server.forget(job.Id)
+	writeJSON(rw, statusCode(resp.Status), resp)
+}
+
+// JobsHandler submits a new job (POST /jobs) and returns its identifier
+// without waiting for the execution.
+func (server *Server) jobsHandler(rw http.ResponseWriter, req *http.Request) {
+	log.Println("Client connected: ", req.URL)
+	if req.Method != "POST" {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	taskReq, ok := readTaskRequest(rw, req)
+	if !ok {
+		return
+	}
+	job, status, err := server.submit(taskReq)
+	if err != nil {
+		writeSubmitError(rw, taskReq, status, err)
+		return
+	}
+	rw.Header().Set("Location", "/jobs/"+job.Id)
+	resp, _ := server.lookup(job.Id)
+	writeJSON(rw, http.StatusAccepted, resp)
+}
+
+// JobHandler returns the state of a job (GET /jobs/{id}) or aborts it
+// (DELETE /jobs/{id}). Contrary to /execute, the HTTP status code does not
+// depend on the result status of the job.
+func (server *Server) jobHandler(rw http.ResponseWriter, req *http.Request) {
+	log.Println("Client connected: ", req.URL)
+	id := strings.TrimPrefix(req.URL.Path, "/jobs/")
+	if strings.HasSuffix(id, "/output") {
+		server.outputHandler(rw, req, strings.TrimSuffix(id, "/output"))
+		return
+	}
+	resp, ok := server.lookup(id)
+	if !ok {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch req.Method {
+	case "GET":
+		writeJSON(rw, http.StatusOK, resp)
+	case "DELETE":
+		if resp.State == doneState {
+			writeJSON(rw, http.StatusOK, resp)
+			return
 		}
+		server.mutex.Lock()
+		conn := server.conn
+		server.mutex.Unlock()
+		log.Print("Job ", id, ": aborting.")
+		if err := conn.Send(pythia.Message{Message: pythia.AbortMsg, Id: id}); err != nil {
+			log.Println(err)
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(rw, http.StatusAccepted, resp)
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// OutputHandler follows the output of a job (GET /jobs/{id}/output) as a
+// stream of server-sent events. Each output event holds the next chunk of the
+// output as a JSON string, starting with the output received so far. A restart
+// event tells that the job has been dispatched again after the loss of its
+// pool: the output received before is void, and the next output events start
+// over. A final done event holds the job, as returned by GET /jobs/{id}, whose
+// output is the complete output. Only the jobs submitted with streaming have
+// output and restart events.
+func (server *Server) outputHandler(rw http.ResponseWriter, req *http.Request, id string) {
+	if req.Method != "GET" {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	server.mutex.Lock()
+	job := server.jobs[id]
+	server.mutex.Unlock()
+	if job == nil {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	flusher, _ := rw.(http.Flusher)
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	server.mutex.Lock()
+	sent, restarts := 0, job.restarts
+	server.mutex.Unlock()
+	for {
+		server.mutex.Lock()
+		restarted := job.restarts != restarts
+		if restarted {
+			sent, restarts = 0, job.restarts
+		}
+		updated := job.updated
+		var output string
+		var resp *jobResponse
+		if job.State == doneState {
+			r := job.response()
+			resp = &r
+		} else {
+			output = job.Output[sent:]
+		}
+		server.mutex.Unlock()
+		if resp != nil {
+			writeEvent(rw, "done", resp)
+			return
+		}
+		if restarted {
+			writeEvent(rw, "restart", nil)
+		}
+		if output != "" {
+			writeEvent(rw, "output", output)
+			sent += len(output)
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case <-updated:
+		case <-job.done:
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// WriteEvent writes a server-sent event whose data is the JSON encoding of v.
+func writeEvent(rw http.ResponseWriter, event string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err)
 		return
 	}
-	rw.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(rw, "event: %s\ndata: %s\n\n", event, data)
 }
 
 // vim:set sw=4 ts=4 noet:
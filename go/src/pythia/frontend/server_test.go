@@ -0,0 +1,515 @@
+// Copyright 2015-2016 The Pythia Authors.
+// This file is part of Pythia.
+//
+// Pythia is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, version 3 of the License.
+//
+// Pythia is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Pythia.  If not, see <http://www.gnu.org/licenses/>.
+
+package frontend
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"pythia"
+	"strings"
+	"testing"
+	"testutils"
+	"testutils/pytest"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Fixture
+
+// ServerFixture contains the common elements for server tests.
+type ServerFixture struct {
+	// Mock queue component
+	Queue *pythia.Listener
+
+	// Server component
+	Server *Server
+
+	// HTTP test server wrapping the server handler
+	Http *httptest.Server
+
+	// Server->Queue connection
+	Conn *pytest.Conn
+}
+
+// Setup an environment for testing the Server component.
+func SetupServerFixture(t *testing.T) *ServerFixture {
+	var err error
+	f := new(ServerFixture)
+	// Setup mock queue
+	t.Log("Setup queue")
+	addr, err := pythia.LocalAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pythia.QueueAddr = addr
+	f.Queue, err = pythia.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Setup server
+	t.Log("Setup server")
+	f.Server = NewServer()
+	f.Server.TasksDir = pytest.TasksDir
+	f.Server.Session = "test"
+	go f.Server.connect()
+	f.Accept(t)
+	f.Http = httptest.NewServer(f.Server.handler())
+	return f
+}
+
+// Accept accepts the connection of the server, which shall identify itself.
+func (f *ServerFixture) Accept(t *testing.T) {
+	conn, err := f.Queue.Accept()
+	if err != nil {
+		f.Queue.Close()
+		t.Fatal(err)
+	}
+	f.Conn = &pytest.Conn{T: t, Conn: conn}
+	f.Conn.Expect(1, pythia.Message{
+		Message: pythia.IdentifyMsg,
+		Session: "test",
+	})
+}
+
+// TearDown tears down the fixture, closing the connections and shutting down
+// the components.
+func (f *ServerFixture) TearDown() {
+	f.Http.Close()
+	f.Server.Shutdown()
+	f.Conn.Close()
+	f.Queue.Close()
+}
+
+// Do performs an HTTP request on the server and decodes the JSON response in
+// v (if not nil). It returns the HTTP status code.
+func (f *ServerFixture) Do(t *testing.T, method, path, body string, v interface{}) int {
+	req, err := http.NewRequest(method, f.Http.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Error(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// WaitState polls the job until it reaches the given state.
+func (f *ServerFixture) WaitState(t *testing.T, id string, state jobState) (resp jobResponse) {
+	for i := 0; i < 100; i++ {
+		f.Do(t, "GET", "/jobs/"+id, "", &resp)
+		if resp.State == state {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Job %s did not reach state %s (last state %s).", id, state, resp.State)
+	return
+}
+
+// Receive waits for the next message sent by the server to the queue.
+// Fail if nothing is received within one second.
+func (f *ServerFixture) Receive(t *testing.T) (msg pythia.Message) {
+	select {
+	case msg = <-f.Conn.Conn.Receive():
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for a message from the server.")
+	}
+	return
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Tests
+
+func TestServerJobLifecycle(t *testing.T) {
+	task := pytest.ReadTask(t, "hello-world")
+	f := SetupServerFixture(t)
+	var submitted jobResponse
+	code := f.Do(t, "POST", "/jobs", `{"tid": "hello-world", "response": "in"}`,
+		&submitted)
+	testutils.Expect(t, "code", http.StatusAccepted, code)
+	testutils.Expect(t, "state", queuedState, submitted.State)
+	id := submitted.Id
+	f.Conn.Expect(1, pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      id,
+		Task:    &task,
+		Input:   "in",
+		Notify:  true,
+	})
+	f.Conn.Send(pythia.Message{Message: pythia.StartedMsg, Id: id})
+	f.WaitState(t, id, runningState)
+	usage := pythia.Usage{WallTime: 1.5, CpuTime: 0.5, MaxRss: 1024, Output: 13}
+	f.Conn.Send(pythia.Message{
+		Message: pythia.DoneMsg,
+		Id:      id,
+		Status:  pythia.Success,
+		Output:  "Hello world!\n",
+		Usage:   &usage,
+	})
+	resp := f.WaitState(t, id, doneState)
+	testutils.Expect(t, "tid", "hello-world", resp.Tid)
+	testutils.Expect(t, "status", pythia.Success, resp.Status)
+	testutils.Expect(t, "output", "Hello world!\n", resp.Output)
+	testutils.Expect(t, "usage", &usage, resp.Usage)
+	if resp.Submitted == nil || resp.Started == nil || resp.Finished == nil {
+		t.Error("Missing timing information", resp)
+	}
+	f.TearDown()
+}
+
+func TestServerJobAbort(t *testing.T) {
+	task := pytest.ReadTask(t, "hello-world")
+	f := SetupServerFixture(t)
+	var submitted jobResponse
+	f.Do(t, "POST", "/jobs", `{"tid": "hello-world"}`, &submitted)
+	id := submitted.Id
+	f.Conn.Expect(1, pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      id,
+		Task:    &task,
+		Notify:  true,
+	})
+	code := f.Do(t, "DELETE", "/jobs/"+id, "", nil)
+	testutils.Expect(t, "code", http.StatusAccepted, code)
+	f.Conn.Expect(1, pythia.Message{Message: pythia.AbortMsg, Id: id})
+	f.Conn.Send(pythia.Message{
+		Message: pythia.DoneMsg,
+		Id:      id,
+		Status:  pythia.Abort,
+	})
+	resp := f.WaitState(t, id, doneState)
+	testutils.Expect(t, "status", pythia.Abort, resp.Status)
+	f.TearDown()
+}
+
+func TestServerUnknownJob(t *testing.T) {
+	f := SetupServerFixture(t)
+	code := f.Do(t, "GET", "/jobs/unknown", "", nil)
+	testutils.Expect(t, "code", http.StatusNotFound, code)
+	code = f.Do(t, "POST", "/jobs", `{"tid": "does-not-exist"}`, nil)
+	testutils.Expect(t, "code", 422, code)
+	f.TearDown()
+}
+
+func TestServerExecuteStatus(t *testing.T) {
+	task := pytest.ReadTask(t, "hello-world")
+	f := SetupServerFixture(t)
+	for status, code := range map[pythia.Status]int{
+		pythia.Success: http.StatusOK,
+		pythia.Timeout: http.StatusOK,
+		pythia.Crash:   http.StatusOK,
+		pythia.Error:   http.StatusServiceUnavailable,
+		pythia.Fatal:   422,
+	} {
+		done := make(chan bool)
+		go func(status pythia.Status, code int) {
+			var resp jobResponse
+			c := f.Do(t, "POST", "/execute", `{"tid": "hello-world"}`, &resp)
+			testutils.Expect(t, "code", code, c)
+			testutils.Expect(t, "status", status, resp.Status)
+			testutils.Expect(t, "output", "out", resp.Output)
+			done <- true
+		}(status, code)
+		msg := f.Receive(t)
+		testutils.Expect(t, "launch", pythia.Message{
+			Message: pythia.LaunchMsg,
+			Id:      msg.Id,
+			Task:    &task,
+			Notify:  true,
+		}, msg)
+		f.Conn.Send(pythia.Message{
+			Message: pythia.DoneMsg,
+			Id:      msg.Id,
+			Status:  status,
+			Output:  "out",
+		})
+		<-done
+	}
+	f.TearDown()
+}
+
+func TestServerExecuteDisconnect(t *testing.T) {
+	f := SetupServerFixture(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequest("POST", f.Http.URL+"/execute",
+		strings.NewReader(`{"tid": "hello-world"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan bool)
+	go func() {
+		if _, err := http.DefaultClient.Do(req.WithContext(ctx)); err == nil {
+			t.Error("Request not cancelled")
+		}
+		done <- true
+	}()
+	msg := f.Receive(t)
+	testutils.Expect(t, "message", pythia.LaunchMsg, msg.Message)
+	// The job is aborted and forgotten once the client has left.
+	cancel()
+	<-done
+	f.Conn.Expect(1, pythia.Message{Message: pythia.AbortMsg, Id: msg.Id})
+	known := true
+	for i := 0; i < 100 && known; i++ {
+		_, known = f.Server.lookup(msg.Id)
+		time.Sleep(time.Millisecond)
+	}
+	if known {
+		t.Error("Job", msg.Id, "not forgotten")
+	}
+	f.TearDown()
+}
+
+func TestServerInputFiles(t *testing.T) {
+	task := pytest.ReadTask(t, "hello-world")
+	f := SetupServerFixture(t)
+	files := map[string][]byte{
+		"main.c":   []byte("int main;\n"),
+		"data/bin": {0, 1, 2, 255},
+	}
+	// Files are given either base64-encoded in JSON or as a multipart form.
+	var form bytes.Buffer
+	w := multipart.NewWriter(&form)
+	w.WriteField("tid", "hello-world")
+	w.WriteField("response", "in")
+	for name, content := range files {
+		fw, err := w.CreateFormFile(name, path.Base(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(content)
+	}
+	w.Close()
+	for _, body := range []struct {
+		contentType, content string
+	}{
+		{"application/json", `{"tid": "hello-world", "response": "in", "files": ` +
+			`{"main.c": "aW50IG1haW47Cg==", "data/bin": "AAEC/w=="}}`},
+		{w.FormDataContentType(), form.String()},
+	} {
+		resp, err := http.Post(f.Http.URL+"/jobs", body.contentType,
+			strings.NewReader(body.content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var submitted jobResponse
+		json.NewDecoder(resp.Body).Decode(&submitted)
+		resp.Body.Close()
+		testutils.Expect(t, "code", http.StatusAccepted, resp.StatusCode)
+		f.Conn.Expect(1, pythia.Message{
+			Message: pythia.LaunchMsg,
+			Id:      submitted.Id,
+			Task:    &task,
+			Input:   "in",
+			Files:   files,
+			Notify:  true,
+		})
+	}
+	// Invalid file names are rejected.
+	code := f.Do(t, "POST", "/jobs",
+		`{"tid": "hello-world", "files": {"../a": ""}}`, nil)
+	testutils.Expect(t, "code", 422, code)
+	f.TearDown()
+}
+
+func TestServerStream(t *testing.T) {
+	task := pytest.ReadTask(t, "hello-world")
+	f := SetupServerFixture(t)
+	var submitted jobResponse
+	f.Do(t, "POST", "/jobs", `{"tid": "hello-world", "stream": true}`, &submitted)
+	id := submitted.Id
+	f.Conn.Expect(1, pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      id,
+		Task:    &task,
+		Notify:  true,
+		Stream:  true,
+	})
+	f.Conn.Send(pythia.Message{Message: pythia.StartedMsg, Id: id})
+	f.Conn.Send(pythia.Message{Message: pythia.OutputMsg, Id: id, Output: "a\n"})
+	// The output received so far is shown while the job is running.
+	for i := 0; i < 100; i++ {
+		if resp, _ := f.Server.lookup(id); resp.Output != "" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	resp, _ := f.Server.lookup(id)
+	testutils.Expect(t, "output", "a\n", resp.Output)
+	stream, err := http.Get(f.Http.URL + "/jobs/" + id + "/output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Body.Close()
+	testutils.Expect(t, "content type", "text/event-stream",
+		stream.Header.Get("Content-Type"))
+	f.Conn.Send(pythia.Message{Message: pythia.OutputMsg, Id: id, Output: "b\r"})
+	f.Conn.Send(pythia.Message{
+		Message: pythia.DoneMsg,
+		Id:      id,
+		Status:  pythia.Success,
+		Output:  "a\nb\rc",
+	})
+	body, err := ioutil.ReadAll(stream.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := strings.Split(strings.TrimSuffix(string(body), "\n\n"), "\n\n")
+	var output string
+	for _, event := range events[:len(events)-1] {
+		var chunk string
+		if !strings.HasPrefix(event, "event: output\ndata: ") ||
+			json.Unmarshal([]byte(event[len("event: output\ndata: "):]), &chunk) != nil {
+			t.Fatal("Invalid output event", event)
+		}
+		output += chunk
+	}
+	// Chunks may arrive after the end of the job, but the done event has the
+	// complete output.
+	if !strings.HasPrefix("a\nb\r", output) || output == "" {
+		t.Errorf("Unexpected streamed output %q", output)
+	}
+	last := events[len(events)-1]
+	if !strings.HasPrefix(last, "event: done\ndata: ") {
+		t.Fatal("Invalid done event", last)
+	}
+	var done jobResponse
+	if err := json.Unmarshal([]byte(last[len("event: done\ndata: "):]), &done); err != nil {
+		t.Fatal(err)
+	}
+	testutils.Expect(t, "status", pythia.Success, done.Status)
+	testutils.Expect(t, "output", "a\nb\rc", done.Output)
+	f.TearDown()
+}
+
+func TestServerStreamRestart(t *testing.T) {
+	task := pytest.ReadTask(t, "hello-world")
+	f := SetupServerFixture(t)
+	var submitted jobResponse
+	f.Do(t, "POST", "/jobs", `{"tid": "hello-world", "stream": true}`, &submitted)
+	id := submitted.Id
+	f.Conn.Expect(1, pythia.Message{
+		Message: pythia.LaunchMsg,
+		Id:      id,
+		Task:    &task,
+		Notify:  true,
+		Stream:  true,
+	})
+	f.Conn.Send(pythia.Message{Message: pythia.StartedMsg, Id: id})
+	f.Conn.Send(pythia.Message{Message: pythia.OutputMsg, Id: id, Output: "stale"})
+	stream, err := http.Get(f.Http.URL + "/jobs/" + id + "/output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Body.Close()
+	reader := bufio.NewReader(stream.Body)
+	// ReadEvent returns the next event of the stream.
+	readEvent := func() string {
+		var event string
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line == "\n" {
+				return event
+			}
+			event += line
+		}
+	}
+	testutils.Expect(t, "event", "event: output\ndata: \"stale\"\n", readEvent())
+	// The job is dispatched again after the loss of its pool.
+	f.Conn.Send(pythia.Message{Message: pythia.StartedMsg, Id: id})
+	testutils.Expect(t, "event", "event: restart\ndata: null\n", readEvent())
+	resp, _ := f.Server.lookup(id)
+	testutils.Expect(t, "state", runningState, resp.State)
+	testutils.Expect(t, "output", "", resp.Output)
+	f.Conn.Send(pythia.Message{Message: pythia.OutputMsg, Id: id, Output: "a\n"})
+	testutils.Expect(t, "event", "event: output\ndata: \"a\\n\"\n", readEvent())
+	f.Conn.Send(pythia.Message{
+		Message: pythia.DoneMsg,
+		Id:      id,
+		Status:  pythia.Success,
+		Output:  "a\nb\n",
+	})
+	event := readEvent()
+	if !strings.HasPrefix(event, "event: done\ndata: ") {
+		t.Fatal("Invalid done event", event)
+	}
+	var done jobResponse
+	if err := json.Unmarshal([]byte(event[len("event: done\ndata: "):]), &done); err != nil {
+		t.Fatal(err)
+	}
+	testutils.Expect(t, "output", "a\nb\n", done.Output)
+	f.TearDown()
+}
+
+func TestServerResume(t *testing.T) {
+	f := SetupServerFixture(t)
+	var ids []string
+	for i := 0; i < 3; i++ {
+		var submitted jobResponse
+		f.Do(t, "POST", "/jobs", `{"tid": "hello-world"}`, &submitted)
+		msg := f.Receive(t)
+		testutils.Expect(t, "id", submitted.Id, msg.Id)
+		ids = append(ids, submitted.Id)
+	}
+	// Drop the connection. The server shall reconnect and resume its session.
+	f.Conn.Conn.Close()
+	f.Accept(t)
+	// The result of the first job is delivered on resumption, the second job
+	// is still known by the queue, and the third one has been lost.
+	f.Conn.Send(pythia.Message{
+		Message: pythia.DoneMsg,
+		Id:      ids[0],
+		Status:  pythia.Success,
+	})
+	f.Conn.Send(pythia.Message{
+		Message: pythia.IdentifyMsg,
+		Session: "test",
+		Jobs:    ids[1:2],
+	})
+	resp := f.WaitState(t, ids[0], doneState)
+	testutils.Expect(t, "status", pythia.Success, resp.Status)
+	resp = f.WaitState(t, ids[2], doneState)
+	testutils.Expect(t, "status", pythia.Error, resp.Status)
+	resp, _ = f.Server.lookup(ids[1])
+	testutils.Expect(t, "state", queuedState, resp.State)
+	f.Conn.Send(pythia.Message{
+		Message: pythia.DoneMsg,
+		Id:      ids[1],
+		Status:  pythia.Success,
+	})
+	resp = f.WaitState(t, ids[1], doneState)
+	testutils.Expect(t, "status", pythia.Success, resp.Status)
+	f.TearDown()
+}
+
+// vim:set sw=4 ts=4 noet:
@@ -0,0 +1,265 @@
+// Copyright 2013 The Pythia Authors.
+// This file is part of Pythia.
+//
+// Pythia is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, version 3 of the License.
+//
+// Pythia is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Pythia.  If not, see <http://www.gnu.org/licenses/>.
+
+package frontend
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"pythia"
+	"sort"
+	"strconv"
+	"time"
+)
+
+func init() {
+	pythia.Components["submit"] = pythia.ComponentInfo{
+		Name:        "submit",
+		Description: "Submit jobs to a running queue and print their results",
+		New:         func() pythia.Component { return NewSubmit() },
+	}
+}
+
+// A submitResult is the result of the job executed for an input file.
+type submitResult struct {
+	Input  string              `json:"input"`
+	Status pythia.Status       `json:"status"`
+	Limit  pythia.Limit        `json:"limit,omitempty"`
+	Output string              `json:"output"`
+	Stderr string              `json:"stderr,omitempty"`
+	Steps  []pythia.StepResult `json:"steps,omitempty"`
+	Files  map[string][]byte   `json:"files,omitempty"`
+	Result json.RawMessage     `json:"result,omitempty"`
+	Usage  *pythia.Usage       `json:"usage,omitempty"`
+}
+
+// A Submit is a component that launches a task with one or several inputs
+// through the queue, waits for the results and prints them. This exercises
+// the same path as the jobs submitted by front-ends.
+//
+// New submit components shall be created by the NewSubmit function.
+type Submit struct {
+	// Priority of the jobs
+	Priority int
+
+	// Whether to print the results as JSON
+	JSON bool
+
+	// How long to wait for the results, or 0 to wait forever
+	Timeout time.Duration
+
+	// The task to launch
+	task pythia.Task
+
+	// Names and contents of the input files
+	names, inputs []string
+
+	// Files given to every job in its input directory
+	files map[string][]byte
+
+	// Connection to the queue
+	conn *pythia.Conn
+
+	// Where to print the results
+	out io.Writer
+}
+
+// NewSubmit returns a new submit component with default parameters.
+func NewSubmit() *Submit {
+	submit := new(Submit)
+	submit.out = os.Stdout
+	return submit
+}
+
+// Setup configures the submit component with the command line flags in args,
+// and reads the task and input files. Input files are given as positional
+// arguments. If there are none, the input is read from the standard input.
+func (submit *Submit) Setup(fs *flag.FlagSet, args []string) error {
+	taskfile := fs.String("task", "", "path to the task description (mandatory)")
+	filesdir := fs.String("files", "", "directory containing input files given to every job")
+	fs.IntVar(&submit.Priority, "priority", submit.Priority, "priority of the jobs")
+	fs.BoolVar(&submit.JSON, "json", submit.JSON, "print the results as JSON")
+	fs.DurationVar(&submit.Timeout, "timeout", submit.Timeout,
+		"how long to wait for the results (0 for no limit)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(*taskfile) == 0 {
+		return errors.New("Missing task file")
+	}
+	taskcontent, err := ioutil.ReadFile(*taskfile)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(taskcontent, &submit.task); err != nil {
+		return err
+	}
+	if len(*filesdir) > 0 {
+		if submit.files, err = pythia.ReadFiles(*filesdir); err != nil {
+			return err
+		}
+	}
+	submit.names = fs.Args()
+	if len(submit.names) == 0 {
+		content, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		submit.names = []string{"-"}
+		submit.inputs = []string{string(content)}
+		return nil
+	}
+	for _, name := range submit.names {
+		content, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		submit.inputs = append(submit.inputs, string(content))
+	}
+	return nil
+}
+
+// Run submits the jobs and prints their results. The program exits with a
+// non-zero status if a job does not succeed.
+func (submit *Submit) Run() {
+	ok, err := submit.run()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "submit:", err)
+		os.Exit(2)
+	} else if !ok {
+		os.Exit(1)
+	}
+}
+
+// Run submits the jobs and prints their results. It returns whether all jobs
+// succeeded.
+func (submit *Submit) run() (bool, error) {
+	conn := pythia.DialRetry(pythia.QueueAddr)
+	defer conn.Close()
+	submit.conn = conn
+	for i, input := range submit.inputs {
+		err := conn.Send(pythia.Message{
+			Message:  pythia.LaunchMsg,
+			Id:       strconv.Itoa(i),
+			Task:     &submit.task,
+			Input:    input,
+			Files:    submit.files,
+			Priority: submit.Priority,
+		})
+		if err != nil {
+			return false, err
+		}
+	}
+	results := make([]*submitResult, len(submit.inputs))
+	var timeout <-chan time.Time
+	if submit.Timeout > 0 {
+		timeout = time.After(submit.Timeout)
+	}
+	for remaining := len(results); remaining > 0; {
+		select {
+		case msg, ok := <-conn.Receive():
+			if !ok {
+				return false, errors.New("Connection to queue lost")
+			}
+			i, err := strconv.Atoi(msg.Id)
+			if msg.Message != pythia.DoneMsg || err != nil || i < 0 ||
+				i >= len(results) || results[i] != nil {
+				log.Println("Ignoring message", msg)
+				continue
+			}
+			results[i] = &submitResult{
+				Input:  submit.names[i],
+				Status: msg.Status,
+				Limit:  msg.Limit,
+				Output: msg.Output,
+				Stderr: msg.Stderr,
+				Steps:  msg.Steps,
+				Files:  msg.Files,
+				Result: msg.Result,
+				Usage:  msg.Usage,
+			}
+			remaining--
+		case <-timeout:
+			return false, errors.New("Timed out waiting for the results")
+		}
+	}
+	ok := true
+	for _, result := range results {
+		ok = ok && result.Status == pythia.Success
+	}
+	return ok, submit.print(results)
+}
+
+// Print prints the results of the jobs.
+func (submit *Submit) print(results []*submitResult) error {
+	if submit.JSON {
+		b, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(submit.out, "%s\n", b)
+		return err
+	}
+	for i, result := range results {
+		if i > 0 {
+			fmt.Fprintln(submit.out)
+		}
+		fmt.Fprintln(submit.out, "Input:", result.Input)
+		fmt.Fprintln(submit.out, "Status:", result.Status)
+		if result.Limit != "" {
+			fmt.Fprintln(submit.out, "Limit:", result.Limit)
+		}
+		for _, step := range result.Steps {
+			fmt.Fprintln(submit.out, "Step:", step)
+		}
+		fmt.Fprintln(submit.out, "Output:", result.Output)
+		if result.Stderr != "" {
+			fmt.Fprintln(submit.out, "Stderr:", result.Stderr)
+		}
+		if result.Result != nil {
+			fmt.Fprintln(submit.out, "Result:", string(result.Result))
+		}
+		var names []string
+		for name := range result.Files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(submit.out, "File: %s (%d bytes)\n", name,
+				len(result.Files[name]))
+		}
+		if u := result.Usage; u != nil {
+			fmt.Fprintf(submit.out, "Usage: %.3fs wall, %.3fs CPU, %d KB max RSS, "+
+				"%d bytes output\n", u.WallTime, u.CpuTime, u.MaxRss, u.Output)
+		}
+	}
+	return nil
+}
+
+// Shutdown interrupts the submission. The queue aborts the jobs when the
+// connection is closed.
+func (submit *Submit) Shutdown() {
+	if submit.conn != nil {
+		submit.conn.Close()
+	}
+}
+
+// vim:set sw=4 ts=4 noet:
@@ -0,0 +1,120 @@
+// Copyright 2013 The Pythia Authors.
+// This file is part of Pythia.
+//
+// Pythia is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, version 3 of the License.
+//
+// Pythia is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Pythia.  If not, see <http://www.gnu.org/licenses/>.
+
+package frontend
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path"
+	"pythia"
+	"testing"
+	"testutils"
+	"testutils/pytest"
+)
+
+func TestSubmit(t *testing.T) {
+	addr, err := pythia.LocalAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pythia.QueueAddr = addr
+	queue, err := pythia.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+	dir, err := ioutil.TempDir("", "pythia-submit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var inputs []string
+	for _, input := range []string{"a", "b"} {
+		name := path.Join(dir, input)
+		if err := ioutil.WriteFile(name, []byte(input), 0644); err != nil {
+			t.Fatal(err)
+		}
+		inputs = append(inputs, name)
+	}
+	submit := NewSubmit()
+	args := append([]string{"-json", "-priority", "3",
+		"-task", path.Join(pytest.TasksDir, "hello-world.task")}, inputs...)
+	if err := submit.Setup(flag.NewFlagSet("submit", flag.ContinueOnError), args); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	submit.out = &out
+	type result struct {
+		ok  bool
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		ok, err := submit.run()
+		done <- result{ok, err}
+	}()
+	conn, err := queue.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &pytest.Conn{T: t, Conn: conn}
+	task := pytest.ReadTask(t, "hello-world")
+	c.Expect(1, pythia.Message{
+		Message:  pythia.LaunchMsg,
+		Id:       "0",
+		Task:     &task,
+		Input:    "a",
+		Priority: 3,
+	}, pythia.Message{
+		Message:  pythia.LaunchMsg,
+		Id:       "1",
+		Task:     &task,
+		Input:    "b",
+		Priority: 3,
+	})
+	c.Send(pythia.Message{Message: pythia.StartedMsg, Id: "1"})
+	c.Send(pythia.Message{
+		Message: pythia.DoneMsg,
+		Id:      "1",
+		Status:  pythia.Timeout,
+		Output:  "B",
+	})
+	c.Send(pythia.Message{
+		Message: pythia.DoneMsg,
+		Id:      "0",
+		Status:  pythia.Success,
+		Output:  "A",
+	})
+	r := <-done
+	c.Close()
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	testutils.Expect(t, "ok", false, r.ok)
+	var results []submitResult
+	if err := json.Unmarshal(out.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	testutils.Expect(t, "results", []submitResult{
+		{Input: inputs[0], Status: pythia.Success, Output: "A"},
+		{Input: inputs[1], Status: pythia.Timeout, Output: "B"},
+	}, results)
+}
+
+// vim:set sw=4 ts=4 noet:
@@ -17,6 +17,8 @@ package pythia
 
 import (
 	"encoding/json"
+	"fmt"
+	"time"
 )
 
 // Status of a task execution.
@@ -32,7 +34,61 @@ const (
 	Fatal    Status = "fatal"    // unrecoverable error (e.g. misformatted task), output = error message
 )
 
+// Limit of a task execution, reported along with statuses timeout and overflow
+// to tell which limit has been exceeded.
+type Limit string
+
+const (
+	TimeLimit    Limit = "time"    // execution (wall-clock) time, status timeout
+	CpuTimeLimit Limit = "cputime" // CPU time, status timeout
+	OutputLimit  Limit = "output"  // size of the output, status overflow
+	StderrLimit  Limit = "stderr"  // size of the standard error, status overflow
+	ResultsLimit Limit = "results" // size of the result files, status overflow
+)
+
+// A StepResult is the outcome of a step of the control file of a task which
+// did not succeed (see Task).
+type StepResult struct {
+	// Line of the step in the control file, starting from 1
+	Line int `json:"line"`
+
+	// Name given to the step in the control file, if any
+	Name string `json:"name,omitempty"`
+
+	// Status of the step: timeout, overflow or crash (which includes
+	// exiting with a non-zero status)
+	Status Status `json:"status"`
+
+	// Limit of the step which has been exceeded, for statuses timeout and
+	// overflow
+	Limit Limit `json:"limit,omitempty"`
+}
+
+// String returns a human-readable description of the step result, such as
+// "compile (line 2): timeout (time)".
+func (step StepResult) String() string {
+	s := fmt.Sprintf("line %d: %s", step.Line, step.Status)
+	if step.Name != "" {
+		s = fmt.Sprintf("%s (line %d): %s", step.Name, step.Line, step.Status)
+	}
+	if step.Limit != "" {
+		s += fmt.Sprintf(" (%s)", step.Limit)
+	}
+	return s
+}
+
 // Task is the description of a task to be run in a sandbox.
+//
+// The task filesystem contains a control file listing the commands to execute,
+// one per line. A command prefixed by '!' is executed as an unprivileged user.
+// A line may start with options enclosed in brackets, which apply to its step:
+//
+//	[name=compile time=10 output=4096 continue] /task/compile.sh
+//
+// The name identifies the step in the results (see StepResult). The step is
+// killed after time seconds, or once it has written more than output bytes
+// (privileged steps only). By default, the execution stops when a privileged
+// step fails or exceeds its limits, unless it is marked continue.
 type Task struct {
 	// Environment is the name of the root filesystem.
 	Environment string `json:"environment"`
@@ -40,11 +96,22 @@ type Task struct {
 	// TaskFS is the relative path to the task filesystem.
 	TaskFS string `json:"taskfs"`
 
+	// Results is the directory of the sandbox whose regular files are
+	// returned with the output once the task is done. If empty, no file is
+	// returned.
+	Results string `json:"results,omitempty"`
+
 	// Execution limits to be enforced in the sandbox.
 	Limits struct {
 		// Maximum execution time in seconds.
 		Time int `json:"time"`
 
+		// Maximum CPU time (user and system) consumed by the sandbox, in
+		// seconds. If zero, only the execution time is limited. Otherwise,
+		// the execution time remains a looser bound, e.g. for tasks waiting
+		// without consuming CPU time.
+		CpuTime int `json:"cputime,omitempty"`
+
 		// Total amount of main memory (in megabytes) allocated
 		// to the sandbox VM.
 		Memory int `json:"memory"`
@@ -55,6 +122,30 @@ type Task struct {
 
 		// Maximum size of the output (in bytes).
 		Output int `json:"output"`
+
+		// Maximum size of the standard error (in bytes). If zero, the
+		// standard error is merged into the output.
+		Stderr int `json:"stderr,omitempty"`
+
+		// Maximum size of the archive of the results directory (in bytes).
+		// If zero, a default limit is used.
+		Results int `json:"results,omitempty"`
+
+		// Maximum number of processes of each user of the sandbox, or of the
+		// whole sandbox for the ns sandbox. If zero, a default limit is used.
+		Processes int `json:"processes,omitempty"`
+
+		// Maximum number of files opened by a process. If zero, the limit
+		// of the environment is kept.
+		OpenFiles int `json:"openfiles,omitempty"`
+
+		// Maximum size of a file written by a process (in kilobytes). If
+		// zero, the size of files is only limited by the disk space.
+		FileSize int `json:"filesize,omitempty"`
+
+		// Maximum size of the stack of a process (in kilobytes). If zero,
+		// the limit of the environment is kept.
+		Stack int `json:"stack,omitempty"`
 	} `json:"limits"`
 }
 
@@ -78,10 +169,31 @@ const (
 	// Pool->Queue
 	RegisterPoolMsg MsgType = "register-pool"
 
+	// Identify the client with a session. The results of the jobs launched
+	// afterwards are delivered to the last connection identified with the same
+	// session, even across queue restarts if the queue journal is enabled.
+	// A pool identifying with the session of a previous connection takes over
+	// the jobs running in it. The queue answers with the jobs of the session
+	// it knows.
+	// Frontend->Queue, Pool->Queue, Queue->Frontend
+	IdentifyMsg MsgType = "identify"
+
 	// Request execution of a task.
 	// Frontend->Queue, Queue->Pool
 	LaunchMsg MsgType = "launch"
 
+	// Job dispatched to a pool. Only sent if requested in the launch message,
+	// or if the output is streamed. A job is dispatched again if its pool is
+	// lost, in which case its output starts over.
+	// Queue->Frontend
+	StartedMsg MsgType = "started"
+
+	// Chunk of the output of a running job. Only sent if requested in the
+	// launch message. Chunks may be lost if a connection is interrupted, but
+	// the done message always contains the whole output.
+	// Pool->Queue, Queue->Frontend
+	OutputMsg MsgType = "output"
+
 	// Job done.
 	// Pool->Queue, Queue->Frontend.
 	DoneMsg MsgType = "done"
@@ -90,8 +202,151 @@ const (
 	// (or another status if the job has ended meanwhile).
 	// Frontend->Queue, Queue->Pool
 	AbortMsg MsgType = "abort"
+
+	// Get the status of the queue. The queue answers with a status message
+	// containing the queue information.
+	// Any->Queue, Queue->Any
+	StatusMsg MsgType = "status"
+
+	// List the jobs known by the queue. The queue answers with a list-jobs
+	// message containing the job list.
+	// Any->Queue, Queue->Any
+	ListJobsMsg MsgType = "list-jobs"
+
+	// Get information about the job with the given (queue) identifier. The
+	// queue answers with a job-info message containing the job information,
+	// or none if the job is unknown.
+	// Any->Queue, Queue->Any
+	JobInfoMsg MsgType = "job-info"
+
+	// Abort the job with the given (queue) identifier, whoever submitted it.
+	// The queue answers with a cancel message, with an error if the job is
+	// not waiting nor running.
+	// Any->Queue, Queue->Any
+	CancelMsg MsgType = "cancel"
+
+	// Stop dispatching jobs to the pool whose connection identifier is given
+	// as id. The jobs running in the pool are not interrupted. The queue
+	// answers with a drain message, with an error if the pool is unknown.
+	// Any->Queue, Queue->Any
+	DrainMsg MsgType = "drain"
+
+	// Resume dispatching jobs to a drained pool. The queue answers with an
+	// undrain message, with an error if the pool is unknown.
+	// Any->Queue, Queue->Any
+	UndrainMsg MsgType = "undrain"
 )
 
+// A JobInfo describes a job known by the queue. Used in introspection
+// messages.
+type JobInfo struct {
+	// The identifier of the job in the queue, prefixed by its origin.
+	Id string `json:"id"`
+
+	// The state of the job: waiting, running, or done (result not delivered
+	// yet).
+	State string `json:"state"`
+
+	// The task of the job.
+	Task *Task `json:"task,omitempty"`
+
+	// The priority of the job.
+	Priority int `json:"priority,omitempty"`
+
+	// The session of the client having submitted the job, if it identified.
+	Session string `json:"session,omitempty"`
+
+	// The identifier of the client having submitted the job, or -1 if the
+	// client is not connected.
+	Client int `json:"client"`
+
+	// The identifier of the pool running the job, or -1 if the job is not
+	// running.
+	Pool int `json:"pool"`
+
+	// Times at which the job has been queued and dispatched to its pool.
+	Queued  *time.Time `json:"queued,omitempty"`
+	Started *time.Time `json:"started,omitempty"`
+}
+
+// A ClientInfo describes a client of the queue (front-end and/or pool). Used
+// in introspection messages.
+type ClientInfo struct {
+	// The identifier of the connection, or -1 for the sessions of the
+	// disconnected clients.
+	Id int `json:"id"`
+
+	// The session of the client, if it identified.
+	Session string `json:"session,omitempty"`
+
+	// Whether the client is connected. Disconnected clients are kept during
+	// the grace period of their session.
+	Connected bool `json:"connected"`
+
+	// The capacity, memory, environments and tasks registered by the pool.
+	Capacity     int      `json:"capacity,omitempty"`
+	Memory       int      `json:"memory,omitempty"`
+	Environments []string `json:"environments,omitempty"`
+	Tasks        []string `json:"tasks,omitempty"`
+
+	// The memory (in megabytes) used by the jobs running in the pool.
+	MemoryUsed int `json:"memoryused,omitempty"`
+
+	// The number of jobs executed by the pool, and the number of them which
+	// have been executed in a sandbox started ahead of time.
+	Executed int `json:"executed,omitempty"`
+	WarmHits int `json:"warmhits,omitempty"`
+
+	// The jobs running in the pool.
+	Running []string `json:"running,omitempty"`
+
+	// The number of jobs submitted by the client that are waiting and
+	// running, respectively.
+	Waiting  int `json:"waiting,omitempty"`
+	InFlight int `json:"inflight,omitempty"`
+
+	// Whether the pool is being drained.
+	Draining bool `json:"draining,omitempty"`
+}
+
+// A QueueInfo describes the state of the queue. Used in introspection
+// messages.
+type QueueInfo struct {
+	// The maximum number of waiting jobs.
+	Capacity int `json:"capacity"`
+
+	// The number of waiting, running and done jobs, respectively.
+	Waiting int `json:"waiting"`
+	Running int `json:"running"`
+	Done    int `json:"done"`
+
+	// The clients of the queue, sorted by identifier.
+	Clients []ClientInfo `json:"clients"`
+}
+
+// A Usage reports the resources used by the execution of a job. Used in done
+// messages.
+type Usage struct {
+	// Wall-clock time of the execution, in seconds.
+	WallTime float64 `json:"walltime"`
+
+	// CPU time (user and system) consumed by the sandbox, in seconds.
+	CpuTime float64 `json:"cputime"`
+
+	// Peak resident memory of the sandbox, in kilobytes.
+	MaxRss int64 `json:"maxrss"`
+
+	// Size of the output and of the standard error produced by the job, in
+	// bytes. They may exceed their limit, in which case they have been
+	// truncated.
+	Output int `json:"output"`
+	Stderr int `json:"stderr,omitempty"`
+
+	// Whether the job has been executed in a sandbox started ahead of time
+	// by the pool.
+	Warm bool `json:"warm,omitempty"`
+}
+
 // A Message is the basic entity that is sent between components. Messages are
 // serialized to JSON.
 type Message struct {
@@ -101,7 +356,42 @@ type Message struct {
 	// The capacity of the pool. Only for message register-pool.
 	Capacity int `json:"capacity,omitempty"`
 
-	// The task identifier. Only for messages launch, done and abort.
+	// The amount of memory (in megabytes) that the sandboxes of the pool may
+	// use in total. Zero means no limit. Only for message register-pool.
+	Memory int `json:"memory,omitempty"`
+
+	// The environments available in the pool. If empty, the pool is assumed
+	// to support all environments. Only for message register-pool.
+	Environments []string `json:"environments,omitempty"`
+
+	// The task filesystems available in the pool. If empty, the pool is
+	// assumed to support all tasks. Only for message register-pool.
+	Tasks []string `json:"tasks,omitempty"`
+
+	// The session of the client. Only for message identify.
+	Session string `json:"session,omitempty"`
+
+	// The identifiers of jobs. For message register-pool, the jobs running in
+	// the pool when it resumes a session (the queue reschedules the other jobs
+	// it dispatched to the session). For message identify sent by the queue,
+	// the jobs of the session waiting or running.
+	Jobs []string `json:"jobs,omitempty"`
+
+	// The queue information. Only for message status sent by the queue.
+	Queue *QueueInfo `json:"queue,omitempty"`
+
+	// The job list. Only for message list-jobs sent by the queue.
+	JobList []JobInfo `json:"joblist,omitempty"`
+
+	// The job information. Only for message job-info sent by the queue.
+	Job *JobInfo `json:"job,omitempty"`
+
+	// The error message if a request failed. Only for the answers of the
+	// queue to messages cancel, drain and undrain.
+	Error string `json:"error,omitempty"`
+
+	// The task identifier. Only for messages launch, done, abort, job-info
+	// and cancel. For messages drain and undrain, the pool identifier.
 	Id string `json:"id,omitempty"`
 
 	// The task to launch. Only for message launch.
@@ -110,11 +400,50 @@ type Message struct {
 	// The input to feed to the task. Only for message launch.
 	Input string `json:"input,omitempty"`
 
+	// The priority of the job. Jobs with a higher priority are scheduled
+	// first. Only for message launch.
+	Priority int `json:"priority,omitempty"`
+
+	// Whether the submitter wants to receive a started message when the job is
+	// dispatched to a pool. Only for message launch.
+	Notify bool `json:"notify,omitempty"`
+
+	// Whether the submitter wants to receive the output of the job while it
+	// is running, in output messages. Only for message launch.
+	Stream bool `json:"stream,omitempty"`
+
 	// The result status of the execution. Only for message done.
 	Status Status `json:"status,omitempty"`
 
-	// The result output of the execution. Only for message done.
+	// The limit which has been exceeded, for statuses timeout and overflow.
+	// Only for message done.
+	Limit Limit `json:"limit,omitempty"`
+
+	// The result output of the execution. Only for message done, and for
+	// message output, where it is the next chunk of the output.
 	Output string `json:"output,omitempty"`
+
+	// The standard error of the execution, if the task limits it separately
+	// from the output. Only for message done.
+	Stderr string `json:"stderr,omitempty"`
+
+	// The steps of the control file of the task which did not succeed, in
+	// order. Only for message done.
+	Steps []StepResult `json:"steps,omitempty"`
+
+	// For message launch, the input files given to the task in addition to
+	// the input, mapped by their path relative to the input directory (see
+	// CheckFiles). For message done, the files of the results directory,
+	// mapped by name, if the task declares one.
+	Files map[string][]byte `json:"files,omitempty"`
+
+	// The JSON document found in the result.json file of the results
+	// directory, if any. Only for message done.
+	Result json.RawMessage `json:"result,omitempty"`
+
+	// The resources used by the execution. Only for message done, if the job
+	// has been executed by a pool.
+	Usage *Usage `json:"usage,omitempty"`
 }
 
 func (msg Message) String() string {
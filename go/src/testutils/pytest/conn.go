@@ -28,6 +28,10 @@ import (
 type Conn struct {
 	T    *testing.T
 	Conn *pythia.Conn
+
+	// Whether to ignore the resource usage of received done messages, which
+	// is not deterministic. Expect then only checks that the usage is present.
+	IgnoreUsage bool
 }
 
 // Dial establishes a test connection.
@@ -36,12 +40,12 @@ func Dial(t *testing.T, addr net.Addr) (*Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Conn{t, conn}, nil
+	return &Conn{T: t, Conn: conn}, nil
 }
 
 // DialRetry establishes a test connection, retrying indefinitely.
 func DialRetry(t *testing.T, addr net.Addr) *Conn {
-	return &Conn{t, pythia.DialRetry(addr)}
+	return &Conn{T: t, Conn: pythia.DialRetry(addr)}
 }
 
 // Send sends a message through the connection.
@@ -59,6 +63,12 @@ func (c *Conn) Expect(timeout int, expected ...pythia.Message) {
 	for i := 0; i < len(expected); i++ {
 		select {
 		case msg := <-c.Conn.Receive():
+			if c.IgnoreUsage && msg.Message == pythia.DoneMsg {
+				if msg.Usage == nil {
+					c.T.Error("<<(missing usage)", msg)
+				}
+				msg.Usage = nil
+			}
 			found := false
 			for i, m := range expected {
 				if !ok[i] && reflect.DeepEqual(msg, m) {
@@ -83,6 +93,18 @@ func (c *Conn) Expect(timeout int, expected ...pythia.Message) {
 	}
 }
 
+// Receive returns the next message read from the connection.
+// If nothing is received for more than timeout seconds, fail and stop the test.
+func (c *Conn) Receive(timeout int) (msg pythia.Message) {
+	select {
+	case msg = <-c.Conn.Receive():
+		c.T.Log("<<", msg)
+	case <-time.After(time.Duration(timeout) * time.Second):
+		c.T.Fatal("<< timed out")
+	}
+	return
+}
+
 // Close checks for an unexpected message waiting in the input channel and
 // closes the connection.
 func (c *Conn) Close() {
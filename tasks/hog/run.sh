@@ -0,0 +1,19 @@
+#!/bin/sh
+# Exceed the limit read on the input: memory or processes.
+read limit
+echo "Start"
+case "$limit" in
+memory)
+    data=a
+    while true; do
+        data="$data$data"
+    done
+    ;;
+processes)
+    for i in 1 2 3 4 5 6 7 8 9 10; do
+        sleep 5 &
+    done
+    wait
+    ;;
+esac
+echo "Done"
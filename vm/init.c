@@ -18,8 +18,14 @@
 #include <stdlib.h>
 #include <stdio.h>
 #include <string.h>
+#include <errno.h>
 #include <signal.h>
 #include <unistd.h>
+#include <fcntl.h>
+#include <dirent.h>
+#include <limits.h>
+#include <poll.h>
+#include <termios.h>
 #include <sys/types.h>
 #include <sys/stat.h>
 #include <sys/time.h>
@@ -37,7 +43,7 @@
 //! Maximum length of the disksize vm parameter.
 #define DISKSIZE_MAXLEN 10
 
-//! Per-user process limit
+//! Default per-user process limit
 #define MAXPROC 100
 
 //! User ID of the privileged non-root user
@@ -52,6 +58,31 @@
 //! Maximum number of arguments in a command of /task/control.
 #define CONTROL_MAXARGS 100
 
+//! Size of the blocks of a tar archive.
+#define TAR_BLOCKSIZE 512
+
+//! Device on which the archive of the results directory is written.
+#define RESULTS_DEVICE "/dev/ubdd"
+
+//! Device containing the archive of the input files.
+#define INPUT_DEVICE "/dev/ubde"
+
+//! Directory in which the input files are extracted.
+#define INPUT_DIR "/tmp/input"
+
+//! Device containing the input.
+#define STDIN_DEVICE "/dev/ubdc"
+
+//! Console on which a warm virtual machine waits for the parameters of its job.
+#define WARM_CONSOLE "/dev/tty2"
+
+//! Maximum length of the parameters of the job of a warm virtual machine.
+#define WARM_MAXLEN 4096
+
+//! Console on which the steps of /task/control which did not succeed are
+//! reported.
+#define STEPS_CONSOLE "/dev/tty3"
+
 /**
  * Shut down the virtual machine.
  */
@@ -196,6 +227,234 @@ static void splitargs(char *cmd, char **argv) {
         die("splitargs", "unbalanced quotes");
 }
 
+/**
+ * Room left for the results archive, or -1 if it is only limited by the size
+ * of the results device.
+ */
+static long results_room = -1;
+
+/**
+ * Write a block of a tar archive.
+ *
+ * @param fd the file descriptor of the archive
+ * @param block the block to write
+ * @return 0 on success, -1 on error (e.g. when the device is full)
+ */
+static int write_block(int fd, const char *block) {
+    if(results_room >= 0) {
+        if(results_room < TAR_BLOCKSIZE)
+            return -1;
+        results_room -= TAR_BLOCKSIZE;
+    }
+    return write(fd, block, TAR_BLOCKSIZE) == TAR_BLOCKSIZE ? 0 : -1;
+}
+
+/**
+ * Write a regular file of the results directory to a tar archive.
+ *
+ * @param fd the file descriptor of the archive
+ * @param dirfd the file descriptor of the results directory
+ * @param name the name of the file
+ * @param st the status of the file
+ * @return 0 on success, -1 on error
+ */
+static int write_result(int fd, int dirfd, const char *name, const struct stat *st) {
+    char block[TAR_BLOCKSIZE];
+    unsigned int sum = 0;
+    off_t remaining;
+    int i, filefd;
+
+    filefd = openat(dirfd, name, O_RDONLY | O_NOFOLLOW);
+    if(filefd < 0)
+        return 0;  // skip files that disappeared
+    // Header, in the ustar format
+    memset(block, 0, TAR_BLOCKSIZE);
+    strcpy(block, name);
+    sprintf(block + 100, "%07o", 0644);
+    sprintf(block + 108, "%07o", 0);
+    sprintf(block + 116, "%07o", 0);
+    sprintf(block + 124, "%011lo", (unsigned long) st->st_size);
+    sprintf(block + 136, "%011lo", (unsigned long) st->st_mtime);
+    memset(block + 148, ' ', 8);
+    block[156] = '0';
+    memcpy(block + 257, "ustar", 6);
+    memcpy(block + 263, "00", 2);
+    for(i = 0; i < TAR_BLOCKSIZE; i++)
+        sum += (unsigned char) block[i];
+    sprintf(block + 148, "%06o", sum);
+    if(write_block(fd, block) < 0) {
+        close(filefd);
+        return -1;
+    }
+    // Content, padded with zeros (also if the file has been truncated)
+    for(remaining = st->st_size; remaining > 0; remaining -= TAR_BLOCKSIZE) {
+        memset(block, 0, TAR_BLOCKSIZE);
+        if(read(filefd, block, remaining < TAR_BLOCKSIZE ? remaining : TAR_BLOCKSIZE) < 0)
+            memset(block, 0, TAR_BLOCKSIZE);
+        if(write_block(fd, block) < 0) {
+            close(filefd);
+            return -1;
+        }
+    }
+    close(filefd);
+    return 0;
+}
+
+/**
+ * Read a block of a tar archive, or die.
+ *
+ * @param fd the file descriptor of the archive
+ * @param block the buffer receiving the block
+ */
+static void read_block(int fd, char *block) {
+    if(read(fd, block, TAR_BLOCKSIZE) != TAR_BLOCKSIZE)
+        die("read " INPUT_DEVICE, "truncated archive");
+}
+
+/**
+ * Check that the name of an input file is relative and stays in INPUT_DIR.
+ *
+ * @param name the name of the file
+ * @return 1 if the name is valid, 0 otherwise
+ */
+static int valid_name(const char *name) {
+    const char *component = name;
+
+    if(name[0] == '/' || name[0] == '\0')
+        return 0;
+    while(component != NULL) {
+        if(strncmp(component, "..", 2) == 0 &&
+                (component[2] == '/' || component[2] == '\0'))
+            return 0;
+        component = strchr(component, '/');
+        if(component != NULL)
+            component++;
+    }
+    return 1;
+}
+
+/**
+ * Extract the archive of the input files in INPUT_DIR, if the "inputfiles" vm
+ * parameter is set.
+ *
+ * The archive, made by the host, only contains regular files in the ustar
+ * format. The files are extracted on a tmpfs, made read-only afterwards, and
+ * are private to the master user.
+ */
+static void import_inputs() {
+    char block[TAR_BLOCKSIZE];
+    char name[TAR_BLOCKSIZE];
+    char *slash;
+    unsigned long remaining;
+    int fd, filefd;
+
+    if(getenv("inputfiles") == NULL)
+        return;
+    check("mkdir " INPUT_DIR, mkdir(INPUT_DIR, 0700));
+    check("mount " INPUT_DIR, mount("none", INPUT_DIR, "tmpfs", MS_NODEV | MS_NOSUID, "mode=700,uid=1,gid=0"));
+    check("chdir " INPUT_DIR, chdir(INPUT_DIR));
+    fd = open(INPUT_DEVICE, O_RDONLY);
+    if(fd < 0)
+        die("open " INPUT_DEVICE, NULL);
+    for(;;) {
+        read_block(fd, block);
+        if(block[0] == '\0')
+            break;  // end of archive
+        if(block[156] != '0' && block[156] != '\0')
+            die("read " INPUT_DEVICE, "unsupported entry");
+        memcpy(name, block, 100);
+        name[100] = '\0';
+        if(!valid_name(name))
+            die("read " INPUT_DEVICE, "invalid file name");
+        // Create the directories of the file
+        for(slash = strchr(name, '/'); slash != NULL; slash = strchr(slash + 1, '/')) {
+            *slash = '\0';
+            if(mkdir(name, 0700) < 0 && errno != EEXIST)
+                die("mkdir", NULL);
+            check("chown", chown(name, UID_MASTER, 0));
+            *slash = '/';
+        }
+        filefd = open(name, O_WRONLY | O_CREAT | O_EXCL | O_NOFOLLOW, 0600);
+        if(filefd < 0)
+            die("open", NULL);
+        check("chown", fchown(filefd, UID_MASTER, 0));
+        for(remaining = strtoul(block + 124, NULL, 8); remaining > 0;
+                remaining -= remaining < TAR_BLOCKSIZE ? remaining : TAR_BLOCKSIZE) {
+            read_block(fd, block);
+            if(write(filefd, block, remaining < TAR_BLOCKSIZE ? remaining : TAR_BLOCKSIZE) < 0)
+                die("write", NULL);
+        }
+        close(filefd);
+    }
+    close(fd);
+    check("chdir /", chdir("/"));
+    check("remount " INPUT_DIR, mount("none", INPUT_DIR, NULL, MS_REMOUNT | MS_RDONLY | MS_NODEV | MS_NOSUID, NULL));
+}
+
+/**
+ * Archive the regular files of the results directory given by the "results"
+ * vm parameter on the results device, if the parameter is set.
+ *
+ * The archive is written until the device is full, such that the host detects
+ * an archive which does not fit. If the "resultsize" vm parameter is set, the
+ * device is deemed to be of that size. Errors are ignored, as the output of the
+ * task shall not be altered.
+ */
+static void export_results() {
+    const char *dir, *size;
+    char block[TAR_BLOCKSIZE];
+    struct dirent *entry;
+    struct stat st;
+    DIR *d = NULL;
+    int fd, dfd;
+
+    dir = getenv("results");
+    if(dir == NULL)
+        return;
+    size = getenv("resultsize");
+    if(size != NULL)
+        results_room = strtol(size, NULL, 10);
+    fd = open(RESULTS_DEVICE, O_WRONLY);
+    if(fd < 0)
+        return;
+    // Do not follow a symbolic link to another directory
+    dfd = open(dir, O_RDONLY | O_DIRECTORY | O_NOFOLLOW);
+    if(dfd >= 0) {
+        d = fdopendir(dfd);
+        if(d == NULL)
+            close(dfd);
+    }
+    if(d != NULL) {
+        while((entry = readdir(d)) != NULL) {
+            // Skip anything but regular files, and names not fitting the header
+            if(fstatat(dfd, entry->d_name, &st, AT_SYMLINK_NOFOLLOW) < 0 ||
+                    !S_ISREG(st.st_mode) || strlen(entry->d_name) >= 100)
+                continue;
+            if(write_result(fd, dfd, entry->d_name, &st) < 0) {
+                closedir(d);
+                close(fd);
+                return;
+            }
+        }
+        closedir(d);
+    }
+    // End of archive
+    memset(block, 0, TAR_BLOCKSIZE);
+    write_block(fd, block);
+    write_block(fd, block);
+    fsync(fd);
+    close(fd);
+}
+
+/**
+ * Kill the remaining processes, export the results and shut down.
+ */
+static void finish() {
+    kill(-1, SIGKILL);
+    export_results();
+    shutdown();
+}
+
 /**
  * Environment used when launching programs.
  */
@@ -206,51 +465,238 @@ static char *const ENVIRONMENT[] = {
     NULL
 };
 
+/**
+ * Options of a step of /task/control.
+ */
+struct step {
+    int line;               //!< line of the step in /task/control, from 1
+    const char *name;       //!< name of the step, or NULL
+    unsigned int time;      //!< time limit in seconds, or 0
+    unsigned long output;   //!< output limit in bytes, or 0
+    int cont;               //!< whether to continue if the step fails
+};
+
+/**
+ * Outcome of a step of /task/control.
+ */
+enum step_status {
+    STEP_SUCCESS,
+    STEP_CRASH,
+    STEP_TIMEOUT,
+    STEP_OVERFLOW
+};
+
 /**
  * Handle to the /task/control file used in run_control.
  * It is defined here so launch() can close it in the child process.
  */
 static FILE *fcontrol;
 
+/**
+ * File descriptor of the second console, to which the standard error of the
+ * master programs is redirected, or -1 if the standard error goes to the
+ * output. It is opened close-on-exec, so programs do not inherit it.
+ */
+static int errfd = -1;
+
+/**
+ * File descriptor of the console on which the steps are reported, or -1.
+ */
+static int stepsfd = -1;
+
+/**
+ * Parse a limit given as a decimal number, or die with fname in the error
+ * message.
+ */
+static unsigned long parse_limit(const char *fname, const char *value) {
+    char *end;
+    unsigned long limit;
+
+    errno = 0;
+    limit = strtoul(value, &end, 10);
+    if(value[0] < '0' || value[0] > '9' || *end != '\0' || errno != 0 ||
+            limit > INT_MAX)
+        die(fname, "invalid limit");
+    return limit;
+}
+
+/**
+ * Resource limits of the programs of /task/control, set from the vm parameters
+ * of the same name (see read_limits). A value of 0 keeps the default limit.
+ */
+static struct {
+    const char *param;  //!< name of the vm parameter
+    int resource;       //!< resource
+    rlim_t unit;        //!< unit of the parameter, in units of the resource
+    rlim_t value;       //!< limit
+} limits[] = {
+    {"processes", RLIMIT_NPROC,  1,    MAXPROC},
+    {"openfiles", RLIMIT_NOFILE, 1,    0},
+    {"filesize",  RLIMIT_FSIZE,  1024, 0},
+    {"stack",     RLIMIT_STACK,  1024, 0},
+};
+
+/**
+ * Read the resource limits of the programs from the vm parameters.
+ */
+static void read_limits() {
+    const char *value;
+    size_t i;
+
+    for(i = 0; i < sizeof(limits) / sizeof(limits[0]); i++) {
+        value = getenv(limits[i].param);
+        if(value != NULL)
+            limits[i].value = parse_limit(limits[i].param, value) * limits[i].unit;
+    }
+}
+
+/**
+ * Apply the resource limits of the programs to the calling process. It is
+ * called in the child process launching a program, before changing users.
+ */
+static void set_limits() {
+    struct rlimit rlim;
+    size_t i;
+
+    for(i = 0; i < sizeof(limits) / sizeof(limits[0]); i++) {
+        if(limits[i].value == 0)
+            continue;
+        rlim.rlim_max = rlim.rlim_cur = limits[i].value;
+        childcheck("setrlimit", setrlimit(limits[i].resource, &rlim));
+    }
+}
+
+/**
+ * Signal mask of init before SIGALRM and SIGCHLD were blocked. These signals
+ * are only delivered while waiting for a step, and programs are launched with
+ * this mask.
+ */
+static sigset_t unblocked;
+
+/**
+ * Set by the signal handler when the time limit of the step is exceeded, and
+ * when a child process terminates.
+ */
+static volatile sig_atomic_t alarmed, exited;
+
+/**
+ * Handle SIGALRM and SIGCHLD.
+ */
+static void handle_signal(int sig) {
+    if(sig == SIGALRM)
+        alarmed = 1;
+    else
+        exited = 1;
+}
+
 /**
  * Launches a program and wait for it to finish.
  *
  * If uid is not UID_MASTER, the standard input and output will be redirected
- * to /dev/null.
+ * to /dev/null. Otherwise, the standard error is redirected to errfd, if open.
  *
- * If uid is UID_MASTER and the program exits with non-zero status (or an error
- * occurs during the setup of the child process), the vm will be shut down.
+ * The program is killed when it exceeds the limits of its step. The output
+ * limit only applies if uid is UID_MASTER: the output (including the standard
+ * error if it is not kept apart) is then copied through a pipe, up to the
+ * limit. The step ends when the program terminates; its remaining processes
+ * are killed.
  *
  * The umask also depends on uid. For UID_MASTER, files will be private by
  * default. For other users, files will be public by default.
  *
  * @param cmd the command to execute (will be modified)
  * @param uid the user id that will execute the program
+ * @param step the options of the step
+ * @return the outcome of the step, STEP_CRASH if the program exits with
+ *         non-zero status (or an error occurs during the setup of the child
+ *         process)
  */
-static void launch(char *cmd, uid_t uid) {
+static enum step_status launch(char *cmd, uid_t uid, const struct step *step) {
     char *argv[CONTROL_MAXARGS+1];
-    pid_t pid;
-    int status;
+    char buffer[4096];
+    struct pollfd pfd;
+    unsigned long written = 0;
+    int fds[2] = {-1, -1};
+    int status = 0, st, reaped = 0, timeout = 0, overflow = 0;
+    ssize_t n;
+    pid_t pid, w;
 
     splitargs(cmd, argv);
+    if(uid == UID_MASTER && step->output > 0)
+        check("pipe", pipe2(fds, O_CLOEXEC));
+    alarmed = exited = 0;
     pid = fork();
     if(pid < 0) {
         // Error
         die("fork", NULL);
     } else if(pid > 0) {
         // Parent
-        waitpid(pid, &status, 0);
-        if(uid == UID_MASTER &&
-                (!WIFEXITED(status) || WEXITSTATUS(status) != 0))
-            shutdown();
+        if(fds[1] >= 0)
+            close(fds[1]);
+        alarm(step->time);
+        pfd.fd = fds[0];
+        pfd.events = POLLIN;
+        // Signals are only delivered during ppoll, which waits for the output
+        // if it goes through the pipe.
+        while(!reaped || pfd.fd >= 0) {
+            if(ppoll(&pfd, pfd.fd >= 0, NULL, &unblocked) > 0) {
+                n = read(pfd.fd, buffer, sizeof(buffer));
+                if(n <= 0) {
+                    close(pfd.fd);
+                    pfd.fd = -1;
+                } else if(!overflow) {
+                    if(written + n > step->output) {
+                        n = step->output - written;
+                        overflow = 1;
+                        kill(-1, SIGKILL);
+                    }
+                    fwrite(buffer, 1, n, stdout);
+                    fflush(stdout);
+                    written += n;
+                }
+            }
+            if(exited) {
+                exited = 0;
+                while((w = waitpid(-1, &st, WNOHANG)) > 0) {
+                    if(w == pid) {
+                        status = st;
+                        reaped = 1;
+                        // Kill the remaining processes holding the pipe
+                        kill(-1, SIGKILL);
+                    }
+                }
+            }
+            if(alarmed && !reaped) {
+                alarmed = 0;
+                timeout = 1;
+                kill(-1, SIGKILL);
+            }
+        }
+        alarm(0);
+        if(overflow)
+            return STEP_OVERFLOW;
+        if(timeout)
+            return STEP_TIMEOUT;
+        if(!WIFEXITED(status) || WEXITSTATUS(status) != 0)
+            return STEP_CRASH;
+        return STEP_SUCCESS;
     } else {
         // Child
         childcheck("close /task/control", fclose(fcontrol));
+        childcheck("set signal mask", sigprocmask(SIG_SETMASK, &unblocked, NULL));
+        set_limits();
         if(uid == UID_MASTER) {
             childcheck("set gid", setgid(0));
             childcheck("set uid", setuid(uid));
             // Make new files private to master by default
             umask(077);
+            if(fds[1] >= 0) {
+                childcheck("redirect stdout", dup2(fds[1], STDOUT_FILENO) < 0);
+                if(errfd < 0)
+                    childcheck("redirect stderr", dup2(fds[1], STDERR_FILENO) < 0);
+            }
+            if(errfd >= 0)
+                childcheck("redirect stderr", dup2(errfd, STDERR_FILENO) < 0);
         } else {
             childcheck("set gid", setgid(2));
             childcheck("set uid", setuid(uid));
@@ -265,15 +711,84 @@ static void launch(char *cmd, uid_t uid) {
         execve(argv[0], argv, ENVIRONMENT);
         childcheck("execve", 1);  // if we arrive here, there was an error launching cmd.
     }
+    return STEP_CRASH;
+}
+
+/**
+ * Parse the options of a step of /task/control.
+ *
+ * A line may start with options enclosed in brackets and separated by
+ * whitespace: name=NAME, time=SECONDS, output=BYTES and continue. The command
+ * may be separated from the options by whitespace.
+ *
+ * @param line the line (will be modified)
+ * @param step will contain the options
+ * @return the command of the line
+ */
+static char *parse_step(char *line, struct step *step) {
+    char *end, *opt, *saveptr;
+
+    step->name = NULL;
+    step->time = 0;
+    step->output = 0;
+    step->cont = 0;
+    if(line[0] != '[')
+        return line;
+    end = strchr(line, ']');
+    if(end == NULL)
+        die("/task/control", "unterminated step options");
+    *end = '\0';
+    for(opt = strtok_r(line + 1, " \t", &saveptr); opt != NULL;
+            opt = strtok_r(NULL, " \t", &saveptr)) {
+        if(strcmp(opt, "continue") == 0)
+            step->cont = 1;
+        else if(strncmp(opt, "name=", 5) == 0 && opt[5] != '\0')
+            step->name = opt + 5;
+        else if(strncmp(opt, "time=", 5) == 0)
+            step->time = parse_limit("/task/control", opt + 5);
+        else if(strncmp(opt, "output=", 7) == 0)
+            step->output = parse_limit("/task/control", opt + 7);
+        else
+            die("/task/control", "invalid step option");
+    }
+    for(line = end + 1; *line == ' ' || *line == '\t'; line++)
+        ;
+    return line;
+}
+
+/**
+ * Report a step which did not succeed on stepsfd, if open.
+ *
+ * @param step the options of the step
+ * @param status the outcome of the step
+ * @param stop whether the step ends the execution
+ */
+static void report_step(const struct step *step, enum step_status status, int stop) {
+    static const char *const names[] = {"success", "crash", "timeout", "overflow"};
+    static const char *const limits[] = {"-", "-", "time", "output"};
+
+    if(stepsfd < 0)
+        return;
+    dprintf(stepsfd, "%d %s %s %s %s\n", step->line, names[status],
+            limits[status], stop ? "stop" : "continue",
+            step->name != NULL ? step->name : "");
 }
 
 /**
  * Read /task/control and execute the commands.
  * The file contains one command per line. If a line starts with '!', it will
- * be run unprivileged.
+ * be run unprivileged. The line may start with the options of its step (see
+ * parse_step).
+ *
+ * If a command run by UID_MASTER fails or exceeds the limits of its step, the
+ * execution stops, unless the step has the continue option.
  */
 static void run_control() {
     char line[CONTROL_MAXLEN+1];
+    char *cmd;
+    struct step step;
+    enum step_status result;
+    int stop;
     int n, i, id;
     struct shminfo shminfo;
     struct shmid_ds shm;
@@ -291,12 +806,22 @@ static void run_control() {
     fcontrol = fopen("/task/control", "r");
     if(fcontrol == NULL)
         die("open /task/control", NULL);
+    step.line = 0;
     while(fgets(line, CONTROL_MAXLEN+1, fcontrol) != NULL) {
         // Launch command
-        if(line[0] == '!')
-            launch(line + 1, UID_WORKER);
-        else
-            launch(line, UID_MASTER);
+        step.line++;
+        cmd = parse_step(line, &step);
+        if(cmd[0] == '!') {
+            result = launch(cmd + 1, UID_WORKER, &step);
+            stop = 0;
+        } else {
+            result = launch(cmd, UID_MASTER, &step);
+            stop = result != STEP_SUCCESS && !step.cont;
+        }
+        if(result != STEP_SUCCESS)
+            report_step(&step, result, stop);
+        if(stop)
+            return;
 
         // Cleanup
         // Kill processes
@@ -336,6 +861,88 @@ static void run_control() {
     }
 }
 
+/**
+ * Wait for the parameters of the job, if the "warm" vm parameter is set.
+ *
+ * A warm virtual machine is booted before its job is known. It tells the host
+ * that it is ready on WARM_CONSOLE, and waits there for a line of
+ * space-separated name=value parameters, which are set as environment
+ * variables, as the vm parameters of a cold boot. The host fills the devices of
+ * the job before sending the line.
+ */
+static void wait_job() {
+    static char params[WARM_MAXLEN];  // kept in the environment by putenv
+    struct termios tio;
+    char *param, *saveptr;
+    size_t len = 0;
+    ssize_t n;
+    int fd;
+
+    if(getenv("warm") == NULL)
+        return;
+    fd = open(WARM_CONSOLE, O_RDWR | O_CLOEXEC);
+    if(fd < 0)
+        die("open " WARM_CONSOLE, NULL);
+    check("tcgetattr", tcgetattr(fd, &tio));
+    cfmakeraw(&tio);
+    check("tcsetattr", tcsetattr(fd, TCSANOW, &tio));
+    check("write " WARM_CONSOLE, write(fd, "ready\n", 6) != 6);
+    while(len == 0 || params[len-1] != '\n') {
+        if(len == WARM_MAXLEN)
+            die("read " WARM_CONSOLE, "parameters are too long");
+        n = read(fd, params + len, WARM_MAXLEN - len);
+        if(n < 0)
+            die("read " WARM_CONSOLE, NULL);
+        if(n == 0)
+            die("read " WARM_CONSOLE, "console closed");
+        len += n;
+    }
+    params[len-1] = '\0';
+    close(fd);
+    for(param = strtok_r(params, " ", &saveptr); param != NULL;
+            param = strtok_r(NULL, " ", &saveptr)) {
+        if(strchr(param, '=') != NULL)
+            check("putenv", putenv(param));
+    }
+}
+
+/**
+ * Open the input as standard input.
+ *
+ * If the "inputsize" vm parameter is set, the input device is larger than the
+ * input, which is then copied to an anonymous file, opened read-only.
+ */
+static void open_input() {
+    const char *size;
+    char buffer[4096], path[32];
+    unsigned long remaining;
+    ssize_t n;
+    int in, fd;
+
+    size = getenv("inputsize");
+    if(size == NULL) {
+        check("open " STDIN_DEVICE, freopen(STDIN_DEVICE, "r", stdin) == NULL);
+        return;
+    }
+    in = open(STDIN_DEVICE, O_RDONLY);
+    if(in < 0)
+        die("open " STDIN_DEVICE, NULL);
+    fd = open("/tmp", O_TMPFILE | O_WRONLY, 0400);
+    if(fd < 0)
+        die("open /tmp", NULL);
+    for(remaining = strtoul(size, NULL, 10); remaining > 0; remaining -= n) {
+        n = read(in, buffer, remaining < sizeof(buffer) ? remaining : sizeof(buffer));
+        if(n <= 0)
+            die("read " STDIN_DEVICE, "truncated input");
+        if(write(fd, buffer, n) != n)
+            die("write /tmp", NULL);
+    }
+    close(in);
+    snprintf(path, sizeof(path), "/proc/self/fd/%d", fd);
+    check("open input", freopen(path, "r", stdin) == NULL);
+    close(fd);
+}
+
 #define TMPFS_PARAMS "mode=777,size="
 
 /**
@@ -345,7 +952,11 @@ int main() {
     const char *disksize;
     size_t disksize_len;
     char tmpfsdata[sizeof(TMPFS_PARAMS)+DISKSIZE_MAXLEN];
-    struct rlimit rlim;
+    struct sigaction sa;
+    sigset_t blocked;
+
+    // Wait for the job if booted ahead of time
+    wait_job();
 
     // Parse environment variables
     disksize = getenv("disksize");
@@ -357,6 +968,26 @@ int main() {
     memcpy(tmpfsdata, TMPFS_PARAMS, sizeof(TMPFS_PARAMS)-1);
     memcpy(tmpfsdata+sizeof(TMPFS_PARAMS)-1, disksize, disksize_len+1);
 
+    // Keep the standard error apart from the output if asked to
+    if(getenv("stderr") != NULL) {
+        errfd = open("/dev/tty1", O_WRONLY | O_CLOEXEC);
+        check("open /dev/tty1", errfd < 0);
+    }
+
+    // Report the steps which did not succeed, if the host listens
+    stepsfd = open(STEPS_CONSOLE, O_WRONLY | O_CLOEXEC);
+
+    // Catch the signals used to wait for the steps
+    memset(&sa, 0, sizeof(sa));
+    sa.sa_handler = handle_signal;
+    sigemptyset(&sa.sa_mask);
+    check("sigaction", sigaction(SIGALRM, &sa, NULL));
+    check("sigaction", sigaction(SIGCHLD, &sa, NULL));
+    sigemptyset(&blocked);
+    sigaddset(&blocked, SIGALRM);
+    sigaddset(&blocked, SIGCHLD);
+    check("sigprocmask", sigprocmask(SIG_BLOCK, &blocked, &unblocked));
+
     // Mount essential filesystems
     check("mount /proc", mount("proc",      "/proc", "proc",     MS_NODEV | MS_NOSUID | MS_NOEXEC, NULL));
     check("mount /sys",  mount("sys",       "/sys",  "sysfs",    MS_NODEV | MS_NOSUID | MS_NOEXEC, NULL));
@@ -365,18 +996,20 @@ int main() {
     // Mount task filesystem
     check("mount /task", mount("/dev/ubdb", "/task", "squashfs", MS_NODEV | MS_NOSUID | MS_RDONLY, NULL));
 
-    // Limit the number of processes a user may create
-    rlim.rlim_max = rlim.rlim_cur = MAXPROC;
-    check("setrlimit", setrlimit(RLIMIT_NPROC, &rlim));
+    // Extract input files
+    import_inputs();
+
+    // Read the limits of the programs
+    read_limits();
 
     // Open input file
-    check("open /dev/ubdc", freopen("/dev/ubdc", "r", stdin) == NULL);
+    open_input();
 
     // Do real work
     run_control();
 
     // Finish
-    shutdown();
+    finish();
     return 0;
 }
 
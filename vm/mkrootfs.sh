@@ -110,9 +110,14 @@ full            c       1       7       666
 random          c       1       8       666
 urandom         c       1       9       666
 console         c       5       1       600
+tty1            c       4       1       600
+tty2            c       4       2       600
+tty3            c       4       3       600
 ubda            b       98      0       400
 ubdb            b       98      16      400
 ubdc            b       98      32      400
+ubdd            b       98      48      600
+ubde            b       98      64      400
 EOF
 
 # Create users